@@ -0,0 +1,139 @@
+// Package cli implements the proxserver and proxsize commands.
+package cli
+
+import (
+    "crypto/tls"
+    "errors"
+    "fmt"
+    "io"
+    "maps"
+    "os"
+    "slices"
+    "sort"
+    "strings"
+    "text/tabwriter"
+    "github.com/SrLiath/ProxSize/config"
+    "github.com/SrLiath/ProxSize/router"
+)
+
+// Check validates the config file the way a reload would, also loading the
+// certificate and key files it references, and prints the routes each port
+// would serve. It returns the exit code for proxserver -check.
+func Check(configFile string) int {
+    content, err := config.Read(configFile)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+        return 1
+    }
+    rules, allowedPorts, err := config.Parse(content)
+    if err == nil {
+        err = errors.Join(checkFiles(rules)...)
+    }
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "❌ %s is invalid:\n%v\n", configFile, err)
+        return 1
+    }
+    fmt.Printf("✅ %s is valid\n\n", configFile)
+    printRouteTable(os.Stdout, rules, allowedPorts)
+    return 0
+}
+
+// checkFiles loads the files a config refers to. A reload only logs these
+// errors, since the files can change independently of the config.
+func checkFiles(rules config.Rules) []error {
+    var problems []error
+    for kind, entries := range map[string]map[string]config.RouteEntry{
+        "path":      rules.Path,
+        "subdomain": rules.Subdomain,
+        "domain":    rules.Domain,
+        "tcp":       rules.TCP,
+    } {
+        for key, entry := range entries {
+            at := "$." + kind + config.JSONKey(key)
+            if entry.JWT != nil {
+                if _, err := router.NewJWTVerifier(entry.JWT); err != nil {
+                    problems = append(problems, fmt.Errorf("%s.jwt: %v", at, err))
+                }
+            }
+            if entry.ClientCert != nil {
+                if _, err := router.NewClientCertPolicy(entry.ClientCert); err != nil {
+                    problems = append(problems, fmt.Errorf("%s.client_cert: %v", at, err))
+                }
+            }
+        }
+    }
+    for port, lc := range rules.Listeners {
+        if lc.TLS == nil {
+            continue
+        }
+        if _, err := tls.LoadX509KeyPair(lc.TLS.CertFile, lc.TLS.KeyFile); err != nil {
+            problems = append(problems, fmt.Errorf("$.listeners[%q].tls: %v", fmt.Sprint(port), err))
+        }
+    }
+    sort.Slice(problems, func(i, j int) bool { return problems[i].Error() < problems[j].Error() })
+    return problems
+}
+
+// printRouteTable prints the routes each listener would serve, in the order
+// requests are matched against them: rules without a port go to every
+// allowed port, ports without rules aren't started, and tcp:// subdomains
+// and tcp rules are served by the multiplexer on tcp_port.
+func printRouteTable(w io.Writer, rules config.Rules, allowedPorts []int) {
+    tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+    defer tw.Flush()
+    sections := []struct {
+        kind    string
+        entries map[string]config.RouteEntry
+    }{{"path", rules.Path}, {"subdomain", rules.Subdomain}, {"domain", rules.Domain}}
+    for _, port := range allowedPorts {
+        // Rules for this port come before any-port rules, as in
+        // router.Table.Routes, and are then listed in match order.
+        var specific, anyPort []router.Route
+        for _, section := range sections {
+            for key, entry := range section.entries {
+                route := router.Route{Type: section.kind, Key: key, Target: entry.Target}
+                if entry.Port == port {
+                    specific = append(specific, route)
+                } else if entry.Port == 0 {
+                    anyPort = append(anyPort, route)
+                }
+            }
+        }
+        routes := append(specific, anyPort...)
+        router.Sort(routes)
+        var rows []string
+        for _, route := range routes {
+            rows = append(rows, fmt.Sprintf("  %s\t%s\t-> %s", route.Type, route.Key, route.Target))
+        }
+        if len(rows) == 0 {
+            fmt.Fprintf(tw, "Port %d: no rules, not started\n\n", port)
+            continue
+        }
+        proto := "HTTP"
+        if rules.Listeners[port].TLS != nil {
+            proto = "HTTPS"
+        }
+        fmt.Fprintf(tw, "Port %d (%s)\n", port, proto)
+        for _, row := range rows {
+            fmt.Fprintln(tw, row)
+        }
+        fmt.Fprintln(tw)
+    }
+    var tcpRows []string
+    for _, section := range []struct {
+        kind    string
+        entries map[string]config.RouteEntry
+    }{{"subdomain", rules.Subdomain}, {"tcp", rules.TCP}} {
+        for _, key := range slices.Sorted(maps.Keys(section.entries)) {
+            if target := section.entries[key].Target; strings.HasPrefix(target, "tcp://") {
+                tcpRows = append(tcpRows, fmt.Sprintf("  %s\t%s\t-> %s", section.kind, key, target))
+            }
+        }
+    }
+    if len(tcpRows) > 0 {
+        fmt.Fprintf(tw, "Port %d (TCP)\n", rules.TCPPort)
+        for _, row := range tcpRows {
+            fmt.Fprintln(tw, row)
+        }
+    }
+}
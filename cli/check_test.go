@@ -0,0 +1,101 @@
+package cli
+
+import (
+    "os"
+    "strings"
+    "testing"
+    "github.com/SrLiath/ProxSize/config"
+    "path/filepath"
+)
+
+func TestPrintRouteTable(t *testing.T) {
+    rules, ports, err := config.Parse([]byte(`{
+        "allowed_ports": [80, 443, 8080],
+        "tcp_port": 2200,
+        "path": {"/": {"target": "http://web"}, "/api": {"target": "http://api"}, "/admin": {"target": "http://admin", "port": 443}},
+        "subdomain": {"app": {"target": "http://app", "port": 80}, "db": {"target": "tcp://db:5432"}},
+        "domain": {"example.com": {"target": "http://site", "port": 443}},
+        "tcp": {"ssh": {"target": "tcp://host:22"}},
+        "listeners": {"443": {"tls": {"cert_file": "c.pem", "key_file": "k.pem"}}}
+    }`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    var out strings.Builder
+    printRouteTable(&out, rules, ports)
+    want := `Port 80 (HTTP)
+  subdomain  app   -> http://app
+  subdomain  db    -> tcp://db:5432
+  path       /api  -> http://api
+  path       /     -> http://web
+
+Port 443 (HTTPS)
+  domain     example.com  -> http://site
+  subdomain  db           -> tcp://db:5432
+  path       /admin       -> http://admin
+  path       /api         -> http://api
+  path       /            -> http://web
+
+Port 8080 (HTTP)
+  subdomain  db    -> tcp://db:5432
+  path       /api  -> http://api
+  path       /     -> http://web
+
+Port 2200 (TCP)
+  subdomain  db   -> tcp://db:5432
+  tcp        ssh  -> tcp://host:22
+`
+    if out.String() != want {
+        t.Errorf("route table:\n%s\nwant:\n%s", out.String(), want)
+    }
+
+    out.Reset()
+    printRouteTable(&out, config.Rules{Path: map[string]config.RouteEntry{"/": {Target: "http://web", Port: 80}}}, []int{80, 81})
+    if !strings.Contains(out.String(), "Port 81: no rules, not started") {
+        t.Errorf("route table:\n%s\nwant port 81 marked as not started", out.String())
+    }
+}
+
+func TestCheck(t *testing.T) {
+    dir := t.TempDir()
+    write := func(name, content string) string {
+        file := filepath.Join(dir, name)
+        if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+            t.Fatal(err)
+        }
+        return file
+    }
+    tests := []struct {
+        name   string
+        file   string
+        status int
+    }{
+        {"valid", write("valid.json", `{"allowed_ports": [80], "path": {"/": {"target": "http://web"}}}`), 0},
+        {"invalid", write("invalid.json", `{"allowed_ports": [80], "path": {"api": {"target": "http://web"}}}`), 1},
+        {"missing file", filepath.Join(dir, "missing.json"), 1},
+        {"missing certificate", write("tls.json", `{"allowed_ports": [443], "path": {"/": {"target": "http://web"}},
+            "listeners": {"443": {"tls": {"cert_file": "/nonexistent/c.pem", "key_file": "/nonexistent/k.pem"}}}}`), 1},
+        {"missing JWT key", write("jwt.json", `{"allowed_ports": [80], "path": {"/": {"target": "http://web",
+            "jwt": {"public_key_file": "/nonexistent/key.pem"}}}}`), 1},
+        {"missing client CA", write("mtls.json", `{"allowed_ports": [80], "path": {"/": {"target": "http://web",
+            "client_cert": {"ca_file": "/nonexistent/ca.pem"}}}}`), 1},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := Check(tt.file); got != tt.status {
+                t.Errorf("Check(%s) = %d, want %d", filepath.Base(tt.file), got, tt.status)
+            }
+        })
+    }
+}
+
+func TestCheckFiles(t *testing.T) {
+    rules := config.Rules{
+        Path: map[string]config.RouteEntry{"/": {Target: "http://web", ClientCert: &config.ClientCertConfig{CAFile: "/nonexistent/ca.pem"}}},
+        Listeners: map[int]config.ListenerConfig{443: {TLS: &config.TLSConfig{CertFile: "/nonexistent/c.pem", KeyFile: "/nonexistent/k.pem"}}},
+    }
+    problems := checkFiles(rules)
+    if len(problems) != 2 || !strings.HasPrefix(problems[0].Error(), `$.listeners["443"].tls: `) || !strings.HasPrefix(problems[1].Error(), `$.path["/"].client_cert: `) {
+        t.Errorf("checkFiles() = %v, want the certificate and CA problems with their paths", problems)
+    }
+}
@@ -0,0 +1,28 @@
+package cli
+
+import (
+    "fmt"
+    "os"
+    "github.com/SrLiath/ProxSize/config"
+)
+
+// Migrate upgrades the config at configFile to the current schema version in
+// place and prints what changed. It returns the exit code for proxsize
+// migrate.
+func Migrate(configFile string) int {
+    changes, err := config.MigrateFile(configFile)
+    if len(changes) > 0 {
+        fmt.Printf("🔁 Migrated %s to version %d:\n", configFile, config.CurrentVersion)
+        for _, change := range changes {
+            fmt.Printf("  %s\n", change)
+        }
+    }
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+        return 1
+    }
+    if len(changes) == 0 {
+        fmt.Printf("✅ %s is already at version %d\n", configFile, config.CurrentVersion)
+    }
+    return 0
+}
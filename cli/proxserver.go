@@ -0,0 +1,39 @@
+package cli
+
+import (
+    "flag"
+    "fmt"
+    "log"
+    "os"
+    "github.com/SrLiath/ProxSize/config"
+    "github.com/SrLiath/ProxSize/proxy"
+)
+
+// RunProxserver runs proxserver with the given command line arguments and
+// returns its exit code.
+func RunProxserver(args []string) int {
+    fs := flag.NewFlagSet("proxserver", flag.ExitOnError)
+    configArg := fs.String("config", "", "Config file or conf.d directory (default $PROXSIZE_CONFIG, then proxies.json next to the executable)")
+    check := fs.Bool("check", false, "Validate the config (or the file given as argument), print the routes per port and exit")
+    fs.Parse(args)
+    configFile, err := config.Locate(*configArg)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+        return 1
+    }
+    if *check {
+        if fs.NArg() > 0 {
+            configFile = fs.Arg(0)
+        }
+        return Check(configFile)
+    }
+    server := proxy.NewServer(configFile)
+    go func() {
+        if err := watchConfig(configFile, server.RequestReload); err != nil {
+            log.Printf("⚠️ Not watching %s for changes: %v", configFile, err)
+        }
+    }()
+    go watchUpgradeSignal(server.RequestUpgrade)
+    server.Run()
+    return 0
+}
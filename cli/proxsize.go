@@ -1,63 +1,68 @@
-package main
+package cli
 
 import (
-    "encoding/json"
     "flag"
     "fmt"
     "log"
     "os"
     "strings"
-    "path/filepath"
+    "github.com/SrLiath/ProxSize/config"
 )
 
-type RouteEntry struct {
-    Target string `json:"target"`
-    Port   int    `json:"port,omitempty"`
-}
-
-type ProxyRules struct {
-    Path         map[string]RouteEntry `json:"path"`
-    Subdomain    map[string]RouteEntry `json:"subdomain"`
-    Domain       map[string]RouteEntry `json:"domain"`
-    TCP          map[string]RouteEntry `json:"tcp"`
-    AllowedPorts []int                 `json:"allowed_ports,omitempty"`
-}
-
-var configFile string
-
-func initConfigFile() {
-    exePath, err := os.Executable()
+// RunProxsize runs proxsize with the given command line arguments and
+// returns its exit code.
+func RunProxsize(args []string) int {
+    fs := flag.NewFlagSet("proxsize", flag.ExitOnError)
+    configArg := fs.String("config", "", "Config file or conf.d directory (default $PROXSIZE_CONFIG, then proxies.json next to the executable)")
+    pathArg := fs.String("path", "", "Add path rule in key=value format")
+    subdomainArg := fs.String("subdomain", "", "Add subdomain rule in key=value format")
+    domainArg := fs.String("domain", "", "Add domain rule in key=value format")
+    removeArg := fs.String("remove", "", "Remove rule in type=key format")
+    listArg := fs.Bool("list", false, "List all rules")
+    portArg := fs.Int("port", -1, "Add a port to the allowed ports list")
+
+    // Commands may come before or after the flags.
+    command := ""
+    if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+        command, args = args[0], args[1:]
+    }
+    fs.Parse(args)
+    if command == "" {
+        command = fs.Arg(0)
+    }
+    configFile, err := config.Locate(*configArg)
     if err != nil {
-        log.Fatalf("Error getting executable path: %v", err)
+        fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+        return 1
+    }
+    switch command {
+    case "":
+    case "validate":
+        return Check(configFile)
+    case "migrate":
+        return Migrate(configFile)
+    case "schema":
+        os.Stdout.Write(config.Schema)
+        return 0
+    default:
+        fmt.Fprintf(os.Stderr, "Unknown command %q. Use validate, migrate or schema.\n", command)
+        return 2
     }
-    dir := filepath.Dir(exePath)
-    configFile = filepath.Join(dir, "proxies.json")
-}
-func main() {
-    initConfigFile()
-    pathArg := flag.String("path", "", "Add path rule in key=value format")
-    subdomainArg := flag.String("subdomain", "", "Add subdomain rule in key=value format")
-    domainArg := flag.String("domain", "", "Add domain rule in key=value format")
-    removeArg := flag.String("remove", "", "Remove rule in type=key format")
-    listArg := flag.Bool("list", false, "List all rules")
-    portArg := flag.Int("port", -1, "Add a port to the allowed ports list")
-
-    flag.Parse()
 
     if *listArg {
-        rules := loadOrCreateRules()
+        rules := loadOrCreateRules(configFile)
         printRules(rules)
-        return
+        return 0
     }
 
     if *removeArg != "" {
         tipo, chave := parseRule(*removeArg)
-        rules := loadOrCreateRules()
+        rules := loadOrCreateRules(configFile)
         switch tipo {
         case "path":
             if _, ok := rules.Path[chave]; ok {
                 delete(rules.Path, chave)
-                saveRules(rules)
+                saveRules(configFile, rules)
                 fmt.Printf("Removed path '%s'.\n", chave)
             } else {
                 fmt.Printf("Path '%s' not found.\n", chave)
@@ -65,7 +70,7 @@ func main() {
         case "subdomain":
             if _, ok := rules.Subdomain[chave]; ok {
                 delete(rules.Subdomain, chave)
-                saveRules(rules)
+                saveRules(configFile, rules)
                 fmt.Printf("Removed subdomain '%s'.\n", chave)
             } else {
                 fmt.Printf("Subdomain '%s' not found.\n", chave)
@@ -73,7 +78,7 @@ func main() {
         case "domain":
             if _, ok := rules.Domain[chave]; ok {
                 delete(rules.Domain, chave)
-                saveRules(rules)
+                saveRules(configFile, rules)
                 fmt.Printf("Removed domain '%s'.\n", chave)
             } else {
                 fmt.Printf("Domain '%s' not found.\n", chave)
@@ -83,7 +88,7 @@ func main() {
             _, err := fmt.Sscanf(chave, "%d", &port)
             if err != nil || port <= 0 || port > 65535 {
                 fmt.Println("Invalid or out-of-range port (1-65535).")
-                return
+                return 0
             }
             found := false
             for i, p := range rules.AllowedPorts {
@@ -94,7 +99,7 @@ func main() {
                 }
             }
             if found {
-                saveRules(rules)
+                saveRules(configFile, rules)
                 fmt.Printf("Port %d removed successfully.\n", port)
             } else {
                 fmt.Printf("Port %d not found in the list.\n", port)
@@ -102,16 +107,16 @@ func main() {
         default:
             fmt.Println("Invalid type. Use path, subdomain, domain, or port.")
         }
-        return
+        return 0
     }
 
     if *portArg != -1 {
         port := *portArg
         if port <= 0 || port > 65535 {
             fmt.Println("Invalid port. Must be between 1 and 65535.")
-            return
+            return 0
         }
-        rules := loadOrCreateRules()
+        rules := loadOrCreateRules(configFile)
         exists := false
         for _, p := range rules.AllowedPorts {
             if p == port {
@@ -121,27 +126,27 @@ func main() {
         }
         if !exists {
             rules.AllowedPorts = append(rules.AllowedPorts, port)
-            saveRules(rules)
+            saveRules(configFile, rules)
             fmt.Printf("Port %d added successfully.\n", port)
         } else {
             fmt.Printf("Port %d is already in the list.\n", port)
         }
-        return
+        return 0
     }
 
     if *pathArg == "" && *subdomainArg == "" && *domainArg == "" {
-        interactiveMenu()
-        return
+        interactiveMenu(configFile)
+        return 0
     }
 
-    rules := loadOrCreateRules()
+    rules := loadOrCreateRules(configFile)
 
     if *pathArg != "" {
         key, value := parseRule(*pathArg)
         if _, exists := rules.Path[key]; exists {
             fmt.Printf("Path '%s' already exists. Ignoring.\n", key)
         } else {
-            rules.Path[key] = RouteEntry{Target: value}
+            rules.Path[key] = config.RouteEntry{Target: value}
         }
     }
 
@@ -150,7 +155,7 @@ func main() {
         if _, exists := rules.Subdomain[key]; exists {
             fmt.Printf("Subdomain '%s' already exists. Ignoring.\n", key)
         } else {
-            rules.Subdomain[key] = RouteEntry{Target: value}
+            rules.Subdomain[key] = config.RouteEntry{Target: value}
         }
     }
 
@@ -159,15 +164,16 @@ func main() {
         if _, exists := rules.Domain[key]; exists {
             fmt.Printf("Domain '%s' already exists. Ignoring.\n", key)
         } else {
-            rules.Domain[key] = RouteEntry{Target: value}
+            rules.Domain[key] = config.RouteEntry{Target: value}
         }
     }
 
-    saveRules(rules)
+    saveRules(configFile, rules)
     fmt.Println("Rule added successfully.")
+    return 0
 }
 
-func interactiveMenu() {
+func interactiveMenu(configFile string) {
     var tipo string
     var entrada string
     fmt.Println("=== Manage Rules ===")
@@ -184,23 +190,23 @@ func interactiveMenu() {
         fmt.Print("Enter path in key=value format (e.g., /api=http://localhost:3000): ")
         fmt.Scanln(&entrada)
         key, value := parseRule(entrada)
-        rules := loadOrCreateRules()
-        rules.Path[key] = RouteEntry{Target: value}
-        saveRules(rules)
+        rules := loadOrCreateRules(configFile)
+        rules.Path[key] = config.RouteEntry{Target: value}
+        saveRules(configFile, rules)
     case "2":
         fmt.Print("Enter subdomain in key=value format (e.g., admin=https://localhost:3001  or git=tcp://192.168.1.10:22): ")
         fmt.Scanln(&entrada)
         key, value := parseRule(entrada)
-        rules := loadOrCreateRules()
-        rules.Subdomain[key] = RouteEntry{Target: value}
-        saveRules(rules)
+        rules := loadOrCreateRules(configFile)
+        rules.Subdomain[key] = config.RouteEntry{Target: value}
+        saveRules(configFile, rules)
     case "3":
         fmt.Print("Enter domain in key=value format (e.g., example.com=http://localhost:3002): ")
         fmt.Scanln(&entrada)
         key, value := parseRule(entrada)
-        rules := loadOrCreateRules()
-        rules.Domain[key] = RouteEntry{Target: value}
-        saveRules(rules)
+        rules := loadOrCreateRules(configFile)
+        rules.Domain[key] = config.RouteEntry{Target: value}
+        saveRules(configFile, rules)
     case "4":
         var port int
         fmt.Print("Enter port (e.g., 8080): ")
@@ -209,7 +215,7 @@ func interactiveMenu() {
             fmt.Println("Invalid port.")
             return
         }
-        rules := loadOrCreateRules()
+        rules := loadOrCreateRules(configFile)
         exists := false
         for _, p := range rules.AllowedPorts {
             if p == port {
@@ -219,7 +225,7 @@ func interactiveMenu() {
         }
         if !exists {
             rules.AllowedPorts = append(rules.AllowedPorts, port)
-            saveRules(rules)
+            saveRules(configFile, rules)
             fmt.Printf("Port %d added successfully.\n", port)
         } else {
             fmt.Printf("Port %d is already in the list.\n", port)
@@ -232,7 +238,7 @@ func interactiveMenu() {
             fmt.Println("Invalid port.")
             return
         }
-        rules := loadOrCreateRules()
+        rules := loadOrCreateRules(configFile)
         found := false
         for i, p := range rules.AllowedPorts {
             if p == port {
@@ -242,7 +248,7 @@ func interactiveMenu() {
             }
         }
         if found {
-            saveRules(rules)
+            saveRules(configFile, rules)
             fmt.Printf("Port %d removed successfully.\n", port)
         } else {
             fmt.Printf("Port %d not found.\n", port)
@@ -263,47 +269,21 @@ func parseRule(input string) (string, string) {
     return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
 }
 
-func loadOrCreateRules() ProxyRules {
-    rules := ProxyRules{
-        Path:         make(map[string]RouteEntry),
-        Subdomain:    make(map[string]RouteEntry),
-        Domain:       make(map[string]RouteEntry),
-        AllowedPorts: []int{},
-    }
-
-    if _, err := os.Stat(configFile); os.IsNotExist(err) {
-        return rules
-    }
-
-    file, err := os.Open(configFile)
+func loadOrCreateRules(configFile string) *config.File {
+    rules, err := config.LoadFile(configFile)
     if err != nil {
-        log.Fatalf("Error opening %s: %v", configFile, err)
+        log.Fatalf("Error reading %s: %v", configFile, err)
     }
-    defer file.Close()
-
-    if err := json.NewDecoder(file).Decode(&rules); err != nil {
-        log.Fatalf("Error decoding JSON: %v", err)
-    }
-
     return rules
 }
 
-func saveRules(rules ProxyRules) {
-    file, err := os.OpenFile(configFile, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
-    if err != nil {
+func saveRules(configFile string, rules *config.File) {
+    if err := rules.Save(configFile); err != nil {
         log.Fatalf("Error saving %s: %v", configFile, err)
     }
-    defer file.Close()
-
-    encoder := json.NewEncoder(file)
-    encoder.SetIndent("", "  ")
-
-    if err := encoder.Encode(rules); err != nil {
-        log.Fatalf("Error writing JSON: %v", err)
-    }
 }
 
-func printRules(rules ProxyRules) {
+func printRules(rules *config.File) {
     fmt.Println("=== Current Rules ===")
 
     fmt.Println("\n[Path]")
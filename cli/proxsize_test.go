@@ -0,0 +1,71 @@
+package cli_test
+
+import (
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "github.com/SrLiath/ProxSize/cli"
+    "github.com/SrLiath/ProxSize/config"
+    "github.com/SrLiath/ProxSize/proxy"
+    "github.com/SrLiath/ProxSize/router"
+    "path/filepath"
+)
+
+// TestAddedRulesRoute adds a rule of each type with proxsize and checks that
+// the config it writes routes requests to that rule's backend.
+func TestAddedRulesRoute(t *testing.T) {
+    backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprintf(w, "%s %s", r.URL.Query().Get("rule"), r.URL.Path)
+    }))
+    t.Cleanup(backend.Close)
+
+    tests := []struct {
+        flag, rule   string
+        host, target string
+        want         string
+    }{
+        {"-path", "/api", "localhost", "/api/users?rule=path", "path /users"},
+        {"-subdomain", "app", "app.example.com", "/users?rule=subdomain", "subdomain /users"},
+        {"-domain", "example.com", "example.com", "/users?rule=domain", "domain /users"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.flag, func(t *testing.T) {
+            file := filepath.Join(t.TempDir(), "proxies.json")
+            if code := cli.RunProxsize([]string{"-config", file, "-port", "8080"}); code != 0 {
+                t.Fatalf("proxsize -port exited with %d", code)
+            }
+            if code := cli.RunProxsize([]string{"-config", file, tt.flag, tt.rule + "=" + backend.URL}); code != 0 {
+                t.Fatalf("proxsize %s exited with %d", tt.flag, code)
+            }
+
+            rules, allowedPorts, err := config.Load(file)
+            if err != nil {
+                t.Fatalf("Load: %v", err)
+            }
+            if len(allowedPorts) != 1 || allowedPorts[0] != 8080 {
+                t.Errorf("allowed ports = %v, want [8080]", allowedPorts)
+            }
+            routing, err := proxy.NewRouting(8080, router.Build(rules, nil), rules.Listeners[8080], nil)
+            if err != nil {
+                t.Fatal(err)
+            }
+            handler := proxy.NewHandler(8080, routing)
+
+            req := httptest.NewRequest("GET", "http://"+tt.host+tt.target, nil)
+            rec := httptest.NewRecorder()
+            handler.ServeHTTP(rec, req)
+            if rec.Code != http.StatusOK || rec.Body.String() != tt.want {
+                t.Errorf("GET %s%s = %d %q, want 200 %q", tt.host, tt.target, rec.Code, rec.Body.String(), tt.want)
+            }
+
+            // Other hosts must not reach a host rule.
+            req = httptest.NewRequest("GET", "http://other.test/users", nil)
+            rec = httptest.NewRecorder()
+            handler.ServeHTTP(rec, req)
+            if tt.flag != "-path" && rec.Code != http.StatusNotFound {
+                t.Errorf("GET other.test/users = %d, want 404", rec.Code)
+            }
+        })
+    }
+}
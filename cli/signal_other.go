@@ -0,0 +1,9 @@
+//go:build !unix
+
+package cli
+
+import "os"
+
+// upgradeSignal is nil where there is no SIGUSR2; upgrades are then only
+// available through the admin API.
+var upgradeSignal os.Signal
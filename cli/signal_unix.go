@@ -0,0 +1,11 @@
+//go:build unix
+
+package cli
+
+import (
+    "os"
+    "syscall"
+)
+
+// upgradeSignal is the signal that triggers a binary upgrade.
+var upgradeSignal os.Signal = syscall.SIGUSR2
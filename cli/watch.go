@@ -0,0 +1,78 @@
+package cli
+
+import (
+    "log"
+    "os"
+    "os/signal"
+    "time"
+    "github.com/SrLiath/ProxSize/config"
+    "github.com/fsnotify/fsnotify"
+    "path/filepath"
+)
+
+// watchConfig calls reload whenever the config file changes, until the
+// watcher fails.
+func watchConfig(configFile string, reload func()) error {
+    watcher, err := fsnotify.NewWatcher()
+    if err != nil {
+        return err
+    }
+    defer watcher.Close()
+    // Watch the directory rather than the file: editors and the admin API
+    // replace the file by renaming a new one over it, which would drop a
+    // watch on the old inode. A conf.d directory is watched for any of its
+    // files changing, including files being removed.
+    dir := filepath.Dir(configFile)
+    ops := fsnotify.Write | fsnotify.Create | fsnotify.Rename
+    matches := func(name string) bool {
+        return filepath.Clean(name) == filepath.Clean(configFile)
+    }
+    if config.IsDir(configFile) {
+        dir = configFile
+        ops |= fsnotify.Remove
+        matches = func(name string) bool {
+            return config.IsConfigFile(name)
+        }
+    }
+    if err := watcher.Add(dir); err != nil {
+        return err
+    }
+
+    debounce := time.NewTimer(0)
+    <-debounce.C
+
+    for {
+        select {
+        case event, ok := <-watcher.Events:
+            if !ok {
+                return nil
+            }
+            if !matches(event.Name) {
+                continue
+            }
+            if event.Op&ops != 0 {
+                debounce.Reset(300 * time.Millisecond)
+            }
+        case <-debounce.C:
+            reload()
+        case err, ok := <-watcher.Errors:
+            if !ok {
+                return nil
+            }
+            log.Println("🚨 Watcher error:", err)
+        }
+    }
+}
+
+// watchUpgradeSignal calls upgrade on each upgradeSignal.
+func watchUpgradeSignal(upgrade func()) {
+    if upgradeSignal == nil {
+        return
+    }
+    sigCh := make(chan os.Signal, 1)
+    signal.Notify(sigCh, upgradeSignal)
+    for range sigCh {
+        log.Println("⬆️ Upgrade requested by signal")
+        upgrade()
+    }
+}
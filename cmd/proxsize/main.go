@@ -0,0 +1,10 @@
+package main
+
+import (
+    "os"
+    "github.com/SrLiath/ProxSize/cli"
+)
+
+func main() {
+    os.Exit(cli.RunProxsize(os.Args[1:]))
+}
@@ -0,0 +1,255 @@
+// Package config defines the proxies.json schema shared by proxserver and
+// proxsize, and loads and validates config files.
+package config
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "time"
+    "path/filepath"
+)
+
+// RouteEntry is one rule of a path, subdomain, domain or tcp section.
+type RouteEntry struct {
+    Target     string            `json:"target"`
+    Port       int               `json:"port,omitempty"`
+    JWT        *JWTConfig        `json:"jwt,omitempty"`
+    ClientCert *ClientCertConfig `json:"client_cert,omitempty"`
+    Allow      []string          `json:"allow,omitempty"`
+    Deny       []string          `json:"deny,omitempty"`
+    RateLimit  *RateLimitConfig  `json:"rate_limit,omitempty"`
+    // MaxConnections caps concurrent requests/connections to this route's
+    // backend; routes sharing a target share the cap.
+    MaxConnections int      `json:"max_connections,omitempty"`
+    QueueTimeout   Duration `json:"queue_timeout,omitempty"`
+    MaxBodyBytes   int64    `json:"max_body_bytes,omitempty"`
+    BufferBody     bool     `json:"buffer_body,omitempty"`
+}
+
+// JWTConfig is a rule's "jwt" section: how bearer tokens are verified and
+// which claims are forwarded.
+type JWTConfig struct {
+    Algorithms     []string          `json:"algorithms,omitempty"`
+    Secret         string            `json:"secret,omitempty"`
+    SecretFile     string            `json:"secret_file,omitempty"`
+    PublicKeyFile  string            `json:"public_key_file,omitempty"`
+    JWKSURL        string            `json:"jwks_url,omitempty"`
+    JWKSCacheTTL   int               `json:"jwks_cache_ttl,omitempty"`
+    Issuer         string            `json:"issuer,omitempty"`
+    Audience       []string          `json:"audience,omitempty"`
+    RequiredClaims []string          `json:"required_claims,omitempty"`
+    ForwardClaims  map[string]string `json:"forward_claims,omitempty"`
+    Leeway         int               `json:"leeway,omitempty"`
+}
+
+// ClientCertConfig is a rule's "client_cert" section.
+type ClientCertConfig struct {
+    CAFile          string   `json:"ca_file"`
+    AllowedSubjects []string `json:"allowed_subjects,omitempty"`
+    AllowedSANs     []string `json:"allowed_sans,omitempty"`
+    IdentityHeader  string   `json:"identity_header,omitempty"`
+}
+
+// RateLimitConfig is a token bucket limit: rate per second, with burst, per
+// client IP, route or header value as By says.
+type RateLimitConfig struct {
+    Rate   float64 `json:"rate"`
+    Burst  int     `json:"burst,omitempty"`
+    By     string  `json:"by,omitempty"`
+    Header string  `json:"header,omitempty"`
+}
+
+// ListenerConfig holds the settings of one port's listener, from the
+// "listeners" section.
+type ListenerConfig struct {
+    TLS            *TLSConfig       `json:"tls,omitempty"`
+    Allow          []string         `json:"allow,omitempty"`
+    Deny           []string         `json:"deny,omitempty"`
+    ConnRateLimit  *RateLimitConfig `json:"conn_rate_limit,omitempty"`
+    MaxConnections int              `json:"max_connections,omitempty"`
+    QueueTimeout   Duration         `json:"queue_timeout,omitempty"`
+    Timeouts       *TimeoutsConfig  `json:"timeouts,omitempty"`
+}
+
+// TimeoutsConfig holds the HTTP server and TCP session timeouts. Zero fields
+// are unset.
+type TimeoutsConfig struct {
+    ReadHeader     Duration `json:"read_header,omitempty"`
+    Read           Duration `json:"read,omitempty"`
+    Write          Duration `json:"write,omitempty"`
+    Idle           Duration `json:"idle,omitempty"`
+    MaxHeaderBytes int      `json:"max_header_bytes,omitempty"`
+    TCPSniff       Duration `json:"tcp_sniff,omitempty"`
+    TCPIdle        Duration `json:"tcp_idle,omitempty"`
+}
+
+// DefaultTimeouts apply where neither "timeouts" nor a listener sets one.
+var DefaultTimeouts = TimeoutsConfig{
+    ReadHeader: Duration(10 * time.Second),
+    Idle:       Duration(2 * time.Minute),
+    TCPSniff:   Duration(10 * time.Second),
+}
+
+// Merge returns t with every field set in override replacing its own.
+func (t TimeoutsConfig) Merge(override *TimeoutsConfig) TimeoutsConfig {
+    if override == nil {
+        return t
+    }
+    if override.ReadHeader != 0 {
+        t.ReadHeader = override.ReadHeader
+    }
+    if override.Read != 0 {
+        t.Read = override.Read
+    }
+    if override.Write != 0 {
+        t.Write = override.Write
+    }
+    if override.Idle != 0 {
+        t.Idle = override.Idle
+    }
+    if override.MaxHeaderBytes != 0 {
+        t.MaxHeaderBytes = override.MaxHeaderBytes
+    }
+    if override.TCPSniff != 0 {
+        t.TCPSniff = override.TCPSniff
+    }
+    if override.TCPIdle != 0 {
+        t.TCPIdle = override.TCPIdle
+    }
+    return t
+}
+
+// AccessLogConfig is the "access_log" section.
+type AccessLogConfig struct {
+    Format     string `json:"format,omitempty"`
+    Output     string `json:"output,omitempty"`
+    MaxSizeMB  int    `json:"max_size_mb,omitempty"`
+    MaxBackups int    `json:"max_backups,omitempty"`
+}
+
+// TracingConfig is the "tracing" section: where spans are exported over OTLP.
+type TracingConfig struct {
+    OTLPEndpoint string            `json:"otlp_endpoint"`
+    ServiceName  string            `json:"service_name,omitempty"`
+    SampleRatio  *float64          `json:"sample_ratio,omitempty"`
+    Headers      map[string]string `json:"headers,omitempty"`
+}
+
+// AdminConfig is the "admin" section. Without Token the API is disabled.
+type AdminConfig struct {
+    Listen string `json:"listen"`
+    Token  string `json:"token,omitempty"`
+}
+
+// LimitsConfig is the "limits" section, the cap on connections across every
+// listener.
+type LimitsConfig struct {
+    MaxConnections int      `json:"max_connections,omitempty"`
+    QueueTimeout   Duration `json:"queue_timeout,omitempty"`
+}
+
+// Duration accepts Go duration strings ("250ms", "30s") or a number of seconds.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+    var v any
+    if err := json.Unmarshal(data, &v); err != nil {
+        return err
+    }
+    switch v := v.(type) {
+    case float64:
+        *d = Duration(v * float64(time.Second))
+    case string:
+        parsed, err := time.ParseDuration(v)
+        if err != nil {
+            return err
+        }
+        *d = Duration(parsed)
+    default:
+        return fmt.Errorf("invalid duration %s", data)
+    }
+    return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+    return json.Marshal(time.Duration(d).String())
+}
+
+// TLSConfig is a listener's "tls" section.
+type TLSConfig struct {
+    CertFile string `json:"cert_file"`
+    KeyFile  string `json:"key_file"`
+}
+
+// RawRules is a rule section before its entries are decoded and validated.
+type RawRules map[string]json.RawMessage
+
+// DefaultTCPPort is where the tcp multiplexer listens unless tcp_port says
+// otherwise.
+const DefaultTCPPort = 2222
+
+// Rules is a validated config, as Parse returns it and the proxy runs it.
+type Rules struct {
+    Path           map[string]RouteEntry  `json:"path"`
+    Subdomain      map[string]RouteEntry  `json:"subdomain"`
+    Domain         map[string]RouteEntry  `json:"domain"`
+    TCP            map[string]RouteEntry  `json:"tcp"`
+    Bind           string                 `json:"bind,omitempty"`
+    // TCPPort is the multiplexer's port, with the default filled in.
+    TCPPort        int                    `json:"tcp_port"`
+    Listeners      map[int]ListenerConfig `json:"listeners,omitempty"`
+    TrustedProxies []string               `json:"trusted_proxies,omitempty"`
+    Limits         LimitsConfig           `json:"limits,omitempty"`
+    Timeouts       *TimeoutsConfig        `json:"timeouts,omitempty"`
+    AccessLog      *AccessLogConfig       `json:"access_log,omitempty"`
+    Admin          *AdminConfig           `json:"admin,omitempty"`
+    Tracing        *TracingConfig         `json:"tracing,omitempty"`
+}
+
+// RawConfig is a config file as written, before validation.
+type RawConfig struct {
+    // Schema is the "$schema" editors use to find the JSON Schema.
+    Schema         string                 `json:"$schema,omitempty"`
+    Version        int                    `json:"version,omitempty"`
+    Path           RawRules               `json:"path"`
+    Subdomain      RawRules               `json:"subdomain"`
+    Domain         RawRules               `json:"domain"`
+    TCP            RawRules               `json:"tcp"`
+    AllowedPorts   []int                  `json:"allowed_ports,omitempty"`
+    // Bind is the host or IP address the proxy listeners bind to, every
+    // interface when empty. Port 0, in allowed_ports or tcp_port, binds a
+    // free port.
+    Bind           string                 `json:"bind,omitempty"`
+    TCPPort        *int                   `json:"tcp_port,omitempty"`
+    Listeners      map[int]ListenerConfig `json:"listeners,omitempty"`
+    TrustedProxies []string               `json:"trusted_proxies,omitempty"`
+    Limits         LimitsConfig           `json:"limits,omitempty"`
+    Timeouts       *TimeoutsConfig        `json:"timeouts,omitempty"`
+    AccessLog      *AccessLogConfig       `json:"access_log,omitempty"`
+    Admin          *AdminConfig           `json:"admin,omitempty"`
+    Tracing        *TracingConfig         `json:"tracing,omitempty"`
+}
+
+// DefaultPath is the config file used when none is given: proxies.json next
+// to the running executable.
+func DefaultPath() (string, error) {
+    exePath, err := os.Executable()
+    if err != nil {
+        return "", fmt.Errorf("locating the executable for the default config: %w", err)
+    }
+    return filepath.Join(filepath.Dir(exePath), "proxies.json"), nil
+}
+
+// Locate picks the config to use: path if it isn't empty (the -config flag),
+// then $PROXSIZE_CONFIG, then DefaultPath. The result may be a file or a
+// conf.d-style directory.
+func Locate(path string) (string, error) {
+    if path != "" {
+        return path, nil
+    }
+    if env := os.Getenv("PROXSIZE_CONFIG"); env != "" {
+        return env, nil
+    }
+    return DefaultPath()
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+    "encoding/json"
+    "testing"
+    "time"
+)
+
+func TestDurationUnmarshal(t *testing.T) {
+    tests := []struct {
+        in      string
+        want    time.Duration
+        wantErr bool
+    }{
+        {`"250ms"`, 250 * time.Millisecond, false},
+        {`"1m30s"`, 90 * time.Second, false},
+        {`30`, 30 * time.Second, false},
+        {`0.5`, 500 * time.Millisecond, false},
+        {`"30"`, 0, true},
+        {`true`, 0, true},
+    }
+    for _, tt := range tests {
+        var d Duration
+        err := json.Unmarshal([]byte(tt.in), &d)
+        if (err != nil) != tt.wantErr {
+            t.Errorf("Unmarshal(%s) error = %v, want error %t", tt.in, err, tt.wantErr)
+            continue
+        }
+        if time.Duration(d) != tt.want {
+            t.Errorf("Unmarshal(%s) = %s, want %s", tt.in, time.Duration(d), tt.want)
+        }
+    }
+
+    out, err := json.Marshal(Duration(90 * time.Second))
+    if err != nil || string(out) != `"1m30s"` {
+        t.Errorf("Marshal = %s, %v", out, err)
+    }
+}
+
+func TestTimeoutsMerge(t *testing.T) {
+    base := TimeoutsConfig{ReadHeader: Duration(time.Second), Idle: Duration(time.Minute), TCPSniff: Duration(5 * time.Second)}
+    if got := base.Merge(nil); got != base {
+        t.Errorf("Merge(nil) = %+v, want %+v", got, base)
+    }
+    got := base.Merge(&TimeoutsConfig{Idle: Duration(time.Hour), Write: Duration(10 * time.Second), MaxHeaderBytes: 4096})
+    want := TimeoutsConfig{
+        ReadHeader:     Duration(time.Second),
+        Idle:           Duration(time.Hour),
+        Write:          Duration(10 * time.Second),
+        MaxHeaderBytes: 4096,
+        TCPSniff:       Duration(5 * time.Second),
+    }
+    if got != want {
+        t.Errorf("Merge = %+v, want %+v", got, want)
+    }
+}
@@ -0,0 +1,135 @@
+package config
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+)
+
+// File is a config file as proxsize edits it: the rule sections and the
+// allowed ports, with every other section kept as it was read.
+type File struct {
+    Version      int                   `json:"version,omitempty"`
+    Path         map[string]RouteEntry `json:"path"`
+    Subdomain    map[string]RouteEntry `json:"subdomain"`
+    Domain       map[string]RouteEntry `json:"domain"`
+    TCP          map[string]RouteEntry `json:"tcp"`
+    AllowedPorts []int                 `json:"allowed_ports,omitempty"`
+    // Extra holds the top-level sections File doesn't model (listeners, ...).
+    Extra map[string]json.RawMessage `json:"-"`
+}
+
+func (f *File) UnmarshalJSON(data []byte) error {
+    type plain File
+    if err := json.Unmarshal(data, (*plain)(f)); err != nil {
+        return err
+    }
+    f.Extra = extraFields(data, "version", "path", "subdomain", "domain", "tcp", "allowed_ports")
+    return nil
+}
+
+func (f File) MarshalJSON() ([]byte, error) {
+    type plain File
+    return marshalWithExtra(plain(f), f.Extra)
+}
+
+// LoadFile reads the config file at path for editing. A missing file gives an
+// empty config at the current version. A directory gives its merged
+// contents, which can be listed but not saved.
+func LoadFile(path string) (*File, error) {
+    f := &File{
+        Path:         make(map[string]RouteEntry),
+        Subdomain:    make(map[string]RouteEntry),
+        Domain:       make(map[string]RouteEntry),
+        TCP:          make(map[string]RouteEntry),
+        AllowedPorts: []int{},
+    }
+    data, err := Read(path)
+    if os.IsNotExist(err) {
+        f.Version = CurrentVersion
+        return f, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    if err := json.Unmarshal(data, f); err != nil {
+        return nil, err
+    }
+    return f, nil
+}
+
+// Save writes f to path in the format its extension names, replacing the file
+// atomically.
+func (f *File) Save(path string) error {
+    if IsDir(path) {
+        return fmt.Errorf("%s is a directory; edit one of its files instead", path)
+    }
+    data, err := json.Marshal(f)
+    if err != nil {
+        return err
+    }
+    return Write(path, data)
+}
+
+// extraFields returns the members of the JSON object in data other than known.
+func extraFields(data []byte, known ...string) map[string]json.RawMessage {
+    var fields map[string]json.RawMessage
+    if err := json.Unmarshal(data, &fields); err != nil {
+        return nil
+    }
+    for _, k := range known {
+        delete(fields, k)
+    }
+    if len(fields) == 0 {
+        return nil
+    }
+    return fields
+}
+
+// marshalWithExtra encodes v and appends the extra members after its own
+// fields, e.g. {"path":..., "allowed_ports":..., "listeners":...}.
+func marshalWithExtra(v any, extra map[string]json.RawMessage) ([]byte, error) {
+    data, err := json.Marshal(v)
+    if err != nil || len(extra) == 0 {
+        return data, err
+    }
+    rest, err := json.Marshal(extra)
+    if err != nil {
+        return nil, err
+    }
+    if len(data) == 2 {
+        return rest, nil
+    }
+    return append(append(data[:len(data)-1], ','), rest[1:]...), nil
+}
+
+// WriteFileAtomic replaces name with data by writing a temporary file next
+// to it and renaming it into place, so readers never see a partial file. An
+// existing file keeps its permissions; a new one gets 0644.
+func WriteFileAtomic(name string, data []byte) error {
+    mode := os.FileMode(0644)
+    if info, err := os.Stat(name); err == nil {
+        mode = info.Mode().Perm()
+    }
+    tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Sync(); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    if err := os.Chmod(tmp.Name(), mode); err != nil {
+        return err
+    }
+    return os.Rename(tmp.Name(), name)
+}
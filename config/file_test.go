@@ -0,0 +1,39 @@
+package config
+
+import (
+    "os"
+    "runtime"
+    "testing"
+    "path/filepath"
+)
+
+func TestWriteFileAtomicMode(t *testing.T) {
+    if runtime.GOOS == "windows" {
+        t.Skip("no Unix permissions")
+    }
+    dir := t.TempDir()
+    secret := filepath.Join(dir, "secret.json")
+    if err := os.WriteFile(secret, []byte("{}"), 0600); err != nil {
+        t.Fatal(err)
+    }
+    tests := []struct {
+        name string
+        file string
+        want os.FileMode
+    }{
+        {"existing file keeps its mode", secret, 0600},
+        {"new file", filepath.Join(dir, "new.json"), 0644},
+    }
+    for _, tt := range tests {
+        if err := WriteFileAtomic(tt.file, []byte(`{"path": {}}`)); err != nil {
+            t.Fatal(err)
+        }
+        info, err := os.Stat(tt.file)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if info.Mode().Perm() != tt.want {
+            t.Errorf("%s: mode = %v, want %v", tt.name, info.Mode().Perm(), tt.want)
+        }
+    }
+}
@@ -0,0 +1,237 @@
+package config
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "os"
+    "strconv"
+    "strings"
+    "github.com/BurntSushi/toml"
+    "gopkg.in/yaml.v3"
+    "path/filepath"
+)
+
+// IsConfigFile reports whether name has the extension of a supported config
+// format: .json, .yaml, .yml or .toml.
+func IsConfigFile(name string) bool {
+    switch strings.ToLower(filepath.Ext(name)) {
+    case ".json", ".yaml", ".yml", ".toml":
+        return true
+    }
+    return false
+}
+
+// decode converts the content of a config file to JSON, by its extension.
+func decode(name string, content []byte) ([]byte, error) {
+    var v any
+    switch strings.ToLower(filepath.Ext(name)) {
+    case ".yaml", ".yml":
+        if err := yaml.Unmarshal(content, &v); err != nil {
+            return nil, err
+        }
+    case ".toml":
+        if _, err := toml.Decode(string(content), &v); err != nil {
+            return nil, err
+        }
+    default:
+        return content, nil
+    }
+    if v == nil {
+        return []byte("{}"), nil
+    }
+    return json.Marshal(stringKeys(v))
+}
+
+// stringKeys turns the map[any]any YAML produces for non-string keys, like
+// listener ports, into objects JSON can encode.
+func stringKeys(v any) any {
+    switch v := v.(type) {
+    case map[any]any:
+        m := make(map[string]any, len(v))
+        for k, val := range v {
+            m[fmt.Sprint(k)] = stringKeys(val)
+        }
+        return m
+    case map[string]any:
+        for k, val := range v {
+            v[k] = stringKeys(val)
+        }
+    case []any:
+        for i, val := range v {
+            v[i] = stringKeys(val)
+        }
+    }
+    return v
+}
+
+// Write saves the JSON document data to path in the format its extension
+// names. Comments in an existing YAML file are kept on the keys that are
+// still there, and so is the order of those keys.
+func Write(path string, data []byte) error {
+    var out []byte
+    switch strings.ToLower(filepath.Ext(path)) {
+    case ".yaml", ".yml":
+        node, err := jsonToNode(json.NewDecoder(bytes.NewReader(data)))
+        if err != nil {
+            return err
+        }
+        doc := &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{node}}
+        if old, err := os.ReadFile(path); err == nil {
+            var prev yaml.Node
+            if yaml.Unmarshal(old, &prev) == nil {
+                keepComments(&prev, doc)
+            }
+        }
+        var buf bytes.Buffer
+        enc := yaml.NewEncoder(&buf)
+        enc.SetIndent(2)
+        if err := enc.Encode(doc); err != nil {
+            return err
+        }
+        out = buf.Bytes()
+    case ".toml":
+        dec := json.NewDecoder(bytes.NewReader(data))
+        dec.UseNumber()
+        var v any
+        if err := dec.Decode(&v); err != nil {
+            return err
+        }
+        var buf bytes.Buffer
+        if err := toml.NewEncoder(&buf).Encode(tomlValue(v)); err != nil {
+            return err
+        }
+        out = buf.Bytes()
+    default:
+        var buf bytes.Buffer
+        if err := json.Indent(&buf, data, "", "  "); err != nil {
+            return err
+        }
+        out = append(buf.Bytes(), '\n')
+    }
+    return WriteFileAtomic(path, out)
+}
+
+// jsonToNode reads the next JSON value from dec as a YAML node, keeping the
+// order of object keys.
+func jsonToNode(dec *json.Decoder) (*yaml.Node, error) {
+    dec.UseNumber()
+    tok, err := dec.Token()
+    if err != nil {
+        return nil, err
+    }
+    switch tok := tok.(type) {
+    case json.Delim:
+        node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+        if tok == '{' {
+            node = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+        }
+        for dec.More() {
+            if node.Kind == yaml.MappingNode {
+                key, err := dec.Token()
+                if err != nil {
+                    return nil, err
+                }
+                node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key.(string)})
+            }
+            child, err := jsonToNode(dec)
+            if err != nil {
+                return nil, err
+            }
+            node.Content = append(node.Content, child)
+        }
+        if _, err := dec.Token(); err != nil {
+            return nil, err
+        }
+        return node, nil
+    case json.Number:
+        tag := "!!int"
+        if _, err := tok.Int64(); err != nil {
+            tag = "!!float"
+        }
+        return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: tok.String()}, nil
+    case string:
+        return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: tok}, nil
+    case bool:
+        return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(tok)}, nil
+    case nil:
+        return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}, nil
+    }
+    return nil, io.ErrUnexpectedEOF
+}
+
+// keepComments copies the comments and style of old onto the matching nodes
+// of node, and puts mapping keys that old also has back in old's order.
+func keepComments(old, node *yaml.Node) {
+    if old.Kind != node.Kind {
+        return
+    }
+    node.HeadComment, node.LineComment, node.FootComment = old.HeadComment, old.LineComment, old.FootComment
+    node.Style = old.Style
+    switch node.Kind {
+    case yaml.DocumentNode, yaml.SequenceNode:
+        for i := 0; i < len(node.Content) && i < len(old.Content); i++ {
+            keepComments(old.Content[i], node.Content[i])
+        }
+    case yaml.MappingNode:
+        pairs := map[string][2]*yaml.Node{}
+        var order []string
+        for i := 0; i+1 < len(node.Content); i += 2 {
+            key := node.Content[i].Value
+            pairs[key] = [2]*yaml.Node{node.Content[i], node.Content[i+1]}
+            order = append(order, key)
+        }
+        var content []*yaml.Node
+        for i := 0; i+1 < len(old.Content); i += 2 {
+            key := old.Content[i].Value
+            pair, ok := pairs[key]
+            if !ok {
+                continue
+            }
+            keepComments(old.Content[i], pair[0])
+            // Keep listener ports unquoted if they were.
+            pair[0].Tag = old.Content[i].Tag
+            keepComments(old.Content[i+1], pair[1])
+            content = append(content, pair[0], pair[1])
+            delete(pairs, key)
+        }
+        for _, key := range order {
+            if pair, ok := pairs[key]; ok {
+                content = append(content, pair[0], pair[1])
+            }
+        }
+        node.Content = content
+    }
+}
+
+// tomlValue prepares a decoded JSON value for the TOML encoder: numbers
+// become integers where they are whole, and nulls, which TOML can't express,
+// are left out.
+func tomlValue(v any) any {
+    switch v := v.(type) {
+    case map[string]any:
+        m := make(map[string]any, len(v))
+        for k, val := range v {
+            if val != nil {
+                m[k] = tomlValue(val)
+            }
+        }
+        return m
+    case []any:
+        s := make([]any, 0, len(v))
+        for _, val := range v {
+            if val != nil {
+                s = append(s, tomlValue(val))
+            }
+        }
+        return s
+    case json.Number:
+        if n, err := v.Int64(); err == nil {
+            return n
+        }
+        f, _ := v.Float64()
+        return f
+    }
+    return v
+}
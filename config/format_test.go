@@ -0,0 +1,142 @@
+package config
+
+import (
+    "encoding/json"
+    "os"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+    "path/filepath"
+)
+
+func TestDecode(t *testing.T) {
+    tests := []struct {
+        name, content string
+        want          string
+    }{
+        {"c.json", `{"allowed_ports": [80]}`, `{"allowed_ports": [80]}`},
+        {"c.yaml", "allowed_ports: [80]\nlisteners:\n  80:\n    max_connections: 5\n", `{"allowed_ports":[80],"listeners":{"80":{"max_connections":5}}}`},
+        {"c.YML", "path:\n  /: {target: http://web}\n", `{"path":{"/":{"target":"http://web"}}}`},
+        {"c.toml", "allowed_ports = [80]\n[listeners.80]\nmax_connections = 5\n", `{"allowed_ports":[80],"listeners":{"80":{"max_connections":5}}}`},
+        {"c.yaml", "", `{}`},
+        {"c.yaml", "# only a comment\n", `{}`},
+    }
+    for _, tt := range tests {
+        got, err := decode(tt.name, []byte(tt.content))
+        if err != nil {
+            t.Errorf("decode(%s, %q) = %v", tt.name, tt.content, err)
+            continue
+        }
+        if string(got) != tt.want {
+            t.Errorf("decode(%s, %q) = %s, want %s", tt.name, tt.content, got, tt.want)
+        }
+    }
+    for _, name := range []string{"c.yaml", "c.toml"} {
+        if _, err := decode(name, []byte("path: [\n= x")); err == nil {
+            t.Errorf("decode(%s) of a broken file succeeded", name)
+        }
+    }
+}
+
+func TestFileRoundTrip(t *testing.T) {
+    for _, ext := range []string{".json", ".yaml", ".toml"} {
+        t.Run(ext, func(t *testing.T) {
+            file := filepath.Join(t.TempDir(), "proxies"+ext)
+            f, err := LoadFile(file)
+            if err != nil {
+                t.Fatal(err)
+            }
+            f.AllowedPorts = []int{80, 443}
+            f.Path["/api"] = RouteEntry{Target: "http://api", MaxConnections: 5, RateLimit: &RateLimitConfig{Rate: 0.5, Burst: 2}}
+            f.Subdomain["db"] = RouteEntry{Target: "tcp://db:5432", Allow: []string{"10.0.0.0/8"}}
+            f.Extra = map[string]json.RawMessage{
+                "listeners": json.RawMessage(`{"443":{"max_connections":10,"queue_timeout":"1.5s"}}`),
+                "admin":     json.RawMessage(`{"listen":"127.0.0.1:9090"}`),
+            }
+            if err := f.Save(file); err != nil {
+                t.Fatal(err)
+            }
+
+            got, err := LoadFile(file)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !reflect.DeepEqual(got.Path, f.Path) || !reflect.DeepEqual(got.Subdomain, f.Subdomain) || !reflect.DeepEqual(got.AllowedPorts, f.AllowedPorts) || got.Version != CurrentVersion {
+                t.Errorf("read back %+v, want %+v", got, f)
+            }
+            rules, _, err := Load(file)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if rules.Listeners[443].MaxConnections != 10 || rules.Listeners[443].QueueTimeout != Duration(1500*time.Millisecond) || rules.Admin == nil || rules.Admin.Listen != "127.0.0.1:9090" {
+                t.Errorf("sections proxsize doesn't edit changed: %+v", rules)
+            }
+        })
+    }
+}
+
+func TestWriteYAMLKeepsComments(t *testing.T) {
+    file := filepath.Join(t.TempDir(), "proxies.yaml")
+    old := `# Proxy rules
+version: 2
+allowed_ports: [80] # public
+path:
+  # the API
+  /api:
+    target: http://api
+  /old:
+    target: http://old
+listeners:
+  80:
+    max_connections: 5
+`
+    if err := os.WriteFile(file, []byte(old), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    // A JSON document in another key order, with /old removed and /new added.
+    doc := `{"path": {"/new": {"target": "http://new"}, "/api": {"target": "http://api2"}},
+        "listeners": {"80": {"max_connections": 5}}, "version": 2, "allowed_ports": [80, 443]}`
+    if err := Write(file, []byte(doc)); err != nil {
+        t.Fatal(err)
+    }
+    data, err := os.ReadFile(file)
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := `# Proxy rules
+version: 2
+allowed_ports: [80, 443] # public
+path:
+  # the API
+  /api:
+    target: http://api2
+  /new:
+    target: http://new
+listeners:
+  80:
+    max_connections: 5
+`
+    if string(data) != want {
+        t.Errorf("written:\n%s\nwant:\n%s", data, want)
+    }
+}
+
+func TestWriteTOML(t *testing.T) {
+    file := filepath.Join(t.TempDir(), "proxies.toml")
+    if err := Write(file, []byte(`{"allowed_ports": [80], "limits": {"max_connections": 100}, "path": {"/": {"target": "http://web", "rate_limit": {"rate": 0.5}, "jwt": null}}}`)); err != nil {
+        t.Fatal(err)
+    }
+    data, err := os.ReadFile(file)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, want := range []string{"allowed_ports = [80]", "max_connections = 100", "rate = 0.5"} {
+        if !strings.Contains(string(data), want) {
+            t.Errorf("written:\n%s\nwant it to contain %q", data, want)
+        }
+    }
+    if strings.Contains(string(data), "jwt") {
+        t.Errorf("written:\n%s\nwant the null left out", data)
+    }
+}
@@ -0,0 +1,141 @@
+package config
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+var placeholder = regexp.MustCompile(`\$?\$\{([^}]*)\}`)
+
+// expansion is a string value with placeholders, as written and as resolved.
+type expansion struct {
+    at    string
+    raw   string
+    value string
+}
+
+// interpolate resolves ${VAR} and ${file:/path} in the string values of a
+// JSON document. $${...} stands for a literal ${...}. A document that isn't
+// valid JSON is returned as is, for the decoder to report. The values that
+// had placeholders are returned too, for redact.
+func interpolate(content []byte) ([]byte, []expansion, []error) {
+    if !bytes.Contains(content, []byte("${")) {
+        return content, nil, nil
+    }
+    dec := json.NewDecoder(bytes.NewReader(content))
+    dec.UseNumber()
+    var doc any
+    if err := dec.Decode(&doc); err != nil {
+        return content, nil, nil
+    }
+    var expansions []expansion
+    var problems []error
+    doc = expandValue(doc, "$", &expansions, &problems)
+    out, err := json.Marshal(doc)
+    if err != nil {
+        return content, nil, append(problems, err)
+    }
+    return out, expansions, problems
+}
+
+func expandValue(v any, at string, expansions *[]expansion, problems *[]error) any {
+    switch v := v.(type) {
+    case map[string]any:
+        for k, val := range v {
+            v[k] = expandValue(val, at+JSONKey(k), expansions, problems)
+        }
+    case []any:
+        for i, val := range v {
+            v[i] = expandValue(val, fmt.Sprintf("%s[%d]", at, i), expansions, problems)
+        }
+    case string:
+        resolved := false
+        out := placeholder.ReplaceAllStringFunc(v, func(m string) string {
+            if strings.HasPrefix(m, "$$") {
+                return m[1:]
+            }
+            resolved = true
+            value, err := resolve(m[2 : len(m)-1])
+            if err != nil {
+                *problems = append(*problems, fmt.Errorf("%s: %v", at, err))
+            }
+            return value
+        })
+        if resolved {
+            *expansions = append(*expansions, expansion{at: at, raw: v, value: out})
+        }
+        return out
+    }
+    return v
+}
+
+// redact rewrites the problems found at an expanded value, or at one of the
+// objects around it, to show the value as written instead of as resolved.
+// Placeholders can hold secrets, and problems end up in logs and Admin API
+// responses.
+func redact(problems []error, expansions []expansion) []error {
+    for i, problem := range problems {
+        msg := problem.Error()
+        for _, e := range expansions {
+            prefix, rest, ok := problemAt(msg, e.at)
+            if !ok {
+                continue
+            }
+            // Validation quotes values with %q, and trims some first.
+            var pairs []string
+            for _, value := range []string{e.value, strings.TrimSpace(e.value)} {
+                if value != "" {
+                    pairs = append(pairs, strconv.Quote(value), strconv.Quote(e.raw), value, e.raw)
+                }
+            }
+            msg = prefix + strings.NewReplacer(pairs...).Replace(rest)
+        }
+        if msg != problem.Error() {
+            problems[i] = errors.New(msg)
+        }
+    }
+    return problems
+}
+
+// problemAt splits a "path: message" problem after its path, if the path is
+// at or an ancestor of at.
+func problemAt(msg, at string) (prefix, rest string, ok bool) {
+    for i := strings.Index(msg, ": "); i >= 0; {
+        path := msg[:i]
+        if at == path || strings.HasPrefix(at, path+".") || strings.HasPrefix(at, path+"[") {
+            return msg[:i+2], msg[i+2:], true
+        }
+        next := strings.Index(msg[i+2:], ": ")
+        if next < 0 {
+            break
+        }
+        i += 2 + next
+    }
+    return "", msg, false
+}
+
+// resolve returns the value of one placeholder: an environment variable, or
+// the contents of a file without its trailing newline.
+func resolve(name string) (string, error) {
+    if path, ok := strings.CutPrefix(name, "file:"); ok {
+        data, err := os.ReadFile(path)
+        if err != nil {
+            return "", fmt.Errorf("${%s}: %v", name, err)
+        }
+        return strings.TrimRight(string(data), "\r\n"), nil
+    }
+    if name == "" {
+        return "", fmt.Errorf("empty ${} placeholder")
+    }
+    value, ok := os.LookupEnv(name)
+    if !ok {
+        return "", fmt.Errorf("${%s}: environment variable not set", name)
+    }
+    return value, nil
+}
@@ -0,0 +1,91 @@
+package config
+
+import (
+    "os"
+    "strings"
+    "testing"
+    "path/filepath"
+)
+
+func TestInterpolate(t *testing.T) {
+    secret := filepath.Join(t.TempDir(), "token")
+    if err := os.WriteFile(secret, []byte("s3cret\n"), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    t.Setenv("API_HOST", "api.internal")
+    t.Setenv("EMPTY", "")
+    tests := []struct {
+        name, in, want string
+        wantErr        string
+    }{
+        {"no placeholders", `{"a": "x", "n": 1.50}`, `{"a": "x", "n": 1.50}`, ""},
+        {"variable", `{"t": "http://${API_HOST}:8080"}`, `{"t":"http://api.internal:8080"}`, ""},
+        {"empty variable", `{"t": "a${EMPTY}b"}`, `{"t":"ab"}`, ""},
+        {"file", `{"token": "${file:` + secret + `}"}`, `{"token":"s3cret"}`, ""},
+        {"escaped", `{"t": "$${API_HOST}"}`, `{"t":"${API_HOST}"}`, ""},
+        {"nested and in arrays", `{"a": {"b": ["${API_HOST}", 2]}}`, `{"a":{"b":["api.internal",2]}}`, ""},
+        {"keys stay as they are", `{"${API_HOST}": "x"}`, `{"${API_HOST}":"x"}`, ""},
+        {"numbers keep their form", `{"n": 1.50, "t": "${API_HOST}"}`, `{"n":1.50,"t":"api.internal"}`, ""},
+        {"unset variable", `{"a": {"t": "${NOT_SET_ANYWHERE}"}}`, `{"a":{"t":""}}`, "$.a.t: ${NOT_SET_ANYWHERE}: environment variable not set"},
+        {"missing file", `{"t": ["${file:/nonexistent/token}"]}`, `{"t":[""]}`, "$.t[0]: ${file:/nonexistent/token}: open /nonexistent/token"},
+        {"empty placeholder", `{"t": "${}"}`, `{"t":""}`, "$.t: empty ${} placeholder"},
+        {"invalid JSON is left for the decoder", `{"t": "${API_HOST}"`, `{"t": "${API_HOST}"`, ""},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, _, problems := interpolate([]byte(tt.in))
+            if string(got) != tt.want {
+                t.Errorf("interpolate() = %s, want %s", got, tt.want)
+            }
+            if tt.wantErr == "" && len(problems) > 0 || tt.wantErr != "" && (len(problems) != 1 || !strings.HasPrefix(problems[0].Error(), tt.wantErr)) {
+                t.Errorf("problems = %v, want %q", problems, tt.wantErr)
+            }
+        })
+    }
+}
+
+func TestParseInterpolates(t *testing.T) {
+    t.Setenv("BACKEND", "http://api:8080")
+    _, _, err := Parse([]byte(`{"path": {"/api": {"target": "${BACKEND}"}, "/b": {"target": "${MISSING_BACKEND}"}}}`))
+    if err == nil || !strings.Contains(err.Error(), `$.path["/b"].target: ${MISSING_BACKEND}: environment variable not set`) {
+        t.Errorf("Parse() = %v, want the unset variable reported", err)
+    }
+    rules, _, err := Parse([]byte(`{"path": {"/api": {"target": "${BACKEND}"}}}`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got := rules.Path["/api"].Target; got != "http://api:8080" {
+        t.Errorf("target = %q, want the variable's value", got)
+    }
+}
+
+func TestParseRedactsPlaceholders(t *testing.T) {
+    secret := filepath.Join(t.TempDir(), "shadow")
+    if err := os.WriteFile(secret, []byte("root:s3cret:19000\n  daemon:*:19000\n"), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    t.Setenv("SECRET_HOST", "s3cret host")
+    t.Setenv("SECRET_BY", "s3cret")
+    tests := []struct {
+        name, config, want string
+    }{
+        {"access list", `{"path": {"/": {"target": "http://a", "allow": ["${file:` + secret + `}"]}}}`, `$.path["/"].allow: invalid IP or CIDR "${file:` + secret + `}"`},
+        {"rate limit", `{"path": {"/": {"target": "http://a", "rate_limit": {"rate": 1, "by": "${SECRET_BY}"}}}}`, `$.path["/"].rate_limit.by: unknown value "${SECRET_BY}"`},
+        {"target", `{"path": {"/": {"target": "http://${SECRET_HOST}"}}}`, `$.path["/"]: invalid target "http://${SECRET_HOST}"`},
+        {"bind", `{"bind": "${SECRET_BY}:80"}`, `$.bind: "${SECRET_BY}:80" is not a host or IP address`},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            _, _, err := Parse([]byte(tt.config))
+            if err == nil {
+                t.Fatal("Parse() succeeded")
+            }
+            if strings.Contains(err.Error(), "s3cret") {
+                t.Errorf("Parse() = %v, shows a resolved value", err)
+            }
+            if !strings.Contains(err.Error(), tt.want) {
+                t.Errorf("Parse() = %v\nwant an error containing %q", err, tt.want)
+            }
+        })
+    }
+}
@@ -0,0 +1,284 @@
+package config
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "maps"
+    "os"
+    "reflect"
+    "slices"
+    "sort"
+    "path/filepath"
+)
+
+// Load reads and parses the config at path.
+func Load(path string) (Rules, []int, error) {
+    content, err := Read(path)
+    if err != nil {
+        return Rules{}, nil, err
+    }
+    return Parse(content)
+}
+
+// IsDir reports whether path is a conf.d-style directory of config files.
+func IsDir(path string) bool {
+    info, err := os.Stat(path)
+    return err == nil && info.IsDir()
+}
+
+// Read returns the config at path as JSON, converting YAML and TOML files.
+// For a directory, every config file in it is merged into one document, in
+// name order.
+func Read(path string) ([]byte, error) {
+    if !IsDir(path) {
+        content, err := os.ReadFile(path)
+        if err != nil {
+            return nil, err
+        }
+        return decode(path, content)
+    }
+    entries, err := os.ReadDir(path)
+    if err != nil {
+        return nil, err
+    }
+    merged := map[string]json.RawMessage{}
+    owners := map[string]string{}
+    var problems []error
+    for _, entry := range entries {
+        name := entry.Name()
+        if entry.IsDir() || !IsConfigFile(name) {
+            continue
+        }
+        content, err := os.ReadFile(filepath.Join(path, name))
+        if err != nil {
+            return nil, err
+        }
+        content, err = decode(name, content)
+        if err != nil {
+            problems = append(problems, fmt.Errorf("%s: %w", name, err))
+            continue
+        }
+        for _, err := range mergeFile(merged, owners, name, content) {
+            problems = append(problems, fmt.Errorf("%s: %w", name, err))
+        }
+    }
+    if len(problems) > 0 {
+        return nil, errors.Join(problems...)
+    }
+    return json.Marshal(merged)
+}
+
+// mergeFile adds the sections of one conf.d file to merged. Rule sections and
+// listeners are merged by key, allowed_ports and trusted_proxies are
+// combined, version must be the same in every file that sets it, and every
+// other section may only be set by one file. owners records which file set
+// what.
+func mergeFile(merged map[string]json.RawMessage, owners map[string]string, name string, content []byte) []error {
+    top := map[string]json.RawMessage{}
+    if err := json.Unmarshal(content, &top); err != nil {
+        return []error{jsonError(content, "$", err)}
+    }
+    var problems []error
+    for _, dup := range duplicateKeys(content) {
+        problems = append(problems, fmt.Errorf("%s: duplicate key", dup))
+    }
+    for _, section := range slices.Sorted(maps.Keys(top)) {
+        raw := top[section]
+        at := "$" + JSONKey(section)
+        switch section {
+        case "path", "subdomain", "domain", "tcp", "listeners":
+            entries := map[string]json.RawMessage{}
+            dst := map[string]json.RawMessage{}
+            if err := json.Unmarshal(raw, &entries); err != nil {
+                problems = append(problems, jsonError(raw, at, err))
+                continue
+            }
+            if prev, ok := merged[section]; ok {
+                json.Unmarshal(prev, &dst)
+            }
+            for _, key := range slices.Sorted(maps.Keys(entries)) {
+                id := at + JSONKey(key)
+                if owner, ok := owners[id]; ok {
+                    problems = append(problems, fmt.Errorf("%s: already defined in %s", id, owner))
+                    continue
+                }
+                owners[id] = name
+                dst[key] = entries[key]
+            }
+            merged[section], _ = json.Marshal(dst)
+        case "version":
+            if prev, ok := merged[section]; ok && !bytes.Equal(prev, raw) {
+                problems = append(problems, fmt.Errorf("%s: %s differs from %s in %s", at, raw, prev, owners[at]))
+                continue
+            }
+            owners[at] = name
+            merged[section] = raw
+        case "$schema":
+            // Only there for editors.
+        case "allowed_ports", "trusted_proxies":
+            var values, dst []json.RawMessage
+            if err := json.Unmarshal(raw, &values); err != nil {
+                problems = append(problems, jsonError(raw, at, err))
+                continue
+            }
+            if prev, ok := merged[section]; ok {
+                json.Unmarshal(prev, &dst)
+            }
+            for _, v := range values {
+                if !slices.ContainsFunc(dst, func(d json.RawMessage) bool { return bytes.Equal(d, v) }) {
+                    dst = append(dst, v)
+                }
+            }
+            merged[section], _ = json.Marshal(dst)
+        default:
+            if owner, ok := owners[at]; ok {
+                problems = append(problems, fmt.Errorf("%s: already set in %s", at, owner))
+                continue
+            }
+            owners[at] = name
+            merged[section] = raw
+        }
+    }
+    return problems
+}
+
+// Parse decodes and validates a config file, after resolving its ${VAR}
+// and ${file:/path} placeholders. Every problem found is reported with the
+// JSON path it was found at.
+func Parse(content []byte) (Rules, []int, error) {
+    expanded, expansions, problems := interpolate(content)
+    var raw RawConfig
+    if err := json.Unmarshal(expanded, &raw); err != nil {
+        return Rules{}, nil, jsonError(expanded, "$", err)
+    }
+
+    result := Rules{
+        Path:      make(map[string]RouteEntry),
+        Subdomain: make(map[string]RouteEntry),
+        Domain:    make(map[string]RouteEntry),
+        TCP:       make(map[string]RouteEntry),
+        Listeners: make(map[int]ListenerConfig),
+    }
+
+    for _, dup := range duplicateKeys(content) {
+        problems = append(problems, fmt.Errorf("%s: duplicate key", dup))
+    }
+    problems = append(problems, unknownKeys(expanded, reflect.TypeOf(raw), "$")...)
+    parseAndAdd := func(kind string, src RawRules, dst map[string]RouteEntry) {
+        for k, v := range src {
+            var entry RouteEntry
+            if bytes.HasPrefix(bytes.TrimSpace(v), []byte(`"`)) {
+                problems = append(problems, fmt.Errorf("$.%s%s: bare-string targets are from version 1, run \"proxsize migrate\" to upgrade the file", kind, JSONKey(k)))
+                continue
+            }
+            if err := json.Unmarshal(v, &entry); err != nil {
+                problems = append(problems, jsonError(v, "$."+kind+JSONKey(k), err))
+                continue
+            }
+            problems = append(problems, unknownKeys(v, reflect.TypeOf(entry), "$."+kind+JSONKey(k))...)
+            problems = append(problems, validateRule(kind, k, entry, raw)...)
+            if entry.Target != "" {
+                dst[k] = entry
+            }
+        }
+    }
+
+    if raw.Listeners != nil {
+        result.Listeners = raw.Listeners
+    }
+    result.Bind = raw.Bind
+    result.TCPPort = tcpPort(raw)
+    result.TrustedProxies = raw.TrustedProxies
+    result.Limits = raw.Limits
+    result.Timeouts = raw.Timeouts
+    result.AccessLog = raw.AccessLog
+    result.Admin = raw.Admin
+    result.Tracing = raw.Tracing
+
+    parseAndAdd("path", raw.Path, result.Path)
+    parseAndAdd("subdomain", raw.Subdomain, result.Subdomain)
+    parseAndAdd("domain", raw.Domain, result.Domain)
+    parseAndAdd("tcp", raw.TCP, result.TCP)
+
+    problems = append(problems, validateConfig(raw)...)
+    problems = append(problems, validateTCP(result, raw.AllowedPorts)...)
+    if len(problems) > 0 {
+        problems = redact(problems, expansions)
+        sort.Slice(problems, func(i, j int) bool { return problems[i].Error() < problems[j].Error() })
+        return Rules{}, nil, errors.Join(problems...)
+    }
+    return result, raw.AllowedPorts, nil
+}
+
+// jsonError turns a decoding error into one that names where in the document
+// it happened.
+func jsonError(data []byte, at string, err error) error {
+    var syntax *json.SyntaxError
+    var typeErr *json.UnmarshalTypeError
+    switch {
+    case errors.As(err, &syntax):
+        line := 1 + bytes.Count(data[:syntax.Offset], []byte("\n"))
+        col := int(syntax.Offset) - bytes.LastIndexByte(data[:syntax.Offset], '\n') - 1
+        return fmt.Errorf("%s: line %d, column %d: %v", at, line, col, err)
+    case errors.As(err, &typeErr):
+        if typeErr.Field != "" {
+            at += "." + typeErr.Field
+        }
+        return fmt.Errorf("%s: expected %s, got %s", at, typeErr.Type, typeErr.Value)
+    }
+    return fmt.Errorf("%s: %v", at, err)
+}
+
+// duplicateKeys lists object keys that appear twice in the same object, which
+// encoding/json would silently resolve to the last one.
+func duplicateKeys(data []byte) []string {
+    dec := json.NewDecoder(bytes.NewReader(data))
+    var dups []string
+    var walk func(at string)
+    walk = func(at string) {
+        tok, err := dec.Token()
+        if err != nil {
+            return
+        }
+        switch tok {
+        case json.Delim('{'):
+            seen := map[string]bool{}
+            for dec.More() {
+                tok, err := dec.Token()
+                if err != nil {
+                    return
+                }
+                key, _ := tok.(string)
+                child := at + JSONKey(key)
+                if seen[key] {
+                    dups = append(dups, child)
+                }
+                seen[key] = true
+                walk(child)
+            }
+            dec.Token()
+        case json.Delim('['):
+            for i := 0; dec.More(); i++ {
+                walk(fmt.Sprintf("%s[%d]", at, i))
+            }
+            dec.Token()
+        }
+    }
+    walk("$")
+    return dups
+}
+
+// JSONKey formats an object key as a JSON path step.
+func JSONKey(key string) string {
+    for i, c := range key {
+        if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+            return fmt.Sprintf("[%q]", key)
+        }
+    }
+    if key == "" {
+        return `[""]`
+    }
+    return "." + key
+}
@@ -0,0 +1,120 @@
+package config
+
+import (
+    "os"
+    "strings"
+    "testing"
+    "path/filepath"
+)
+
+// writeFiles creates files, by name, in a new temporary directory.
+func writeFiles(t *testing.T, files map[string]string) string {
+    t.Helper()
+    dir := t.TempDir()
+    for name, content := range files {
+        file := filepath.Join(dir, name)
+        if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+            t.Fatal(err)
+        }
+        if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return dir
+}
+
+func TestLocate(t *testing.T) {
+    t.Setenv("PROXSIZE_CONFIG", "")
+    def, err := DefaultPath()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got, err := Locate(""); got != def || err != nil {
+        t.Errorf("Locate() = %q, %v, want the default %q", got, err, def)
+    }
+    t.Setenv("PROXSIZE_CONFIG", "/etc/proxsize/conf.d")
+    if got, _ := Locate(""); got != "/etc/proxsize/conf.d" {
+        t.Errorf("Locate() = %q, want $PROXSIZE_CONFIG", got)
+    }
+    if got, _ := Locate("proxies.yaml"); got != "proxies.yaml" {
+        t.Errorf("Locate(flag) = %q, want the flag over $PROXSIZE_CONFIG", got)
+    }
+}
+
+func TestLoadDir(t *testing.T) {
+    dir := writeFiles(t, map[string]string{
+        "00-base.json": `{"$schema": "./proxies.schema.json", "version": 2, "allowed_ports": [80, 443],
+            "trusted_proxies": ["10.0.0.0/8"], "limits": {"max_connections": 100}}`,
+        "10-api.yaml": "version: 2\nallowed_ports: [443, 8080]\npath:\n  /api:\n    target: http://api\nlisteners:\n  8080:\n    max_connections: 5\n",
+        "20-web.toml": "[path.\"/\"]\ntarget = \"http://web\"\n[subdomain.app]\ntarget = \"http://app\"\n",
+        "README.md":   "not a config",
+        "old/x.json":  `{"path": {"/api": {"target": "http://old"}}}`,
+    })
+    if !IsDir(dir) || IsDir(filepath.Join(dir, "00-base.json")) {
+        t.Fatal("IsDir() can't tell the directory from its files")
+    }
+    rules, ports, err := Load(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(ports) != 3 || ports[0] != 80 || ports[1] != 443 || ports[2] != 8080 {
+        t.Errorf("allowed_ports = %v, want the files' ports combined in order", ports)
+    }
+    if rules.Path["/api"].Target != "http://api" || rules.Path["/"].Target != "http://web" || rules.Subdomain["app"].Target != "http://app" {
+        t.Errorf("rules = %+v, want every file's rules", rules)
+    }
+    if rules.Listeners[8080].MaxConnections != 5 || rules.Limits.MaxConnections != 100 || len(rules.TrustedProxies) != 1 {
+        t.Errorf("settings = %+v", rules)
+    }
+}
+
+func TestLoadDirConflicts(t *testing.T) {
+    tests := []struct {
+        name  string
+        files map[string]string
+        want  string
+    }{
+        {"rule in two files", map[string]string{
+            "a.json": `{"path": {"/api": {"target": "http://a"}}}`,
+            "b.yaml": "path:\n  /api:\n    target: http://b\n",
+        }, `b.yaml: $.path["/api"]: already defined in a.json`},
+        {"listener in two files", map[string]string{
+            "a.json": `{"listeners": {"80": {}}}`,
+            "b.json": `{"listeners": {"80": {}}}`,
+        }, `b.json: $.listeners["80"]: already defined in a.json`},
+        {"setting in two files", map[string]string{
+            "a.json": `{"limits": {"max_connections": 1}}`,
+            "b.json": `{"limits": {"max_connections": 2}}`,
+        }, "b.json: $.limits: already set in a.json"},
+        {"different versions", map[string]string{
+            "a.json": `{"version": 2}`,
+            "b.json": `{"version": 3}`,
+        }, "b.json: $.version: 3 differs from 2 in a.json"},
+        {"broken file", map[string]string{
+            "a.json": `{"path": {}}`,
+            "b.yaml": "path: [",
+        }, "b.yaml: "},
+        {"duplicate key", map[string]string{
+            "a.json": `{"path": {"/": {"target": "http://a"}, "/": {"target": "http://b"}}}`,
+        }, `a.json: $.path["/"]: duplicate key`},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            _, err := Read(writeFiles(t, tt.files))
+            if err == nil || !strings.Contains(err.Error(), tt.want) {
+                t.Errorf("Read() = %v, want %q", err, tt.want)
+            }
+        })
+    }
+}
+
+func TestLoadMissing(t *testing.T) {
+    if _, _, err := Load(filepath.Join(t.TempDir(), "proxies.json")); !os.IsNotExist(err) {
+        t.Errorf("Load() = %v, want a not-exist error", err)
+    }
+    // An empty directory is an empty config.
+    rules, ports, err := Load(t.TempDir())
+    if err != nil || len(ports) != 0 || len(rules.Path) != 0 {
+        t.Errorf("Load(empty dir) = %+v, %v, %v", rules, ports, err)
+    }
+}
@@ -0,0 +1,318 @@
+package config
+
+import (
+    "encoding/json"
+    "fmt"
+    "maps"
+    "net"
+    "net/url"
+    "reflect"
+    "slices"
+    "strings"
+)
+
+// validateRule checks a single rule on top of ValidateRoute: port references,
+// access lists, rate limits and client certificates.
+func validateRule(kind, key string, entry RouteEntry, raw RawConfig) []error {
+    at := "$." + kind + JSONKey(key)
+    var problems []error
+    if err := ValidateRoute(kind, key, entry); err != nil {
+        problems = append(problems, fmt.Errorf("%s: %v", at, err))
+    }
+    if entry.Port > 0 && !slices.Contains(raw.AllowedPorts, entry.Port) {
+        problems = append(problems, fmt.Errorf("%s.port: port %d is not in allowed_ports, so the rule is never served", at, entry.Port))
+    }
+    problems = append(problems, validateACL(at, entry.Allow, entry.Deny)...)
+    if entry.RateLimit != nil {
+        problems = append(problems, validateRateLimit(at+".rate_limit", *entry.RateLimit)...)
+    }
+    if entry.MaxConnections < 0 {
+        problems = append(problems, fmt.Errorf("%s.max_connections: must not be negative", at))
+    }
+    if entry.MaxBodyBytes < 0 {
+        problems = append(problems, fmt.Errorf("%s.max_body_bytes: must not be negative", at))
+    }
+    if entry.ClientCert != nil && entry.ClientCert.CAFile == "" {
+        problems = append(problems, fmt.Errorf("%s.client_cert.ca_file: required", at))
+    }
+    if entry.ClientCert != nil && !strings.HasPrefix(entry.Target, "tcp://") {
+        // Only a TLS listener can ask for a certificate; anywhere else the
+        // route would refuse every request.
+        ports := raw.AllowedPorts
+        if entry.Port > 0 {
+            ports = []int{entry.Port}
+        }
+        for _, port := range ports {
+            if raw.Listeners[port].TLS == nil {
+                problems = append(problems, fmt.Errorf("%s.client_cert: port %d has no listeners[%q].tls, so every request would get 403", at, port, fmt.Sprint(port)))
+            }
+        }
+    }
+    return problems
+}
+
+var unmarshalerType = reflect.TypeFor[json.Unmarshaler]()
+
+// unknownKeys reports the object members in data that t, the config type
+// data decodes into, has no field for. encoding/json would silently drop
+// them, so a typo like "alow" would turn an access list off.
+func unknownKeys(data []byte, t reflect.Type, at string) []error {
+    for t.Kind() == reflect.Pointer {
+        t = t.Elem()
+    }
+    if reflect.PointerTo(t).Implements(unmarshalerType) {
+        return nil
+    }
+    var problems []error
+    switch t.Kind() {
+    case reflect.Struct:
+        var members map[string]json.RawMessage
+        if json.Unmarshal(data, &members) != nil {
+            return nil
+        }
+        fields := map[string]reflect.Type{}
+        for i := 0; i < t.NumField(); i++ {
+            f := t.Field(i)
+            name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+            if f.IsExported() && name != "-" {
+                fields[name] = f.Type
+            }
+        }
+        for _, key := range slices.Sorted(maps.Keys(members)) {
+            ft, ok := fields[key]
+            if !ok {
+                problems = append(problems, fmt.Errorf("%s%s: unknown key", at, JSONKey(key)))
+                continue
+            }
+            problems = append(problems, unknownKeys(members[key], ft, at+JSONKey(key))...)
+        }
+    case reflect.Map:
+        var entries map[string]json.RawMessage
+        if json.Unmarshal(data, &entries) != nil {
+            return nil
+        }
+        for _, key := range slices.Sorted(maps.Keys(entries)) {
+            problems = append(problems, unknownKeys(entries[key], t.Elem(), at+JSONKey(key))...)
+        }
+    case reflect.Slice:
+        var items []json.RawMessage
+        if json.Unmarshal(data, &items) != nil {
+            return nil
+        }
+        for i, item := range items {
+            problems = append(problems, unknownKeys(item, t.Elem(), fmt.Sprintf("%s[%d]", at, i))...)
+        }
+    }
+    return problems
+}
+
+// validateTCP reports tcp rules that share their key with a tcp://
+// subdomain rule, since the multiplexer can only route a host name to one of
+// them, and a multiplexer port that an HTTP listener would take too.
+func validateTCP(rules Rules, allowedPorts []int) []error {
+    var problems []error
+    muxed := len(rules.TCP) > 0
+    for key, entry := range rules.Subdomain {
+        if strings.HasPrefix(entry.Target, "tcp://") {
+            muxed = true
+            for tcpKey := range rules.TCP {
+                if strings.EqualFold(tcpKey, key) {
+                    problems = append(problems, fmt.Errorf("$.tcp%s: conflicts with the tcp:// subdomain rule %q", JSONKey(tcpKey), key))
+                }
+            }
+        }
+    }
+    if muxed && rules.TCPPort != 0 && slices.Contains(allowedPorts, rules.TCPPort) {
+        problems = append(problems, fmt.Errorf("$.allowed_ports: port %d is the tcp multiplexer's, set tcp_port to serve HTTP there", rules.TCPPort))
+    }
+    return problems
+}
+
+func tcpPort(raw RawConfig) int {
+    if raw.TCPPort != nil {
+        return *raw.TCPPort
+    }
+    return DefaultTCPPort
+}
+
+// validateConfig checks the settings outside the individual rules, and keys
+// that conflict across rules.
+func validateConfig(raw RawConfig) []error {
+    problems := validateVersion(raw.Version)
+    if strings.Contains(raw.Bind, ":") && net.ParseIP(raw.Bind) == nil {
+        problems = append(problems, fmt.Errorf("$.bind: %q is not a host or IP address, ports go in allowed_ports and tcp_port", raw.Bind))
+    }
+    if port := tcpPort(raw); port < 0 || port > 65535 {
+        problems = append(problems, fmt.Errorf("$.tcp_port: port %d out of range", port))
+    }
+    seenPorts := map[int]bool{}
+    for i, port := range raw.AllowedPorts {
+        at := fmt.Sprintf("$.allowed_ports[%d]", i)
+        if port < 0 || port > 65535 {
+            problems = append(problems, fmt.Errorf("%s: port %d out of range", at, port))
+        }
+        if seenPorts[port] {
+            problems = append(problems, fmt.Errorf("%s: port %d listed twice", at, port))
+        }
+        seenPorts[port] = true
+    }
+
+    // Host names are case-insensitive, and path rules that differ only by a
+    // trailing slash overlap with no defined order between them.
+    normalize := map[string]func(string) string{
+        "path":      func(k string) string { return strings.TrimSuffix(k, "/") },
+        "subdomain": strings.ToLower,
+        "domain":    strings.ToLower,
+        "tcp":       strings.ToLower,
+    }
+    sections := map[string]RawRules{"path": raw.Path, "subdomain": raw.Subdomain, "domain": raw.Domain, "tcp": raw.TCP}
+    for kind, section := range sections {
+        seen := map[string]string{}
+        for _, key := range slices.Sorted(maps.Keys(section)) {
+            norm := normalize[kind](key)
+            if other, ok := seen[norm]; ok && norm != "" {
+                problems = append(problems, fmt.Errorf("$.%s%s: conflicts with %q", kind, JSONKey(key), other))
+            }
+            seen[norm] = key
+        }
+    }
+    for key := range raw.Subdomain {
+        if strings.Contains(key, ".") {
+            problems = append(problems, fmt.Errorf("$.subdomain%s: subdomain keys match the first label only, use a domain rule", JSONKey(key)))
+        }
+    }
+    for key := range raw.TCP {
+        if strings.Contains(key, ".") {
+            problems = append(problems, fmt.Errorf("$.tcp%s: tcp keys match the first label of the host name only", JSONKey(key)))
+        }
+    }
+
+    for port, lc := range raw.Listeners {
+        at := fmt.Sprintf("$.listeners[%q]", fmt.Sprint(port))
+        if port != tcpPort(raw) && !seenPorts[port] {
+            problems = append(problems, fmt.Errorf("%s: port %d is not in allowed_ports, so the listener is never started", at, port))
+        }
+        if lc.TLS != nil && (lc.TLS.CertFile == "" || lc.TLS.KeyFile == "") {
+            problems = append(problems, fmt.Errorf("%s.tls: cert_file and key_file are required", at))
+        }
+        problems = append(problems, validateACL(at, lc.Allow, lc.Deny)...)
+        if lc.ConnRateLimit != nil {
+            problems = append(problems, validateRateLimit(at+".conn_rate_limit", *lc.ConnRateLimit)...)
+        }
+    }
+    if _, err := ParseCIDRs(raw.TrustedProxies); err != nil {
+        problems = append(problems, fmt.Errorf("$.trusted_proxies: %v", err))
+    }
+    if raw.AccessLog != nil {
+        switch raw.AccessLog.Format {
+        case "", "json", "common", "combined":
+        default:
+            problems = append(problems, fmt.Errorf("$.access_log.format: unknown format %q", raw.AccessLog.Format))
+        }
+    }
+    if raw.Admin != nil && raw.Admin.Listen == "" {
+        problems = append(problems, fmt.Errorf("$.admin.listen: required"))
+    }
+    if raw.Tracing != nil && raw.Tracing.OTLPEndpoint != "" {
+        if u, err := url.Parse(raw.Tracing.OTLPEndpoint); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+            problems = append(problems, fmt.Errorf("$.tracing.otlp_endpoint: invalid URL %q", raw.Tracing.OTLPEndpoint))
+        }
+    }
+    return problems
+}
+
+func validateACL(at string, allow, deny []string) []error {
+    var problems []error
+    if _, err := ParseCIDRs(allow); err != nil {
+        problems = append(problems, fmt.Errorf("%s.allow: %v", at, err))
+    }
+    if _, err := ParseCIDRs(deny); err != nil {
+        problems = append(problems, fmt.Errorf("%s.deny: %v", at, err))
+    }
+    return problems
+}
+
+func validateRateLimit(at string, cfg RateLimitConfig) []error {
+    var problems []error
+    if cfg.Rate <= 0 {
+        problems = append(problems, fmt.Errorf("%s.rate: must be positive", at))
+    }
+    switch cfg.By {
+    case "", "ip", "route":
+    case "header":
+        if cfg.Header == "" {
+            problems = append(problems, fmt.Errorf("%s.header: required when by is \"header\"", at))
+        }
+    default:
+        problems = append(problems, fmt.Errorf("%s.by: unknown value %q", at, cfg.By))
+    }
+    return problems
+}
+
+// ParseCIDRs accepts CIDR blocks as well as bare IP addresses.
+func ParseCIDRs(entries []string) ([]*net.IPNet, error) {
+    var nets []*net.IPNet
+    for _, entry := range entries {
+        entry = strings.TrimSpace(entry)
+        if !strings.Contains(entry, "/") {
+            ip := net.ParseIP(entry)
+            if ip == nil {
+                return nil, fmt.Errorf("invalid IP or CIDR %q", entry)
+            }
+            bits := 128
+            if ip.To4() != nil {
+                ip, bits = ip.To4(), 32
+            }
+            nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+            continue
+        }
+        _, n, err := net.ParseCIDR(entry)
+        if err != nil {
+            return nil, fmt.Errorf("invalid IP or CIDR %q", entry)
+        }
+        nets = append(nets, n)
+    }
+    return nets, nil
+}
+
+// RouteTypes are the rule sections of a config, which are also the route
+// types.
+var RouteTypes = []string{"path", "subdomain", "domain", "tcp"}
+
+// IsRouteType reports whether kind is one of RouteTypes.
+func IsRouteType(kind string) bool {
+    for _, t := range RouteTypes {
+        if t == kind {
+            return true
+        }
+    }
+    return false
+}
+
+// ValidateRoute checks the key, port and target of a single rule, with its
+// placeholders resolved.
+func ValidateRoute(kind, key string, entry RouteEntry) error {
+    if kind == "path" && !strings.HasPrefix(key, "/") {
+        return fmt.Errorf("path key %q must start with /", key)
+    }
+    if entry.Port < 0 || entry.Port > 65535 {
+        return fmt.Errorf("port %d out of range", entry.Port)
+    }
+    u, err := url.Parse(entry.Target)
+    if err != nil || u.Host == "" {
+        return fmt.Errorf("invalid target %q", entry.Target)
+    }
+    switch u.Scheme {
+    case "http", "https":
+    case "tcp":
+        if kind != "subdomain" && kind != "tcp" {
+            return fmt.Errorf("tcp:// targets are only supported for subdomain and tcp rules")
+        }
+    default:
+        return fmt.Errorf("unsupported target scheme %q", u.Scheme)
+    }
+    if kind == "tcp" && u.Scheme != "tcp" {
+        return fmt.Errorf("tcp rules need a tcp:// target")
+    }
+    return nil
+}
@@ -0,0 +1,114 @@
+package config
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestParse(t *testing.T) {
+    rules, ports, err := Parse([]byte(`{
+        "version": 2,
+        "allowed_ports": [80, 443],
+        "bind": "127.0.0.1",
+        "path": {"/api": {"target": "http://api:8080"}, "/": {"target": "http://web", "port": 443}},
+        "subdomain": {"db": {"target": "tcp://db:5432"}},
+        "domain": {"example.com": {"target": "https://site"}},
+        "tcp": {"ssh": {"target": "tcp://host:22"}},
+        "listeners": {"443": {"max_connections": 10}, "2222": {"allow": ["10.0.0.0/8"]}}
+    }`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(ports) != 2 || len(rules.Path) != 2 || len(rules.Subdomain) != 1 || len(rules.Domain) != 1 || len(rules.TCP) != 1 {
+        t.Errorf("Parse() = %+v, %v", rules, ports)
+    }
+    if rules.Bind != "127.0.0.1" || rules.TCPPort != DefaultTCPPort || rules.Path["/"].Port != 443 || rules.Listeners[443].MaxConnections != 10 {
+        t.Errorf("Parse() = %+v", rules)
+    }
+}
+
+func TestParseErrors(t *testing.T) {
+    tests := []struct {
+        name   string
+        config string
+        want   []string
+    }{
+        {"syntax error", "{\n  \"path\": {,}\n}", []string{"$: line 2, column 12: invalid character ','"}},
+        {"wrong type", `{"allowed_ports": "80"}`, []string{"$.allowed_ports: expected []int, got string"}},
+        {"unknown top-level key", `{"alowed_ports": [80]}`, []string{"$.alowed_ports: unknown key"}},
+        {"unknown rule key", `{"path": {"/": {"target": "http://a", "alow": ["10.0.0.1"]}}}`, []string{`$.path["/"].alow: unknown key`}},
+        {"unknown nested key", `{"listeners": {"80": {"tls": {"cert": "x"}}}, "allowed_ports": [80]}`, []string{`$.listeners["80"].tls.cert: unknown key`}},
+        {"duplicate key", `{"path": {"/a": {"target": "http://a"}, "/a": {"target": "http://b"}}}`, []string{`$.path["/a"]: duplicate key`}},
+        {"bare-string target", `{"path": {"/": "http://a"}}`, []string{`$.path["/"]: bare-string targets are from version 1`}},
+        {"path without slash", `{"path": {"api": {"target": "http://a"}}}`, []string{`$.path.api: path key "api" must start with /`}},
+        {"bad target", `{"domain": {"example.com": {"target": "ftp://a"}}}`, []string{`$.domain["example.com"]: unsupported target scheme "ftp"`}},
+        {"port not allowed", `{"path": {"/": {"target": "http://a", "port": 81}}, "allowed_ports": [80]}`, []string{`$.path["/"].port: port 81 is not in allowed_ports`}},
+        {"trailing slash conflict", `{"path": {"/api": {"target": "http://a"}, "/api/": {"target": "http://b"}}}`, []string{`$.path["/api/"]: conflicts with "/api"`}},
+        {"host case conflict", `{"domain": {"Example.com": {"target": "http://a"}, "example.com": {"target": "http://b"}}}`, []string{`$.domain["example.com"]: conflicts with "Example.com"`}},
+        {"dotted subdomain", `{"subdomain": {"a.b": {"target": "http://a"}}}`, []string{`$.subdomain["a.b"]: subdomain keys match the first label only`}},
+        {"tcp and tcp:// subdomain", `{"subdomain": {"db": {"target": "tcp://a:1"}}, "tcp": {"DB": {"target": "tcp://b:1"}}}`, []string{`$.tcp.DB: conflicts with the tcp:// subdomain rule "db"`}},
+        {"tcp case conflict", `{"tcp": {"DB": {"target": "tcp://a:1"}, "db": {"target": "tcp://b:1"}}}`, []string{`$.tcp.db: conflicts with "DB"`}},
+        {"mux port in allowed_ports", `{"tcp": {"db": {"target": "tcp://a:1"}}, "allowed_ports": [2222]}`, []string{"$.allowed_ports: port 2222 is the tcp multiplexer's"}},
+        {"duplicate port", `{"allowed_ports": [80, 80]}`, []string{"$.allowed_ports[1]: port 80 listed twice"}},
+        {"port out of range", `{"allowed_ports": [70000], "tcp_port": -1}`, []string{"$.allowed_ports[0]: port 70000 out of range", "$.tcp_port: port -1 out of range"}},
+        {"bind with a port", `{"bind": "127.0.0.1:80"}`, []string{`$.bind: "127.0.0.1:80" is not a host or IP address`}},
+        {"listener for an unused port", `{"listeners": {"81": {}}, "allowed_ports": [80]}`, []string{`$.listeners["81"]: port 81 is not in allowed_ports`}},
+        {"tls without key", `{"listeners": {"443": {"tls": {"cert_file": "c.pem"}}}, "allowed_ports": [443]}`, []string{`$.listeners["443"].tls: cert_file and key_file are required`}},
+        {"bad access list", `{"path": {"/": {"target": "http://a", "allow": ["10.0.0.300"]}}}`, []string{`$.path["/"].allow`}},
+        {"zero rate", `{"path": {"/": {"target": "http://a", "rate_limit": {"rate": 0}}}}`, []string{`$.path["/"].rate_limit`}},
+        {"negative limits", `{"path": {"/": {"target": "http://a", "max_connections": -1, "max_body_bytes": -1}}}`, []string{`$.path["/"].max_body_bytes: must not be negative`, `$.path["/"].max_connections: must not be negative`}},
+        {"client cert without CA", `{"path": {"/": {"target": "http://a", "client_cert": {}}}}`, []string{`$.path["/"].client_cert.ca_file: required`}},
+        {"client cert without TLS", `{"allowed_ports": [80, 443], "listeners": {"443": {"tls": {"cert_file": "c.pem", "key_file": "k.pem"}}},
+            "path": {"/": {"target": "http://a", "client_cert": {"ca_file": "ca.pem"}}}, "domain": {"example.com": {"target": "http://a", "port": 80, "client_cert": {"ca_file": "ca.pem"}}}}`,
+            []string{`$.path["/"].client_cert: port 80 has no listeners["80"].tls`, `$.domain["example.com"].client_cert: port 80 has no listeners["80"].tls`}},
+        {"access log format", `{"access_log": {"format": "xml"}}`, []string{`$.access_log.format: unknown format "xml"`}},
+        {"admin without listen", `{"admin": {"token": "x"}}`, []string{"$.admin.listen: required"}},
+        {"tracing endpoint", `{"tracing": {"otlp_endpoint": "collector:4318"}}`, []string{"$.tracing.otlp_endpoint: invalid URL"}},
+        {"bad trusted proxy", `{"trusted_proxies": ["nope"]}`, []string{"$.trusted_proxies:"}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            _, _, err := Parse([]byte(tt.config))
+            if err == nil {
+                t.Fatal("Parse() succeeded")
+            }
+            for _, want := range tt.want {
+                if !strings.Contains(err.Error(), want) {
+                    t.Errorf("Parse() = %v\nwant an error containing %q", err, want)
+                }
+            }
+        })
+    }
+}
+
+func TestParseReportsEveryProblem(t *testing.T) {
+    _, _, err := Parse([]byte(`{"path": {"a": {"target": "http://x"}, "b": {"target": "http://y"}}, "unknown": 1}`))
+    if err == nil {
+        t.Fatal("Parse() succeeded")
+    }
+    want := "$.path.a: path key \"a\" must start with /\n$.path.b: path key \"b\" must start with /\n$.unknown: unknown key"
+    if err.Error() != want {
+        t.Errorf("Parse() = %q, want the problems sorted:\n%s", err, want)
+    }
+}
+
+func TestValidateRoute(t *testing.T) {
+    tests := []struct {
+        kind, key, target string
+        wantErr           string
+    }{
+        {"path", "/api", "http://api:80", ""},
+        {"subdomain", "db", "tcp://db:5432", ""},
+        {"tcp", "ssh", "tcp://host:22", ""},
+        {"path", "/x", "tcp://db:5432", "only supported for subdomain and tcp rules"},
+        {"tcp", "ssh", "http://host", "tcp rules need a tcp:// target"},
+        {"domain", "example.com", "example.com", "invalid target"},
+        {"path", "/x", "://bad", "invalid target"},
+    }
+    for _, tt := range tests {
+        err := ValidateRoute(tt.kind, tt.key, RouteEntry{Target: tt.target})
+        if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+            t.Errorf("ValidateRoute(%s, %s, %s) = %v, want %q", tt.kind, tt.key, tt.target, err, tt.wantErr)
+        }
+    }
+}
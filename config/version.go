@@ -0,0 +1,179 @@
+package config
+
+import (
+    "bytes"
+    _ "embed"
+    "encoding/json"
+    "fmt"
+    "os"
+    "strconv"
+    "path/filepath"
+)
+
+// CurrentVersion is the config schema version this build reads and writes.
+// Version 1 is the original format, whose rules could be a bare target
+// string instead of an object.
+const CurrentVersion = 2
+
+// Schema is the JSON Schema for the current config version.
+//
+//go:embed proxies.schema.json
+var Schema []byte
+
+// validateVersion checks the version Parse reads. A file without one predates
+// the field; it is read like the current version, with the version 1
+// leftovers reported rule by rule, and Migrate gives it one.
+func validateVersion(version int) []error {
+    switch {
+    case version < 0 || version > CurrentVersion:
+        return []error{fmt.Errorf("$.version: unsupported version %d, this build reads up to %d", version, CurrentVersion)}
+    case version != 0 && version < CurrentVersion:
+        return []error{fmt.Errorf("$.version: version %d is out of date, run \"proxsize migrate\" to upgrade it to %d", version, CurrentVersion)}
+    }
+    return nil
+}
+
+// MigrateFile upgrades the config file at path to CurrentVersion in place,
+// in its own format, and returns a line for each change made. For a
+// directory, every config file in it is migrated.
+func MigrateFile(path string) ([]string, error) {
+    if IsDir(path) {
+        entries, err := os.ReadDir(path)
+        if err != nil {
+            return nil, err
+        }
+        var changes []string
+        for _, entry := range entries {
+            name := entry.Name()
+            if entry.IsDir() || !IsConfigFile(name) {
+                continue
+            }
+            fileChanges, err := MigrateFile(filepath.Join(path, name))
+            for _, change := range fileChanges {
+                changes = append(changes, name+": "+change)
+            }
+            if err != nil {
+                return changes, fmt.Errorf("%s: %w", name, err)
+            }
+        }
+        return changes, nil
+    }
+    content, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    data, err := decode(path, content)
+    if err != nil {
+        return nil, err
+    }
+    out, changes, err := Migrate(data)
+    if err != nil || len(changes) == 0 {
+        return nil, err
+    }
+    return changes, Write(path, out)
+}
+
+// Migrate upgrades a config document to CurrentVersion: bare-string rules
+// become {"target": ...} objects and the version is set. A document without a
+// version is version 1. It returns the new document and a line for each
+// change made, keeping the order of keys. Placeholders are left as they are.
+func Migrate(content []byte) ([]byte, []string, error) {
+    top, err := members(content)
+    if err != nil {
+        return nil, nil, jsonError(content, "$", err)
+    }
+    version, versionAt := 1, -1
+    var changes []string
+    for i, m := range top {
+        switch {
+        case m.key == "version":
+            if err := json.Unmarshal(m.value, &version); err != nil {
+                return nil, nil, jsonError(m.value, "$.version", err)
+            }
+            versionAt = i
+        case IsRouteType(m.key):
+            top[i].value, err = migrateRules(m.value, "$."+m.key, &changes)
+            if err != nil {
+                return nil, nil, err
+            }
+        }
+    }
+    if version < 1 || version > CurrentVersion {
+        return nil, nil, fmt.Errorf("$.version: unsupported version %d, this build reads up to %d", version, CurrentVersion)
+    }
+    if version != CurrentVersion {
+        current := member{"version", json.RawMessage(strconv.Itoa(CurrentVersion))}
+        if versionAt >= 0 {
+            top[versionAt] = current
+        } else {
+            top = append([]member{current}, top...)
+        }
+        changes = append([]string{fmt.Sprintf("$.version: %d -> %d", version, CurrentVersion)}, changes...)
+    }
+    return encodeMembers(top), changes, nil
+}
+
+// migrateRules turns the bare-string entries of a rule section into objects.
+// A section that isn't an object is left for Parse to report.
+func migrateRules(section json.RawMessage, at string, changes *[]string) (json.RawMessage, error) {
+    entries, err := members(section)
+    if err != nil {
+        return section, nil
+    }
+    for i, m := range entries {
+        var target string
+        if json.Unmarshal(m.value, &target) != nil {
+            continue
+        }
+        entries[i].value, _ = json.Marshal(RouteEntry{Target: target})
+        *changes = append(*changes, fmt.Sprintf("%s%s: %q -> {\"target\": %q}", at, JSONKey(m.key), target, target))
+    }
+    return encodeMembers(entries), nil
+}
+
+type member struct {
+    key   string
+    value json.RawMessage
+}
+
+// members reads the members of the JSON object in data, in order.
+func members(data []byte) ([]member, error) {
+    dec := json.NewDecoder(bytes.NewReader(data))
+    tok, err := dec.Token()
+    if err != nil {
+        return nil, err
+    }
+    if tok != json.Delim('{') {
+        return nil, fmt.Errorf("expected an object")
+    }
+    var ms []member
+    for dec.More() {
+        tok, err := dec.Token()
+        if err != nil {
+            return nil, err
+        }
+        var m member
+        m.key, _ = tok.(string)
+        if err := dec.Decode(&m.value); err != nil {
+            return nil, err
+        }
+        ms = append(ms, m)
+    }
+    return ms, nil
+}
+
+func encodeMembers(ms []member) []byte {
+    var buf bytes.Buffer
+    buf.WriteByte('{')
+    for i, m := range ms {
+        if i > 0 {
+            buf.WriteByte(',')
+        }
+        key, _ := json.Marshal(m.key)
+        buf.Write(key)
+        buf.WriteByte(':')
+        buf.Write(m.value)
+    }
+    buf.WriteByte('}')
+    return buf.Bytes()
+}
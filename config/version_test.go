@@ -0,0 +1,154 @@
+package config
+
+import (
+    "encoding/json"
+    "maps"
+    "os"
+    "reflect"
+    "slices"
+    "strings"
+    "testing"
+    "path/filepath"
+)
+
+func TestMigrate(t *testing.T) {
+    tests := []struct {
+        name, in, want string
+        changes        []string
+    }{
+        {"version 1",
+            `{"version": 1, "allowed_ports": [80], "path": {"/api": "http://api", "/": {"target": "http://web"}}, "subdomain": {"db": "tcp://db:5432"}}`,
+            `{"version":2,"allowed_ports":[80],"path":{"/api":{"target":"http://api"},"/":{"target": "http://web"}},"subdomain":{"db":{"target":"tcp://db:5432"}}}`,
+            []string{`$.version: 1 -> 2`, `$.path["/api"]: "http://api" -> {"target": "http://api"}`, `$.subdomain.db: "tcp://db:5432" -> {"target": "tcp://db:5432"}`}},
+        {"no version",
+            `{"domain": {"example.com": "http://site"}}`,
+            `{"version":2,"domain":{"example.com":{"target":"http://site"}}}`,
+            []string{`$.version: 1 -> 2`, `$.domain["example.com"]: "http://site" -> {"target": "http://site"}`}},
+        {"no version and nothing else to change", `{"path": {"/": {"target": "http://web"}}}`, `{"version":2,"path":{"/":{"target": "http://web"}}}`, []string{`$.version: 1 -> 2`}},
+        {"current version", `{"version": 2, "path": {"/": {"target": "http://web"}}}`, `{"version":2,"path":{"/":{"target": "http://web"}}}`, nil},
+        {"placeholders are kept", `{"version": 1, "tcp": {"ssh": "${SSH_TARGET}"}}`, `{"version":2,"tcp":{"ssh":{"target":"${SSH_TARGET}"}}}`, []string{`$.version: 1 -> 2`, `$.tcp.ssh: "${SSH_TARGET}" -> {"target": "${SSH_TARGET}"}`}},
+        {"section that isn't an object", `{"version": 2, "path": ["/"]}`, `{"version":2,"path":["/"]}`, nil},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            out, changes, err := Migrate([]byte(tt.in))
+            if err != nil {
+                t.Fatal(err)
+            }
+            if string(out) != tt.want {
+                t.Errorf("Migrate() = %s\nwant %s", out, tt.want)
+            }
+            if !slices.Equal(changes, tt.changes) {
+                t.Errorf("changes = %q\nwant %q", changes, tt.changes)
+            }
+        })
+    }
+
+    for in, want := range map[string]string{
+        `{"version": 3}`:   "$.version: unsupported version 3",
+        `{"version": 0}`:   "$.version: unsupported version 0",
+        `{"version": "2"}`: "$.version: expected int",
+        `[]`:               "$: expected an object",
+    } {
+        if _, _, err := Migrate([]byte(in)); err == nil || !strings.Contains(err.Error(), want) {
+            t.Errorf("Migrate(%s) = %v, want %q", in, err, want)
+        }
+    }
+}
+
+func TestParseVersion(t *testing.T) {
+    tests := []struct {
+        config, wantErr string
+    }{
+        {`{"version": 2}`, ""},
+        {`{}`, ""},
+        {`{"version": 1}`, `version 1 is out of date, run "proxsize migrate"`},
+        {`{"version": 3}`, "unsupported version 3, this build reads up to 2"},
+        {`{"version": -1}`, "unsupported version -1"},
+    }
+    for _, tt := range tests {
+        _, _, err := Parse([]byte(tt.config))
+        if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+            t.Errorf("Parse(%s) = %v, want %q", tt.config, err, tt.wantErr)
+        }
+    }
+}
+
+func TestMigrateFile(t *testing.T) {
+    dir := writeFiles(t, map[string]string{
+        "a.yaml": "# routes\nversion: 1\npath:\n  /api: http://api # the API\n",
+        "b.json": `{"version": 2, "path": {"/": {"target": "http://web"}}}`,
+        "c.toml": "[subdomain]\napp = \"http://app\"\n",
+    })
+    before, _ := os.ReadFile(filepath.Join(dir, "b.json"))
+    changes, err := MigrateFile(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := []string{
+        "a.yaml: $.version: 1 -> 2",
+        `a.yaml: $.path["/api"]: "http://api" -> {"target": "http://api"}`,
+        "c.toml: $.version: 1 -> 2",
+        `c.toml: $.subdomain.app: "http://app" -> {"target": "http://app"}`,
+    }
+    if !slices.Equal(changes, want) {
+        t.Errorf("changes = %q\nwant %q", changes, want)
+    }
+    if after, _ := os.ReadFile(filepath.Join(dir, "b.json")); string(after) != string(before) {
+        t.Errorf("up-to-date file rewritten:\n%s", after)
+    }
+    yamlFile, _ := os.ReadFile(filepath.Join(dir, "a.yaml"))
+    if !strings.HasPrefix(string(yamlFile), "# routes\nversion: 2\n") || !strings.Contains(string(yamlFile), "target: http://api") {
+        t.Errorf("migrated YAML:\n%s", yamlFile)
+    }
+    if _, _, err := Load(dir); err != nil {
+        t.Errorf("migrated directory doesn't load: %v", err)
+    }
+    if changes, err := MigrateFile(dir); err != nil || len(changes) != 0 {
+        t.Errorf("second migration = %q, %v, want nothing to do", changes, err)
+    }
+}
+
+// jsonFields lists the JSON names of the fields of the struct t.
+func jsonFields(t reflect.Type) []string {
+    var names []string
+    for i := 0; i < t.NumField(); i++ {
+        name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+        if t.Field(i).IsExported() && name != "-" {
+            names = append(names, name)
+        }
+    }
+    slices.Sort(names)
+    return names
+}
+
+func TestSchemaMatchesConfig(t *testing.T) {
+    type object struct {
+        Properties map[string]json.RawMessage `json:"properties"`
+    }
+    var schema struct {
+        object
+        Defs map[string]object `json:"$defs"`
+    }
+    if err := json.Unmarshal(Schema, &schema); err != nil {
+        t.Fatal(err)
+    }
+    tests := []struct {
+        name string
+        got  map[string]json.RawMessage
+        typ  reflect.Type
+    }{
+        {"top level", schema.Properties, reflect.TypeFor[RawConfig]()},
+        {"route", schema.Defs["route"].Properties, reflect.TypeFor[RouteEntry]()},
+        {"listener", schema.Defs["listener"].Properties, reflect.TypeFor[ListenerConfig]()},
+        {"timeouts", schema.Defs["timeouts"].Properties, reflect.TypeFor[TimeoutsConfig]()},
+        {"jwt", schema.Defs["jwt"].Properties, reflect.TypeFor[JWTConfig]()},
+        {"client cert", schema.Defs["clientCert"].Properties, reflect.TypeFor[ClientCertConfig]()},
+        {"rate limit", schema.Defs["rateLimit"].Properties, reflect.TypeFor[RateLimitConfig]()},
+    }
+    for _, tt := range tests {
+        if got, want := slices.Sorted(maps.Keys(tt.got)), jsonFields(tt.typ); !slices.Equal(got, want) {
+            t.Errorf("schema %s properties = %v\nwant the fields of %s: %v", tt.name, got, tt.typ.Name(), want)
+        }
+    }
+}
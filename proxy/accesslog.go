@@ -0,0 +1,275 @@
+package proxy
+
+import (
+    "crypto/tls"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "net/http"
+    "os"
+    "sync"
+    "time"
+    "github.com/SrLiath/ProxSize/config"
+    "github.com/SrLiath/ProxSize/router"
+    "github.com/SrLiath/ProxSize/tcpmux"
+)
+
+type accessRecord struct {
+    Type       string   `json:"type"`
+    Time       string   `json:"time"`
+    ClientIP   string   `json:"client_ip"`
+    Host       string   `json:"host"`
+    Method     string   `json:"method"`
+    Path       string   `json:"path"`
+    Proto      string   `json:"proto"`
+    RouteType  string   `json:"route_type,omitempty"`
+    RouteKey   string   `json:"route_key,omitempty"`
+    Target     string   `json:"target,omitempty"`
+    RequestID  string   `json:"request_id,omitempty"`
+    Status     int      `json:"status"`
+    BytesIn    int64    `json:"bytes_in"`
+    BytesOut   int64    `json:"bytes_out"`
+    DurationMS float64  `json:"duration_ms"`
+    TLS        *tlsInfo `json:"tls,omitempty"`
+    UserAgent  string   `json:"user_agent,omitempty"`
+    Referer    string   `json:"referer,omitempty"`
+    // uri is the request target with its query string, for the request
+    // line of the common and combined formats.
+    uri string
+}
+
+type tlsInfo struct {
+    Version    string `json:"version"`
+    Cipher     string `json:"cipher"`
+    ServerName string `json:"server_name,omitempty"`
+    ClientCert string `json:"client_cert,omitempty"`
+}
+
+type accessLogger struct {
+    cfg    config.AccessLogConfig
+    mu     sync.Mutex
+    out    io.Writer
+    closer io.Closer
+}
+
+// configureAccessLog swaps in a logger for cfg, keeping the current one (and
+// its open file) when the settings haven't changed.
+func (tel *telemetry) configureAccessLog(cfg *config.AccessLogConfig) {
+    old := tel.accessLog.Load()
+    if cfg == nil {
+        tel.accessLog.Store(nil)
+        if old != nil && old.closer != nil {
+            old.closer.Close()
+        }
+        return
+    }
+
+    c := *cfg
+    if c.Format == "" {
+        c.Format = "json"
+    }
+    if c.Output == "" {
+        c.Output = "stdout"
+    }
+    if old != nil && old.cfg == c {
+        return
+    }
+
+    l := &accessLogger{cfg: c}
+    switch c.Output {
+    case "stdout":
+        l.out = os.Stdout
+    case "stderr":
+        l.out = os.Stderr
+    default:
+        f, err := newRotatingFile(c.Output, c.MaxSizeMB, c.MaxBackups)
+        if err != nil {
+            log.Printf("⚠️ Access log %s: %v", c.Output, err)
+            return
+        }
+        l.out, l.closer = f, f
+    }
+    tel.accessLog.Store(l)
+    if old != nil && old.closer != nil {
+        old.closer.Close()
+    }
+}
+
+func (tel *telemetry) writeAccessLog(r *http.Request, host, path string, client net.IP, route *router.Route, w *statusWriter, bytesIn int64, elapsed time.Duration) {
+    l := tel.accessLog.Load()
+    if l == nil {
+        return
+    }
+
+    status := w.status
+    if status == 0 {
+        status = http.StatusOK
+    }
+    rec := accessRecord{
+        Type:       "http",
+        Time:       time.Now().UTC().Format(time.RFC3339Nano),
+        ClientIP:   client.String(),
+        Host:       host,
+        Method:     r.Method,
+        Path:       path,
+        Proto:      r.Proto,
+        RequestID:  requestID(r),
+        Status:     status,
+        BytesIn:    bytesIn,
+        BytesOut:   w.bytes,
+        DurationMS: float64(elapsed.Microseconds()) / 1000,
+        UserAgent:  r.UserAgent(),
+        Referer:    r.Referer(),
+        uri:        r.URL.RequestURI(),
+    }
+    if route != nil {
+        rec.RouteType, rec.RouteKey, rec.Target = route.Type, route.Key, route.Target
+    }
+    if r.TLS != nil {
+        rec.TLS = &tlsInfo{
+            Version:    tls.VersionName(r.TLS.Version),
+            Cipher:     tls.CipherSuiteName(r.TLS.CipherSuite),
+            ServerName: r.TLS.ServerName,
+        }
+        if len(r.TLS.PeerCertificates) > 0 {
+            rec.TLS.ClientCert = r.TLS.PeerCertificates[0].Subject.String()
+        }
+    }
+    l.write(rec)
+}
+
+func (l *accessLogger) write(rec accessRecord) {
+    var line []byte
+    switch l.cfg.Format {
+    case "common", "combined":
+        t, _ := time.Parse(time.RFC3339Nano, rec.Time)
+        size := "-"
+        if rec.BytesOut > 0 {
+            size = fmt.Sprintf("%d", rec.BytesOut)
+        }
+        line = fmt.Appendf(nil, "%s - - [%s] \"%s %s %s\" %d %s",
+            rec.ClientIP, t.Format("02/Jan/2006:15:04:05 -0700"), rec.Method, rec.uri, rec.Proto, rec.Status, size)
+        if l.cfg.Format == "combined" {
+            line = fmt.Appendf(line, " %q %q", orDash(rec.Referer), orDash(rec.UserAgent))
+        }
+        line = append(line, '\n')
+    default:
+        var err error
+        line, err = json.Marshal(rec)
+        if err != nil {
+            return
+        }
+        line = append(line, '\n')
+    }
+
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.out.Write(line)
+}
+
+// logTCPSession reports a finished TCP session in the log and, when the
+// access log is in JSON format, as a record there.
+func (tel *telemetry) logTCPSession(rec tcpmux.Session) {
+    rec.Time = time.Now().UTC().Format(time.RFC3339Nano)
+    log.Printf("🔚 TCP session %s | Host: %q | Target: %q | Connect: %.1fms | In: %d B | Out: %d B | Duration: %.0fms | %s",
+        rec.Client, rec.Host, rec.Target, rec.ConnectMS, rec.BytesIn, rec.BytesOut, rec.DurationMS, rec.CloseReason)
+
+    l := tel.accessLog.Load()
+    if l == nil || l.cfg.Format != "json" {
+        return
+    }
+    line, err := json.Marshal(rec)
+    if err != nil {
+        return
+    }
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.out.Write(append(line, '\n'))
+}
+
+func orDash(s string) string {
+    if s == "" {
+        return "-"
+    }
+    return s
+}
+
+// rotatingFile is an append-only log file that is rotated to name.1,
+// name.2, ... once it grows past maxSize.
+type rotatingFile struct {
+    mu         sync.Mutex
+    name       string
+    maxSize    int64
+    maxBackups int
+    file       *os.File
+    size       int64
+}
+
+func newRotatingFile(name string, maxSizeMB, maxBackups int) (*rotatingFile, error) {
+    if maxSizeMB <= 0 {
+        maxSizeMB = 100
+    }
+    if maxBackups <= 0 {
+        maxBackups = 5
+    }
+    f := &rotatingFile{name: name, maxSize: int64(maxSizeMB) << 20, maxBackups: maxBackups}
+    if err := f.open(); err != nil {
+        return nil, err
+    }
+    return f, nil
+}
+
+func (f *rotatingFile) open() error {
+    file, err := os.OpenFile(f.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+    if err != nil {
+        return err
+    }
+    info, err := file.Stat()
+    if err != nil {
+        file.Close()
+        return err
+    }
+    f.file, f.size = file, info.Size()
+    return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    if f.file == nil {
+        return 0, os.ErrClosed
+    }
+    if f.size+int64(len(p)) > f.maxSize && f.size > 0 {
+        if err := f.rotate(); err != nil {
+            log.Printf("⚠️ Rotating %s: %v", f.name, err)
+        }
+    }
+    n, err := f.file.Write(p)
+    f.size += int64(n)
+    return n, err
+}
+
+func (f *rotatingFile) rotate() error {
+    f.file.Close()
+    for i := f.maxBackups - 1; i >= 1; i-- {
+        os.Rename(fmt.Sprintf("%s.%d", f.name, i), fmt.Sprintf("%s.%d", f.name, i+1))
+    }
+    renameErr := os.Rename(f.name, f.name+".1")
+    if err := f.open(); err != nil {
+        return err
+    }
+    return renameErr
+}
+
+func (f *rotatingFile) Close() error {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    if f.file == nil {
+        return nil
+    }
+    err := f.file.Close()
+    f.file = nil
+    return err
+}
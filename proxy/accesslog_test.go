@@ -0,0 +1,184 @@
+package proxy
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "regexp"
+    "strings"
+    "testing"
+    "github.com/SrLiath/ProxSize/config"
+    "github.com/SrLiath/ProxSize/router"
+    "github.com/SrLiath/ProxSize/tcpmux"
+    "path/filepath"
+)
+
+// serveLogged serves one request through a Handler logging in format and
+// returns what was written to the access log.
+func serveLogged(t *testing.T, format string, r *http.Request) string {
+    t.Helper()
+    upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte("hello"))
+    }))
+    t.Cleanup(upstream.Close)
+    routing, err := NewRouting(80, router.Build(config.Rules{Path: map[string]config.RouteEntry{
+        "/app": {Target: upstream.URL},
+    }}, nil), config.ListenerConfig{}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    file := filepath.Join(t.TempDir(), "access.log")
+    tel := newTelemetry()
+    tel.configureAccessLog(&config.AccessLogConfig{Format: format, Output: file})
+    t.Cleanup(func() { tel.configureAccessLog(nil) })
+    newHandler(80, routing, tel).ServeHTTP(httptest.NewRecorder(), r)
+
+    data, err := os.ReadFile(file)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return string(data)
+}
+
+func TestAccessLogFormats(t *testing.T) {
+    tests := []struct {
+        format string
+        want   string
+    }{
+        {"common", `^192\.0\.2\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} \+0000\] "GET /app/x\?a=1&b=2 HTTP/1\.1" 200 5\n$`},
+        {"combined", `^192\.0\.2\.1 - - \[.+\] "GET /app/x\?a=1&b=2 HTTP/1\.1" 200 5 "https://ref\.example\.com/" "test-agent"\n$`},
+    }
+    for _, tt := range tests {
+        t.Run(tt.format, func(t *testing.T) {
+            r := httptest.NewRequest("GET", "http://example.com/app/x?a=1&b=2", nil)
+            r.RemoteAddr = "192.0.2.1:5000"
+            r.Header.Set("Referer", "https://ref.example.com/")
+            r.Header.Set("User-Agent", "test-agent")
+            if got := serveLogged(t, tt.format, r); !regexp.MustCompile(tt.want).MatchString(got) {
+                t.Errorf("log line = %q, want a match for %s", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestAccessLogJSON(t *testing.T) {
+    r := httptest.NewRequest("GET", "http://example.com/app/x?a=1", nil)
+    r.RemoteAddr = "192.0.2.1:5000"
+    r.Header.Set("User-Agent", "test-agent")
+    line := serveLogged(t, "", r)
+
+    var rec map[string]any
+    if err := json.Unmarshal([]byte(line), &rec); err != nil {
+        t.Fatalf("log line %q isn't JSON: %v", line, err)
+    }
+    want := map[string]any{
+        "type":       "http",
+        "client_ip":  "192.0.2.1",
+        "host":       "example.com",
+        "method":     "GET",
+        "route_type": "path",
+        "route_key":  "/app",
+        "status":     float64(200),
+        "bytes_out":  float64(5),
+        "user_agent": "test-agent",
+    }
+    for k, v := range want {
+        if rec[k] != v {
+            t.Errorf("%s = %v, want %v", k, rec[k], v)
+        }
+    }
+    if _, ok := rec["tls"]; ok {
+        t.Error("tls set on a plain HTTP request")
+    }
+}
+
+func TestAccessLogTCPSession(t *testing.T) {
+    session := tcpmux.Session{Type: "tcp", Client: "192.0.2.1:5000", Host: "db.example.com", Target: "db:5432", BytesIn: 10, BytesOut: 20, CloseReason: "eof"}
+    for _, format := range []string{"json", "common"} {
+        t.Run(format, func(t *testing.T) {
+            file := filepath.Join(t.TempDir(), "access.log")
+            tel := newTelemetry()
+            tel.configureAccessLog(&config.AccessLogConfig{Format: format, Output: file})
+            defer tel.configureAccessLog(nil)
+            tel.logTCPSession(session)
+
+            data, err := os.ReadFile(file)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if format != "json" {
+                if len(data) != 0 {
+                    t.Errorf("TCP session written to a %s log: %q", format, data)
+                }
+                return
+            }
+            var got tcpmux.Session
+            if err := json.Unmarshal(data, &got); err != nil {
+                t.Fatalf("log line %q isn't JSON: %v", data, err)
+            }
+            if got.Time == "" {
+                t.Error("session logged without a time")
+            }
+            got.Time = ""
+            if got != session {
+                t.Errorf("logged %+v, want %+v", got, session)
+            }
+        })
+    }
+}
+
+func TestRotatingFile(t *testing.T) {
+    name := filepath.Join(t.TempDir(), "access.log")
+    f, err := newRotatingFile(name, 1, 2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer f.Close()
+    f.maxSize = 12
+
+    for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n", "six\n"} {
+        if _, err := f.Write([]byte(line)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    want := map[string]string{
+        name:        "five\nsix\n",
+        name + ".1": "three\nfour\n",
+        name + ".2": "one\ntwo\n",
+    }
+    for file, content := range want {
+        data, err := os.ReadFile(file)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if string(data) != content {
+            t.Errorf("%s = %q, want %q", filepath.Base(file), data, content)
+        }
+    }
+    if _, err := os.Stat(name + ".3"); !os.IsNotExist(err) {
+        t.Errorf("kept more than max_backups files: %v", err)
+    }
+
+    // Reopening continues the current file rather than truncating it.
+    f.Close()
+    f, err = newRotatingFile(name, 1, 2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer f.Close()
+    if f.size != int64(len(want[name])) {
+        t.Errorf("reopened size = %d, want %d", f.size, len(want[name]))
+    }
+    if _, err := f.Write([]byte("x")); err != nil {
+        t.Fatal(err)
+    }
+    f.Close()
+    if _, err := f.Write([]byte("x")); err != os.ErrClosed {
+        t.Errorf("Write after Close = %v, want os.ErrClosed", err)
+    }
+    if data, _ := os.ReadFile(name); !strings.HasSuffix(string(data), "six\nx") {
+        t.Errorf("reopened file = %q, want the new line appended", data)
+    }
+}
@@ -0,0 +1,495 @@
+package proxy
+
+import (
+    "crypto/subtle"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "net/http"
+    "os"
+    "slices"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+    "github.com/SrLiath/ProxSize/config"
+    _ "embed"
+)
+
+//go:embed ui/index.html
+var adminUI []byte
+
+func (p *Server) startAdminServer(cfg config.AdminConfig) *serverInstance {
+    addr := cfg.Listen
+    mux := http.NewServeMux()
+    mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+        p.tel.metrics.writeTo(w)
+    })
+    p.registerAdminAPI(mux, cfg.Token)
+    mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+        http.Redirect(w, r, "/ui/", http.StatusFound)
+    })
+    mux.HandleFunc("GET /ui/{$}", func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "text/html; charset=utf-8")
+        w.Header().Set("Content-Security-Policy", "default-src 'self'; style-src 'unsafe-inline'; script-src 'unsafe-inline'")
+        w.Write(adminUI)
+    })
+
+    server := &http.Server{
+        Addr:              addr,
+        Handler:           mux,
+        ReadHeaderTimeout: 10 * time.Second,
+    }
+    ln, err := listen(addr)
+    if err != nil {
+        log.Printf("❌ Admin server on %s: %v", addr, err)
+        return nil
+    }
+    go func() {
+        log.Printf("🔧 Admin server listening on %s", ln.Addr())
+        if err := server.Serve(ln); err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+            log.Printf("❌ Admin server on %s: %v", addr, err)
+        }
+    }()
+    return &serverInstance{addr: addr, server: server, listener: ln}
+}
+
+type serverStatus struct {
+    mu        sync.Mutex
+    listeners []int
+    addrs     map[string]string
+    routes    map[string]int
+    lastError string
+}
+
+func (s *serverStatus) update(listeners []int, addrs map[string]string, rules config.Rules) {
+    sort.Ints(listeners)
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.listeners = listeners
+    s.addrs = addrs
+    s.lastError = ""
+    s.routes = map[string]int{
+        "path":      len(rules.Path),
+        "subdomain": len(rules.Subdomain),
+        "domain":    len(rules.Domain),
+        "tcp":       len(rules.TCP),
+    }
+}
+
+func (s *serverStatus) rejected(err error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.lastError = err.Error()
+}
+
+// registerAdminAPI adds the route management API under /api. Every call needs
+// the admin token as a bearer token; without a configured token the API is
+// disabled. Changes are validated, written to the config file atomically and
+// applied right away, whether or not a config watcher is running.
+func (p *Server) registerAdminAPI(mux *http.ServeMux, token string) {
+    configFile, reloadCh, upgradeCh := p.configFile, p.reloadCh, p.upgradeCh
+    edit := func(fn func(top map[string]json.RawMessage) error) error {
+        if err := editConfig(configFile, fn); err != nil {
+            return err
+        }
+        if err := p.Reload(); err != nil {
+            log.Printf("❌ Config rejected after an Admin API edit, keeping the last good configuration:\n%v", err)
+        }
+        return nil
+    }
+    auth := func(h http.HandlerFunc) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) {
+            if token == "" {
+                apiError(w, http.StatusForbidden, "admin API disabled: set admin.token")
+                return
+            }
+            got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+            if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+                w.Header().Set("WWW-Authenticate", `Bearer realm="proxsize"`)
+                apiError(w, http.StatusUnauthorized, "invalid admin token")
+                return
+            }
+            log.Printf("🔧 Admin API %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+            h(w, r)
+        }
+    }
+
+    mux.HandleFunc("GET /api/status", auth(func(w http.ResponseWriter, r *http.Request) {
+        p.status.mu.Lock()
+        listeners, addrs, routes, lastError := p.status.listeners, p.status.addrs, p.status.routes, p.status.lastError
+        p.status.mu.Unlock()
+        m := p.tel.metrics
+        m.mu.Lock()
+        reloads, failures, last := m.reloads, m.reloadFailures, m.lastReload
+        m.mu.Unlock()
+        writeJSON(w, http.StatusOK, map[string]any{
+            "config_file":     configFile,
+            "listeners":       listeners,
+            "addresses":       addrs,
+            "routes":          routes,
+            "reloads":         reloads,
+            "reload_failures": failures,
+            "last_reload":     last,
+            "last_error":      lastError,
+        })
+    }))
+
+    mux.HandleFunc("GET /api/stats", auth(func(w http.ResponseWriter, r *http.Request) {
+        writeJSON(w, http.StatusOK, p.tel.metrics.snapshot())
+    }))
+
+    mux.HandleFunc("GET /api/routes", auth(func(w http.ResponseWriter, r *http.Request) {
+        top, err := readConfigSections(configFile)
+        if err != nil {
+            apiError(w, http.StatusInternalServerError, err.Error())
+            return
+        }
+        out := map[string]json.RawMessage{}
+        for _, kind := range config.RouteTypes {
+            out[kind] = sectionOrEmpty(top[kind])
+        }
+        writeJSON(w, http.StatusOK, out)
+    }))
+
+    mux.HandleFunc("GET /api/routes/{type}", auth(func(w http.ResponseWriter, r *http.Request) {
+        kind := r.PathValue("type")
+        if !config.IsRouteType(kind) {
+            apiError(w, http.StatusNotFound, fmt.Sprintf("unknown route type %q", kind))
+            return
+        }
+        top, err := readConfigSections(configFile)
+        if err != nil {
+            apiError(w, http.StatusInternalServerError, err.Error())
+            return
+        }
+        writeJSON(w, http.StatusOK, sectionOrEmpty(top[kind]))
+    }))
+
+    mux.HandleFunc("GET /api/routes/{type}/{key...}", auth(func(w http.ResponseWriter, r *http.Request) {
+        kind, key, ok := routeParams(w, r)
+        if !ok {
+            return
+        }
+        top, err := readConfigSections(configFile)
+        if err != nil {
+            apiError(w, http.StatusInternalServerError, err.Error())
+            return
+        }
+        var section map[string]json.RawMessage
+        json.Unmarshal(top[kind], &section)
+        entry, found := section[key]
+        if !found {
+            apiError(w, http.StatusNotFound, fmt.Sprintf("%s %q not found", kind, key))
+            return
+        }
+        writeJSON(w, http.StatusOK, entry)
+    }))
+
+    saveRoute := func(create bool) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) {
+            kind, key, ok := routeParams(w, r)
+            if !ok {
+                return
+            }
+            var entry config.RouteEntry
+            dec := json.NewDecoder(io.LimitReader(r.Body, 1<<20))
+            dec.DisallowUnknownFields()
+            if err := dec.Decode(&entry); err != nil {
+                apiError(w, http.StatusBadRequest, "invalid route: "+err.Error())
+                return
+            }
+            // The edited config is validated as a whole by editConfig, once
+            // placeholders like "http://${BACKEND_HOST}" are resolved.
+            existed := false
+            err := edit(func(top map[string]json.RawMessage) error {
+                return editSection(top, kind, func(section map[string]json.RawMessage) error {
+                    _, existed = section[key]
+                    if existed && create {
+                        return errConflict
+                    }
+                    raw, err := json.Marshal(entry)
+                    section[key] = raw
+                    return err
+                })
+            })
+            if err == errConflict {
+                apiError(w, http.StatusConflict, fmt.Sprintf("%s %q already exists", kind, key))
+                return
+            }
+            if err == errReadOnly {
+                apiError(w, http.StatusConflict, err.Error())
+                return
+            }
+            if errors.Is(err, errInvalidConfig) {
+                apiError(w, http.StatusUnprocessableEntity, err.Error())
+                return
+            }
+            if err != nil {
+                apiError(w, http.StatusInternalServerError, err.Error())
+                return
+            }
+            status := http.StatusCreated
+            if existed {
+                status = http.StatusOK
+            }
+            writeJSON(w, status, entry)
+        }
+    }
+    mux.HandleFunc("POST /api/routes/{type}/{key...}", auth(saveRoute(true)))
+    mux.HandleFunc("PUT /api/routes/{type}/{key...}", auth(saveRoute(false)))
+
+    mux.HandleFunc("DELETE /api/routes/{type}/{key...}", auth(func(w http.ResponseWriter, r *http.Request) {
+        kind, key, ok := routeParams(w, r)
+        if !ok {
+            return
+        }
+        err := edit(func(top map[string]json.RawMessage) error {
+            return editSection(top, kind, func(section map[string]json.RawMessage) error {
+                if _, found := section[key]; !found {
+                    return errNotFound
+                }
+                delete(section, key)
+                return nil
+            })
+        })
+        if err == errNotFound {
+            apiError(w, http.StatusNotFound, fmt.Sprintf("%s %q not found", kind, key))
+            return
+        }
+        if err == errReadOnly {
+            apiError(w, http.StatusConflict, err.Error())
+            return
+        }
+        if errors.Is(err, errInvalidConfig) {
+            apiError(w, http.StatusUnprocessableEntity, err.Error())
+            return
+        }
+        if err != nil {
+            apiError(w, http.StatusInternalServerError, err.Error())
+            return
+        }
+        w.WriteHeader(http.StatusNoContent)
+    }))
+
+    mux.HandleFunc("GET /api/ports", auth(func(w http.ResponseWriter, r *http.Request) {
+        top, err := readConfigSections(configFile)
+        if err != nil {
+            apiError(w, http.StatusInternalServerError, err.Error())
+            return
+        }
+        ports := []int{}
+        json.Unmarshal(top["allowed_ports"], &ports)
+        writeJSON(w, http.StatusOK, ports)
+    }))
+
+    mux.HandleFunc("POST /api/ports", auth(func(w http.ResponseWriter, r *http.Request) {
+        var body struct {
+            Port int `json:"port"`
+        }
+        if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&body); err != nil {
+            apiError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+            return
+        }
+        if body.Port <= 0 || body.Port > 65535 {
+            apiError(w, http.StatusBadRequest, "port must be between 1 and 65535")
+            return
+        }
+        err := edit(func(top map[string]json.RawMessage) error {
+            var ports []int
+            json.Unmarshal(top["allowed_ports"], &ports)
+            if slices.Contains(ports, body.Port) {
+                return errConflict
+            }
+            raw, err := json.Marshal(append(ports, body.Port))
+            top["allowed_ports"] = raw
+            return err
+        })
+        if err == errConflict {
+            apiError(w, http.StatusConflict, fmt.Sprintf("port %d already allowed", body.Port))
+            return
+        }
+        if err == errReadOnly {
+            apiError(w, http.StatusConflict, err.Error())
+            return
+        }
+        if errors.Is(err, errInvalidConfig) {
+            apiError(w, http.StatusUnprocessableEntity, err.Error())
+            return
+        }
+        if err != nil {
+            apiError(w, http.StatusInternalServerError, err.Error())
+            return
+        }
+        writeJSON(w, http.StatusCreated, body)
+    }))
+
+    mux.HandleFunc("DELETE /api/ports/{port}", auth(func(w http.ResponseWriter, r *http.Request) {
+        port := 0
+        if _, err := fmt.Sscanf(r.PathValue("port"), "%d", &port); err != nil {
+            apiError(w, http.StatusBadRequest, "invalid port")
+            return
+        }
+        err := edit(func(top map[string]json.RawMessage) error {
+            var ports []int
+            json.Unmarshal(top["allowed_ports"], &ports)
+            for i, p := range ports {
+                if p == port {
+                    raw, err := json.Marshal(append(ports[:i], ports[i+1:]...))
+                    top["allowed_ports"] = raw
+                    return err
+                }
+            }
+            return errNotFound
+        })
+        if err == errNotFound {
+            apiError(w, http.StatusNotFound, fmt.Sprintf("port %d not found", port))
+            return
+        }
+        if err == errReadOnly {
+            apiError(w, http.StatusConflict, err.Error())
+            return
+        }
+        if errors.Is(err, errInvalidConfig) {
+            apiError(w, http.StatusUnprocessableEntity, err.Error())
+            return
+        }
+        if err != nil {
+            apiError(w, http.StatusInternalServerError, err.Error())
+            return
+        }
+        w.WriteHeader(http.StatusNoContent)
+    }))
+
+    mux.HandleFunc("POST /api/reload", auth(func(w http.ResponseWriter, r *http.Request) {
+        select {
+        case reloadCh <- struct{}{}:
+        default:
+            // A reload is already queued.
+        }
+        writeJSON(w, http.StatusAccepted, map[string]string{"status": "reload queued"})
+    }))
+
+    mux.HandleFunc("POST /api/upgrade", auth(func(w http.ResponseWriter, r *http.Request) {
+        select {
+        case upgradeCh <- struct{}{}:
+        default:
+        }
+        writeJSON(w, http.StatusAccepted, map[string]string{"status": "upgrade queued"})
+    }))
+}
+
+var (
+    errConflict      = errors.New("conflict")
+    errNotFound      = errors.New("not found")
+    errInvalidConfig = errors.New("change would make the config invalid")
+    errReadOnly      = errors.New("config is a directory, edit its files instead")
+    configMu         sync.Mutex
+)
+
+func routeParams(w http.ResponseWriter, r *http.Request) (kind, key string, ok bool) {
+    kind, key = r.PathValue("type"), r.PathValue("key")
+    if !config.IsRouteType(kind) {
+        apiError(w, http.StatusNotFound, fmt.Sprintf("unknown route type %q", kind))
+        return "", "", false
+    }
+    if kind == "path" {
+        // /api/routes/path/api addresses the "/api" rule.
+        key = "/" + strings.TrimPrefix(key, "/")
+    }
+    if key == "" {
+        apiError(w, http.StatusBadRequest, "missing route key")
+        return "", "", false
+    }
+    return kind, key, true
+}
+
+func readConfigSections(configFile string) (map[string]json.RawMessage, error) {
+    configMu.Lock()
+    defer configMu.Unlock()
+    data, err := config.Read(configFile)
+    if err != nil {
+        return nil, err
+    }
+    top := map[string]json.RawMessage{}
+    if err := json.Unmarshal(data, &top); err != nil {
+        return nil, err
+    }
+    return top, nil
+}
+
+// editConfig applies fn to the top-level sections of the config file and
+// writes the result back atomically. Sections fn doesn't touch are kept
+// byte for byte.
+func editConfig(configFile string, fn func(top map[string]json.RawMessage) error) error {
+    configMu.Lock()
+    defer configMu.Unlock()
+    if config.IsDir(configFile) {
+        return errReadOnly
+    }
+
+    top := map[string]json.RawMessage{}
+    data, err := config.Read(configFile)
+    if err == nil {
+        if err := json.Unmarshal(data, &top); err != nil {
+            return fmt.Errorf("decoding %s: %w", configFile, err)
+        }
+    } else if !os.IsNotExist(err) {
+        return err
+    }
+
+    if err := fn(top); err != nil {
+        return err
+    }
+    out, err := json.MarshalIndent(top, "", "  ")
+    if err != nil {
+        return err
+    }
+    // Refuse edits the reload would reject, rather than writing a file the
+    // proxy then ignores.
+    if _, _, err := config.Parse(out); err != nil {
+        return fmt.Errorf("%w:\n%v", errInvalidConfig, err)
+    }
+    return config.Write(configFile, out)
+}
+
+func editSection(top map[string]json.RawMessage, kind string, fn func(section map[string]json.RawMessage) error) error {
+    section := map[string]json.RawMessage{}
+    if raw, ok := top[kind]; ok && string(raw) != "null" {
+        if err := json.Unmarshal(raw, &section); err != nil {
+            return fmt.Errorf("decoding %s rules: %w", kind, err)
+        }
+    }
+    if err := fn(section); err != nil {
+        return err
+    }
+    raw, err := json.Marshal(section)
+    if err != nil {
+        return err
+    }
+    top[kind] = raw
+    return nil
+}
+
+func sectionOrEmpty(raw json.RawMessage) json.RawMessage {
+    if len(raw) == 0 || string(raw) == "null" {
+        return json.RawMessage("{}")
+    }
+    return raw
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    enc := json.NewEncoder(w)
+    enc.SetIndent("", "  ")
+    enc.Encode(v)
+}
+
+func apiError(w http.ResponseWriter, status int, msg string) {
+    writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,220 @@
+package proxy_test
+
+import (
+    "encoding/json"
+    "io"
+    "net/http"
+    "os"
+    "strings"
+    "testing"
+    "github.com/SrLiath/ProxSize/proxy"
+    "path/filepath"
+)
+
+// api calls the admin API at addr with token and returns the status and body.
+func api(t *testing.T, addr, token, method, path, body string) (int, string) {
+    t.Helper()
+    req, err := http.NewRequest(method, "http://"+addr+path, strings.NewReader(body))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if token != "" {
+        req.Header.Set("Authorization", "Bearer "+token)
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    data, _ := io.ReadAll(resp.Body)
+    return resp.StatusCode, string(data)
+}
+
+func TestAdminAuth(t *testing.T) {
+    srv, _ := startProxy(t, map[string]any{"admin": map[string]any{"listen": "127.0.0.1:0", "token": "secret"}})
+    open, _ := startProxy(t, map[string]any{"admin": map[string]any{"listen": "127.0.0.1:0"}})
+    tests := []struct {
+        name   string
+        addr   string
+        token  string
+        status int
+    }{
+        {"valid token", srv.Addrs()["admin"], "secret", http.StatusOK},
+        {"wrong token", srv.Addrs()["admin"], "guess", http.StatusUnauthorized},
+        {"no token", srv.Addrs()["admin"], "", http.StatusUnauthorized},
+        {"API without a configured token", open.Addrs()["admin"], "", http.StatusForbidden},
+        {"any token without a configured token", open.Addrs()["admin"], "secret", http.StatusForbidden},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if status, body := api(t, tt.addr, tt.token, "GET", "/api/routes", ""); status != tt.status {
+                t.Errorf("GET /api/routes = %d %s, want %d", status, body, tt.status)
+            }
+        })
+    }
+    // Metrics and the UI don't need the token.
+    if status, _ := api(t, open.Addrs()["admin"], "", "GET", "/metrics", ""); status != http.StatusOK {
+        t.Errorf("GET /metrics = %d", status)
+    }
+}
+
+func TestAdminRoutes(t *testing.T) {
+    app := backend(t, "app")
+    echo := echoBackend(t)
+    t.Setenv("ADMIN_TEST_BACKEND", strings.TrimPrefix(app.URL, "http://"))
+    srv, file := startProxy(t, map[string]any{
+        "subdomain": map[string]any{"db": route("tcp://" + echo)},
+        "admin":     map[string]any{"listen": "127.0.0.1:0", "token": "secret"},
+    })
+    addr := srv.Addrs()["admin"]
+    target := `{"target":"` + app.URL + `"}`
+
+    steps := []struct {
+        method, path, body string
+        status             int
+        contains           string
+    }{
+        {"POST", "/api/routes/path/api", target, http.StatusCreated, app.URL},
+        {"POST", "/api/routes/path/api", target, http.StatusConflict, "already exists"},
+        {"GET", "/api/routes/path/api", "", http.StatusOK, app.URL},
+        {"GET", "/api/routes/path", "", http.StatusOK, `"/api"`},
+        {"PUT", "/api/routes/path/api", `{"target":"` + app.URL + `","max_body_bytes":100}`, http.StatusOK, "max_body_bytes"},
+        {"PUT", "/api/routes/subdomain/app", target, http.StatusCreated, app.URL},
+        {"POST", "/api/routes/path/bad", `{"target":"` + app.URL + `","nope":1}`, http.StatusBadRequest, "unknown field"},
+        {"POST", "/api/routes/path/bad", `{"target":"ftp://example.com"}`, http.StatusUnprocessableEntity, "unsupported target scheme"},
+        {"POST", "/api/routes/tcp/ssh", target, http.StatusUnprocessableEntity, "tcp rules need a tcp:// target"},
+        {"POST", "/api/routes/domain/example.com", `{"target":"tcp://` + echo + `"}`, http.StatusUnprocessableEntity, "only supported for subdomain and tcp rules"},
+        {"PUT", "/api/routes/path/env", `{"target":"http://${ADMIN_TEST_BACKEND}"}`, http.StatusCreated, "${ADMIN_TEST_BACKEND}"},
+        {"PUT", "/api/routes/path/unset", `{"target":"http://${ADMIN_TEST_UNSET}"}`, http.StatusUnprocessableEntity, "${ADMIN_TEST_UNSET}: environment variable not set"},
+        {"POST", "/api/routes/tcp/db", `{"target":"tcp://` + echo + `"}`, http.StatusUnprocessableEntity, "conflicts with the tcp:// subdomain rule"},
+        {"POST", "/api/routes/nope/x", target, http.StatusNotFound, "unknown route type"},
+        {"GET", "/api/routes/path/missing", "", http.StatusNotFound, "not found"},
+        {"DELETE", "/api/routes/subdomain/app", "", http.StatusNoContent, ""},
+        {"DELETE", "/api/routes/subdomain/app", "", http.StatusNotFound, "not found"},
+        {"POST", "/api/ports", `{"port":8081}`, http.StatusCreated, "8081"},
+        {"POST", "/api/ports", `{"port":8081}`, http.StatusConflict, "already allowed"},
+        {"POST", "/api/ports", `{"port":70000}`, http.StatusBadRequest, "between 1 and 65535"},
+        {"GET", "/api/ports", "", http.StatusOK, "8081"},
+        {"DELETE", "/api/ports/8081", "", http.StatusNoContent, ""},
+        {"DELETE", "/api/ports/8081", "", http.StatusNotFound, "not found"},
+    }
+    for _, step := range steps {
+        status, body := api(t, addr, "secret", step.method, step.path, step.body)
+        if status != step.status || !strings.Contains(body, step.contains) {
+            t.Errorf("%s %s = %d %s, want %d containing %q", step.method, step.path, status, strings.TrimSpace(body), step.status, step.contains)
+        }
+    }
+
+    // Edits land in the file, keeping the sections the API didn't touch.
+    data, err := os.ReadFile(file)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var cfg struct {
+        Path      map[string]map[string]any `json:"path"`
+        Subdomain map[string]map[string]any `json:"subdomain"`
+        TCP       map[string]any            `json:"tcp"`
+        Admin     map[string]any            `json:"admin"`
+    }
+    if err := json.Unmarshal(data, &cfg); err != nil {
+        t.Fatal(err)
+    }
+    if cfg.Path["/api"]["max_body_bytes"] != float64(100) || cfg.Path["/env"]["target"] != "http://${ADMIN_TEST_BACKEND}" || cfg.Subdomain["db"] == nil || cfg.Subdomain["app"] != nil || cfg.TCP != nil || cfg.Admin["token"] != "secret" {
+        t.Errorf("config file after the edits:\n%s", data)
+    }
+
+    // Edits are applied without a config watcher running.
+    if status, body := get(t, srv.Addrs()["0"], "localhost", "/api/x"); status != 200 || body != "app /x" {
+        t.Errorf("GET /api/x after adding the route = %d %q", status, body)
+    }
+    if status, body := get(t, srv.Addrs()["0"], "localhost", "/env/x"); status != 200 || body != "app /x" {
+        t.Errorf("GET /env/x after adding a placeholder target = %d %q", status, body)
+    }
+
+    status, body := api(t, addr, "secret", "GET", "/api/status", "")
+    var st struct {
+        Listeners []int             `json:"listeners"`
+        Addresses map[string]string `json:"addresses"`
+        Routes    map[string]int    `json:"routes"`
+        Reloads   int               `json:"reloads"`
+    }
+    if err := json.Unmarshal([]byte(body), &st); status != http.StatusOK || err != nil {
+        t.Fatalf("GET /api/status = %d %s", status, body)
+    }
+    // The initial load, then one reload for each of the seven edits.
+    if st.Addresses["0"] != srv.Addrs()["0"] || st.Routes["path"] != 2 || st.Routes["subdomain"] != 1 || st.Reloads != 8 {
+        t.Errorf("status = %+v", st)
+    }
+}
+
+func TestAdminUI(t *testing.T) {
+    srv, _ := startProxy(t, map[string]any{"admin": map[string]any{"listen": "127.0.0.1:0", "token": "secret"}})
+    addr := srv.Addrs()["admin"]
+    noRedirect := &http.Client{
+        Transport: client.Transport,
+        CheckRedirect: func(*http.Request, []*http.Request) error {
+            return http.ErrUseLastResponse
+        },
+    }
+
+    resp, err := noRedirect.Get("http://" + addr + "/")
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/ui/" {
+        t.Errorf("GET / = %d to %q, want a redirect to /ui/", resp.StatusCode, resp.Header.Get("Location"))
+    }
+
+    // The page itself is public; it asks for the token to call the API.
+    resp, err = client.Get("http://" + addr + "/ui/")
+    if err != nil {
+        t.Fatal(err)
+    }
+    page, _ := io.ReadAll(resp.Body)
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+        t.Fatalf("GET /ui/ = %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+    }
+    if csp := resp.Header.Get("Content-Security-Policy"); !strings.Contains(csp, "default-src 'self'") {
+        t.Errorf("Content-Security-Policy = %q", csp)
+    }
+    if !strings.Contains(string(page), "/api/") {
+        t.Error("UI page doesn't call the admin API")
+    }
+
+    for _, path := range []string{"/ui/other", "/nope"} {
+        if status, _ := api(t, addr, "", "GET", path, ""); status != http.StatusNotFound {
+            t.Errorf("GET %s = %d, want 404", path, status)
+        }
+    }
+}
+
+func TestAdminConfigDir(t *testing.T) {
+    dir := t.TempDir()
+    writeConfig(t, filepath.Join(dir, "base.json"), map[string]any{
+        "bind":          "127.0.0.1",
+        "allowed_ports": []int{0},
+        "admin":         map[string]any{"listen": "127.0.0.1:0", "token": "secret"},
+    })
+    writeConfig(t, filepath.Join(dir, "app.json"), map[string]any{"path": map[string]any{"/": route("http://app")}})
+    srv := proxy.NewServer(dir)
+    if err := srv.Reload(); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(srv.Stop)
+    addr := srv.Addrs()["admin"]
+
+    if status, body := api(t, addr, "secret", "GET", "/api/routes/path", ""); status != http.StatusOK || !strings.Contains(body, "http://app") {
+        t.Errorf("GET /api/routes/path = %d %s, want the merged rules", status, body)
+    }
+    for _, call := range [][3]string{
+        {"POST", "/api/routes/path/api", `{"target":"http://api"}`},
+        {"DELETE", "/api/routes/path/", ""},
+        {"POST", "/api/ports", `{"port":8080}`},
+    } {
+        if status, body := api(t, addr, "secret", call[0], call[1], call[2]); status != http.StatusConflict || !strings.Contains(body, "edit its files instead") {
+            t.Errorf("%s %s = %d %s, want 409", call[0], call[1], status, body)
+        }
+    }
+}
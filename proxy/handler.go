@@ -0,0 +1,453 @@
+package proxy
+
+import (
+    "bytes"
+    "context"
+    "crypto/rand"
+    "crypto/tls"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "math"
+    "net"
+    "net/http"
+    "net/http/httputil"
+    "net/url"
+    "strings"
+    "sync/atomic"
+    "time"
+    "github.com/SrLiath/ProxSize/config"
+    "github.com/SrLiath/ProxSize/router"
+)
+
+// Routing is what an HTTP listener needs to serve a request. Reloads
+// replace it atomically, so each request sees either the old or the new
+// configuration, never a mix.
+type Routing struct {
+    routes  []router.Route
+    acl     *router.ACL
+    cap     *router.ConnLimiter
+    trusted []*net.IPNet
+    global  *router.ConnLimiter
+    tls     *tls.Config
+}
+
+// NewRouting sets up the routing for an HTTP listener on port from the
+// table's routes for it, loading its TLS certificate if it has one.
+func NewRouting(port int, table *router.Table, listener config.ListenerConfig, trusted []*net.IPNet) (*Routing, error) {
+    routes := table.Routes(port)
+    routing := &Routing{
+        routes:  routes,
+        acl:     router.NewACL(listener.Allow, listener.Deny, fmt.Sprintf("listener %d", port)),
+        cap:     table.ConnLimiter(fmt.Sprintf("listener:%d", port), listener.MaxConnections, time.Duration(listener.QueueTimeout)),
+        trusted: trusted,
+        global:  table.Global,
+    }
+    if listener.TLS != nil {
+        cert, err := tls.LoadX509KeyPair(listener.TLS.CertFile, listener.TLS.KeyFile)
+        if err != nil {
+            return nil, fmt.Errorf("loading TLS certificate: %w", err)
+        }
+        routing.tls = &tls.Config{
+            MinVersion:   tls.VersionTLS12,
+            Certificates: []tls.Certificate{cert},
+            NextProtos:   []string{"h2", "http/1.1"},
+        }
+        for _, route := range routes {
+            if route.ClientCert != nil {
+                // Certificates are checked per route in the handler, since
+                // routes on the same listener may trust different CAs.
+                routing.tls.ClientAuth = tls.RequestClientCert
+                break
+            }
+        }
+    }
+    return routing, nil
+}
+
+// Handler serves requests by the routes of its current Routing. Proxy
+// listeners use one each; it can also be mounted on any http.Server.
+type Handler struct {
+    port    int
+    routing atomic.Pointer[Routing]
+    tel     *telemetry
+}
+
+// NewHandler creates a Handler with its own metrics, and no access log or
+// tracing.
+func NewHandler(port int, routing *Routing) *Handler {
+    return newHandler(port, routing, newTelemetry())
+}
+
+func newHandler(port int, routing *Routing, tel *telemetry) *Handler {
+    h := &Handler{port: port, tel: tel}
+    h.routing.Store(routing)
+    return h
+}
+
+// Update swaps in new routing. Requests already being served finish with the
+// routing they started with.
+func (h *Handler) Update(routing *Routing) {
+    h.routing.Store(routing)
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    rt := h.routing.Load()
+    host, _, _ := net.SplitHostPort(r.Host)
+    if host == "" {
+        host = r.Host
+    }
+    path := r.URL.Path
+    client := router.ClientIP(r, rt.trusted)
+    r = withRequestID(w, r, rt.trusted)
+    logRequest(r, "📨 [%s] %s | Host: %q | Path: %q | Client: %s", r.Method, r.URL.String(), host, path, client)
+
+    start := time.Now()
+    sw := &statusWriter{ResponseWriter: w}
+    w = sw
+    body := &countingReader{ReadCloser: r.Body}
+    r.Body = body
+    var matched *router.Route
+    reqSpan := h.tel.startServerSpan(r, host, client)
+    if reqSpan != nil {
+        r = r.WithContext(context.WithValue(r.Context(), spanContextKey{}, reqSpan))
+    }
+    defer func() {
+        reqSpan.finishHTTP(matched, sw.status)
+        elapsed := time.Since(start)
+        h.tel.metrics.observeRequest(matched, sw.status, elapsed)
+        h.tel.writeAccessLog(r, host, path, client, matched, sw, body.n, elapsed)
+    }()
+
+    if !rt.acl.Allows(client) {
+        logRequest(r, "🚫 Client %s denied on port %d", client, h.port)
+        http.Error(w, "Forbidden", http.StatusForbidden)
+        return
+    }
+
+    if !rt.cap.Acquire() {
+        logRequest(r, "⛔ Port %d at its connection limit, rejecting %s", h.port, client)
+        http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+        return
+    }
+    defer rt.cap.Release()
+    if !rt.global.Acquire() {
+        logRequest(r, "⛔ Global connection limit reached, rejecting %s", client)
+        http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+        return
+    }
+    defer rt.global.Release()
+
+    routing := reqSpan.child("route", spanKindInternal)
+    for _, route := range rt.routes {
+        if !route.Matches(host, path) {
+            continue
+        }
+        logRequest(r, "🎯 Match %s: %q -> %q", route.Type, route.Key, route.Target)
+        matched = &route
+        routing.setAttr("proxsize.route.type", route.Type)
+        routing.setAttr("proxsize.route.key", route.Key)
+        routing.end()
+        if !route.ACL.Allows(client) {
+            logRequest(r, "🚫 Client %s denied for %s %q", client, route.Type, route.Key)
+            http.Error(w, "Forbidden", http.StatusForbidden)
+            return
+        }
+        if route.RateLimit != nil {
+            if ok, wait := route.RateLimit.Allow(route.RateLimit.Key(r, client)); !ok {
+                logRequest(r, "🐢 Rate limit exceeded for %s %q by %s", route.Type, route.Key, client)
+                w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(wait.Seconds()))))
+                http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+                return
+            }
+        }
+        if route.ClientCert != nil {
+            if err := route.ClientCert.Authorize(r); err != nil {
+                logRequest(r, "🔒 Client certificate rejected for %s %q: %v", route.Type, route.Key, err)
+                http.Error(w, "Forbidden", http.StatusForbidden)
+                return
+            }
+        }
+        if route.JWT != nil {
+            if err := route.JWT.Authorize(r); err != nil {
+                logRequest(r, "🔒 JWT rejected for %s %q: %v", route.Type, route.Key, err)
+                w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+                http.Error(w, "Unauthorized", http.StatusUnauthorized)
+                return
+            }
+        }
+        if route.MaxBody > 0 || route.BufferBody {
+            if err := limitBody(w, r, route.MaxBody, route.BufferBody); err != nil {
+                logRequest(r, "📦 Request body rejected for %s %q: %v", route.Type, route.Key, err)
+                http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+                return
+            }
+        }
+        if !route.Backend.Acquire() {
+            logRequest(r, "⛔ Backend %q at its connection limit, rejecting %s", route.Target, client)
+            http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+            return
+        }
+        defer route.Backend.Release()
+        trim := ""
+        if route.Type == "path" {
+            trim = route.Key
+        }
+        h.proxyTo(w, r, route.Target, trim)
+        return
+    }
+
+    routing.end()
+    logRequest(r, "❌ No rule found for %q", r.URL.Path)
+    http.NotFound(w, r)
+}
+
+func (p *Server) startServer(addr string, port int, routing *Routing, listener config.ListenerConfig) *serverInstance {
+    ln, err := listen(addr)
+    if err != nil {
+        log.Printf("❌ Error on port %d: %v", port, err)
+        return nil
+    }
+    inst := &serverInstance{port: port, addr: addr, listener: ln, binding: httpBinding(listener), handler: newHandler(port, routing, p.tel)}
+
+    server := &http.Server{
+        Addr:    addr,
+        Handler: inst.handler,
+    }
+    if t := listener.Timeouts; t != nil {
+        server.ReadHeaderTimeout = time.Duration(t.ReadHeader)
+        server.ReadTimeout = time.Duration(t.Read)
+        server.WriteTimeout = time.Duration(t.Write)
+        server.IdleTimeout = time.Duration(t.Idle)
+        server.MaxHeaderBytes = t.MaxHeaderBytes
+    }
+
+    if listener.TLS != nil {
+        // The certificate and client auth come from the current routing, so
+        // reloads can change them without rebinding.
+        server.TLSConfig = &tls.Config{
+            GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+                return inst.handler.routing.Load().tls, nil
+            },
+        }
+    }
+    inst.server = server
+
+    go func() {
+        var err error
+        if listener.TLS != nil {
+            log.Printf("🔌 TLS server listening on %s with %d routes", ln.Addr(), len(routing.routes))
+            err = server.ServeTLS(ln, "", "")
+        } else {
+            log.Printf("🔌 Server listening on %s with %d routes", ln.Addr(), len(routing.routes))
+            err = server.Serve(ln)
+        }
+        if err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+            log.Printf("❌ Error on port %d: %v", port, err)
+        }
+    }()
+
+    return inst
+}
+
+// defaultBufferLimit caps buffered bodies on routes that set buffer_body
+// without max_body_bytes.
+const defaultBufferLimit = 10 << 20
+
+// limitBody enforces max bytes on the request body. Streamed bodies are cut
+// off by http.MaxBytesReader (surfacing as a 413 from the proxy's error
+// handler); buffered bodies are read fully up front so they can be replayed.
+func limitBody(w http.ResponseWriter, r *http.Request, max int64, buffer bool) error {
+    if max > 0 && r.ContentLength > max {
+        return fmt.Errorf("content length %d over limit of %d bytes", r.ContentLength, max)
+    }
+    if !buffer {
+        r.Body = http.MaxBytesReader(w, r.Body, max)
+        return nil
+    }
+
+    if max <= 0 {
+        max = defaultBufferLimit
+    }
+    data, err := io.ReadAll(io.LimitReader(r.Body, max+1))
+    r.Body.Close()
+    if err != nil {
+        return err
+    }
+    if int64(len(data)) > max {
+        return fmt.Errorf("body over limit of %d bytes", max)
+    }
+    r.ContentLength = int64(len(data))
+    r.Body = io.NopCloser(bytes.NewReader(data))
+    r.GetBody = func() (io.ReadCloser, error) {
+        return io.NopCloser(bytes.NewReader(data)), nil
+    }
+    return nil
+}
+
+type requestIDKey struct{}
+
+// withRequestID makes sure r carries an X-Request-ID, which is forwarded to
+// the backend and echoed to the client. An incoming ID is only kept when it
+// comes from a trusted proxy and looks sane; otherwise a new one is generated.
+func withRequestID(w http.ResponseWriter, r *http.Request, trusted []*net.IPNet) *http.Request {
+    peer, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        peer = r.RemoteAddr
+    }
+    id := r.Header.Get("X-Request-ID")
+    if id == "" || !validRequestID(id) || !router.ContainsIP(trusted, net.ParseIP(peer)) {
+        var b [16]byte
+        rand.Read(b[:])
+        id = hex.EncodeToString(b[:])
+    }
+    r.Header.Set("X-Request-ID", id)
+    w.Header().Set("X-Request-ID", id)
+    return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+func validRequestID(id string) bool {
+    if len(id) > 128 {
+        return false
+    }
+    for _, c := range id {
+        if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+            return false
+        }
+    }
+    return true
+}
+
+func requestID(r *http.Request) string {
+    id, _ := r.Context().Value(requestIDKey{}).(string)
+    return id
+}
+
+// logRequest logs a line prefixed with the request's ID.
+func logRequest(r *http.Request, format string, args ...any) {
+    if id := requestID(r); id != "" {
+        format = "[" + id + "] " + format
+    }
+    log.Printf(format, args...)
+}
+
+func (h *Handler) proxyTo(w http.ResponseWriter, r *http.Request, target, trim string) {
+    remote, err := url.Parse(target)
+    if err != nil {
+        http.Error(w, "Invalid target", http.StatusBadGateway)
+        return
+    }
+
+    hostPort := r.Host
+    _, rPort, err := net.SplitHostPort(hostPort)
+    if err != nil {
+        if remote.Scheme == "https" {
+            rPort = "443"
+        } else {
+            rPort = "80"
+        }
+    }
+
+    host, hPort, err := net.SplitHostPort(remote.Host)
+    if err != nil || hPort == "" {
+        remote.Host = net.JoinHostPort(remote.Host, rPort)
+    } else if host == "" {
+        remote.Host = net.JoinHostPort(remote.Host, rPort)
+    }
+
+    parent, _ := r.Context().Value(spanContextKey{}).(*span)
+    upstream := parent.child("upstream", spanKindClient)
+    upstream.setAttr("server.address", remote.Host)
+    upstream.setAttr("url.full", target)
+
+    proxy := httputil.NewSingleHostReverseProxy(remote)
+    proxy.Director = func(r *http.Request) {
+        r.Host = remote.Host
+        r.URL.Scheme = remote.Scheme
+        r.URL.Host = remote.Host
+        r.URL.Path = strings.TrimPrefix(r.URL.Path, trim)
+        if !strings.HasPrefix(r.URL.Path, "/") {
+            // Trimming "/" or a prefix like "/api/" takes the slash too.
+            r.URL.Path = "/" + r.URL.Path
+        }
+        upstream.inject(r.Header)
+    }
+    proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+        var tooLarge *http.MaxBytesError
+        if errors.As(err, &tooLarge) {
+            logRequest(r, "📦 Request body over %d bytes for %q", tooLarge.Limit, target)
+            upstream.fail(err.Error())
+            upstream.end()
+            http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+            return
+        }
+        logRequest(r, "❌ Proxy error for %q: %v", target, err)
+        h.tel.metrics.backendResult(target, false)
+        upstream.fail(err.Error())
+        upstream.end()
+        w.WriteHeader(http.StatusBadGateway)
+    }
+    proxy.ModifyResponse = func(resp *http.Response) error {
+        if requestID(r) != "" {
+            // The client already gets our ID; don't let an echo duplicate it.
+            resp.Header.Del("X-Request-ID")
+        }
+        h.tel.metrics.backendResult(target, true)
+        upstream.setAttr("http.response.status_code", resp.StatusCode)
+        if resp.StatusCode >= 500 {
+            upstream.fail(resp.Status)
+        }
+        upstream.end()
+        return nil
+    }
+
+    proxy.ServeHTTP(w, r)
+}
+
+// statusWriter records the status and size of a response for the access log.
+type statusWriter struct {
+    http.ResponseWriter
+    status int
+    bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+    if w.status == 0 {
+        w.status = code
+    }
+    w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+    if w.status == 0 {
+        w.status = http.StatusOK
+    }
+    n, err := w.ResponseWriter.Write(b)
+    w.bytes += int64(n)
+    return n, err
+}
+
+func (w *statusWriter) Flush() {
+    if f, ok := w.ResponseWriter.(http.Flusher); ok {
+        f.Flush()
+    }
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer (for
+// hijacking upgraded connections, deadlines, ...).
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+    return w.ResponseWriter
+}
+
+type countingReader struct {
+    io.ReadCloser
+    n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+    n, err := r.ReadCloser.Read(p)
+    r.n += int64(n)
+    return n, err
+}
@@ -0,0 +1,144 @@
+package proxy_test
+
+import (
+    "fmt"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "regexp"
+    "strings"
+    "testing"
+    "github.com/SrLiath/ProxSize/config"
+    "github.com/SrLiath/ProxSize/proxy"
+    "github.com/SrLiath/ProxSize/router"
+)
+
+// handlerFor builds the Handler a listener on port 80 would use for rules.
+func handlerFor(t *testing.T, rules config.Rules) *proxy.Handler {
+    t.Helper()
+    routing, err := proxy.NewRouting(80, router.Build(rules, nil), config.ListenerConfig{}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return proxy.NewHandler(80, routing)
+}
+
+// onlyReader hides the length of a body, so it is sent chunked.
+type onlyReader struct {
+    io.Reader
+}
+
+func TestBodyLimits(t *testing.T) {
+    upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        body, err := io.ReadAll(r.Body)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        fmt.Fprintf(w, "length=%d read=%d", r.ContentLength, len(body))
+    }))
+    t.Cleanup(upstream.Close)
+    handler := handlerFor(t, config.Rules{Subdomain: map[string]config.RouteEntry{
+        "limited":  {Target: upstream.URL, MaxBodyBytes: 10},
+        "buffered": {Target: upstream.URL, MaxBodyBytes: 10, BufferBody: true},
+        "default":  {Target: upstream.URL, BufferBody: true},
+    }})
+
+    tests := []struct {
+        name    string
+        host    string
+        body    string
+        chunked bool
+        status  int
+        want    string
+    }{
+        {"within limit", "limited", "12345", false, 200, "length=5 read=5"},
+        {"declared length over limit", "limited", strings.Repeat("x", 20), false, 413, ""},
+        {"streamed body over limit", "limited", strings.Repeat("x", 20), true, 413, ""},
+        {"streamed body within limit", "limited", "12345", true, 200, "length=-1 read=5"},
+        {"buffered gets a length", "buffered", "12345", true, 200, "length=5 read=5"},
+        {"buffered over limit", "buffered", strings.Repeat("x", 11), true, 413, ""},
+        {"buffered with the default limit", "default", strings.Repeat("x", 1000), true, 200, "length=1000 read=1000"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var body io.Reader = strings.NewReader(tt.body)
+            if tt.chunked {
+                body = onlyReader{body}
+            }
+            req := httptest.NewRequest("POST", "http://"+tt.host+".example.com/", body)
+            if tt.chunked {
+                req.ContentLength = -1
+            }
+            rec := httptest.NewRecorder()
+            handler.ServeHTTP(rec, req)
+            if rec.Code != tt.status {
+                t.Fatalf("status = %d %q, want %d", rec.Code, rec.Body.String(), tt.status)
+            }
+            if tt.want != "" && rec.Body.String() != tt.want {
+                t.Errorf("backend saw %q, want %q", rec.Body.String(), tt.want)
+            }
+        })
+    }
+}
+
+func TestRequestID(t *testing.T) {
+    upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        // Echo the ID back, as some backends do.
+        w.Header().Set("X-Request-ID", r.Header.Get("X-Request-ID"))
+        fmt.Fprint(w, r.Header.Get("X-Request-ID"))
+    }))
+    t.Cleanup(upstream.Close)
+    trusted, err := config.ParseCIDRs([]string{"10.0.0.0/8"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    routing, err := proxy.NewRouting(80, router.Build(config.Rules{Path: map[string]config.RouteEntry{
+        "/": {Target: upstream.URL},
+    }}, nil), config.ListenerConfig{}, trusted)
+    if err != nil {
+        t.Fatal(err)
+    }
+    handler := proxy.NewHandler(80, routing)
+    generated := regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+    tests := []struct {
+        name   string
+        remote string
+        id     string
+        kept   bool
+    }{
+        {"generated when missing", "10.0.0.2:5000", "", false},
+        {"kept from a trusted proxy", "10.0.0.2:5000", "abc-123_x.y:z", true},
+        {"replaced from an untrusted client", "203.0.113.9:5000", "abc-123", false},
+        {"invalid characters", "10.0.0.2:5000", "abc 123", false},
+        {"header injection", "10.0.0.2:5000", "abc\r\nX-Evil: 1", false},
+        {"longest allowed", "10.0.0.2:5000", strings.Repeat("a", 128), true},
+        {"too long", "10.0.0.2:5000", strings.Repeat("a", 129), false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            req := httptest.NewRequest("GET", "http://example.com/", nil)
+            req.RemoteAddr = tt.remote
+            if tt.id != "" {
+                req.Header.Set("X-Request-ID", tt.id)
+            }
+            rec := httptest.NewRecorder()
+            handler.ServeHTTP(rec, req)
+
+            ids := rec.Header().Values("X-Request-ID")
+            if len(ids) != 1 {
+                t.Fatalf("response X-Request-ID = %q, want exactly one", ids)
+            }
+            if seen := rec.Body.String(); seen != ids[0] {
+                t.Errorf("backend saw %q, client got %q", seen, ids[0])
+            }
+            if tt.kept && ids[0] != tt.id {
+                t.Errorf("X-Request-ID = %q, want %q kept", ids[0], tt.id)
+            }
+            if !tt.kept && !generated.MatchString(ids[0]) {
+                t.Errorf("X-Request-ID = %q, want a generated ID", ids[0])
+            }
+        })
+    }
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "time"
+    "github.com/SrLiath/ProxSize/config"
+    "github.com/SrLiath/ProxSize/tcpmux"
+)
+
+// drainTimeout bounds how long a stopped listener waits for in-flight
+// requests and TCP sessions before closing them.
+const drainTimeout = 30 * time.Second
+
+// serverInstance is one running listener: an HTTP port, the TCP multiplexer
+// or the admin server.
+type serverInstance struct {
+    port     int
+    addr     string
+    server   *http.Server
+    listener net.Listener
+    // binding holds the listener settings that can only change by rebinding
+    // the port. Everything else is swapped in place on reload.
+    binding  string
+    handler  *Handler
+    tcp      *tcpmux.Server
+}
+
+// stopServer closes the listener right away, so the port can be bound again,
+// and lets in-flight requests and TCP sessions drain in the background.
+func (p *Server) stopServer(inst *serverInstance) {
+    log.Printf("🛑 Stopping server on %s", inst.addr)
+    inst.listener.Close()
+    p.draining.Add(1)
+    go func() {
+        defer p.draining.Done()
+        inst.drain()
+    }()
+}
+
+// drain waits for in-flight requests and TCP sessions to finish, closing
+// whatever is left after drainTimeout.
+func (inst *serverInstance) drain() {
+    ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+    defer cancel()
+    if inst.server != nil {
+        if err := inst.server.Shutdown(ctx); err != nil {
+            log.Printf("⌛ %s still had requests in flight after %s, closing them", inst.addr, drainTimeout)
+            inst.server.Close()
+        }
+    }
+    if inst.tcp != nil {
+        if n := inst.tcp.Drain(ctx); n > 0 {
+            log.Printf("⌛ %s still had %d TCP sessions after %s, closing them", inst.addr, n, drainTimeout)
+        }
+    }
+    log.Printf("✅ %s drained", inst.addr)
+}
+
+// httpBinding describes the settings baked into a listener when it starts.
+// Listeners whose binding is unchanged keep running across reloads.
+func httpBinding(lc config.ListenerConfig) string {
+    var t config.TimeoutsConfig
+    if lc.Timeouts != nil {
+        t = *lc.Timeouts
+    }
+    return fmt.Sprintf("tls=%t read_header=%d read=%d write=%d idle=%d max_header_bytes=%d",
+        lc.TLS != nil, t.ReadHeader, t.Read, t.Write, t.Idle, t.MaxHeaderBytes)
+}
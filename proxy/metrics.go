@@ -0,0 +1,346 @@
+package proxy
+
+import (
+    "fmt"
+    "io"
+    "net/http"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+    "github.com/SrLiath/ProxSize/router"
+)
+
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+    counts []uint64
+    sum    float64
+    count  uint64
+}
+
+type requestKey struct {
+    routeType, routeKey, status string
+}
+
+type routeKey struct {
+    routeType, routeKey string
+}
+
+// proxMetrics holds the counters exported on /metrics. Backend health is
+// passive: a backend is up when the last proxied request or dial to it
+// succeeded.
+type proxMetrics struct {
+    mu             sync.Mutex
+    requests       map[requestKey]uint64
+    durations      map[routeKey]*histogram
+    backendErrors  map[string]uint64
+    backendUp      map[string]bool
+    tcpActive      map[string]int64
+    tcpBytesIn     map[string]uint64
+    tcpBytesOut    map[string]uint64
+    reloads        uint64
+    reloadFailures uint64
+    lastReload     time.Time
+}
+
+func newMetrics() *proxMetrics {
+    return &proxMetrics{
+        requests:      map[requestKey]uint64{},
+        durations:     map[routeKey]*histogram{},
+        backendErrors: map[string]uint64{},
+        backendUp:     map[string]bool{},
+        tcpActive:     map[string]int64{},
+        tcpBytesIn:    map[string]uint64{},
+        tcpBytesOut:   map[string]uint64{},
+    }
+}
+
+func (m *proxMetrics) reloaded() {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.reloads++
+    m.lastReload = time.Now()
+}
+
+func (m *proxMetrics) reloadFailed() {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.reloadFailures++
+}
+
+func (m *proxMetrics) observeRequest(route *router.Route, status int, elapsed time.Duration) {
+    if status == 0 {
+        status = http.StatusOK
+    }
+    rk := routeKey{"none", ""}
+    if route != nil {
+        rk = routeKey{route.Type, route.Key}
+    }
+
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.requests[requestKey{rk.routeType, rk.routeKey, fmt.Sprintf("%d", status)}]++
+    h, ok := m.durations[rk]
+    if !ok {
+        h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+        m.durations[rk] = h
+    }
+    seconds := elapsed.Seconds()
+    for i, bound := range latencyBuckets {
+        if seconds <= bound {
+            h.counts[i]++
+        }
+    }
+    h.sum += seconds
+    h.count++
+}
+
+func (m *proxMetrics) backendResult(target string, ok bool) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.backendUp[target] = ok
+    if !ok {
+        m.backendErrors[target]++
+    }
+}
+
+func (m *proxMetrics) tcpOpened(target string) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.tcpActive[target]++
+}
+
+func (m *proxMetrics) tcpClosed(target string, in, out int64) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.tcpActive[target]--
+    m.tcpBytesIn[target] += uint64(in)
+    m.tcpBytesOut[target] += uint64(out)
+}
+
+// retainRoutes drops series for routes and targets that are no longer
+// configured, so /metrics follows the route table built on each reload.
+func (m *proxMetrics) retainRoutes(routes []router.Route) {
+    keys := map[routeKey]bool{{"none", ""}: true}
+    targets := map[string]bool{}
+    for _, route := range routes {
+        keys[routeKey{route.Type, route.Key}] = true
+        targets[route.Target] = true
+    }
+
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    for k := range m.requests {
+        if !keys[routeKey{k.routeType, k.routeKey}] {
+            delete(m.requests, k)
+        }
+    }
+    for k := range m.durations {
+        if !keys[k] {
+            delete(m.durations, k)
+        }
+    }
+    for _, series := range []map[string]uint64{m.backendErrors, m.tcpBytesIn, m.tcpBytesOut} {
+        for target := range series {
+            if !targets[target] {
+                delete(series, target)
+            }
+        }
+    }
+    for target := range m.backendUp {
+        if !targets[target] {
+            delete(m.backendUp, target)
+        }
+    }
+    for target, n := range m.tcpActive {
+        if !targets[target] && n == 0 {
+            delete(m.tcpActive, target)
+        }
+    }
+}
+
+type routeStats struct {
+    Type     string  `json:"type"`
+    Key      string  `json:"key"`
+    Requests uint64  `json:"requests"`
+    Errors   uint64  `json:"errors"`
+    AvgMS    float64 `json:"avg_ms"`
+}
+
+type backendStats struct {
+    Target      string `json:"target"`
+    Up          *bool  `json:"up"`
+    Errors      uint64 `json:"errors"`
+    TCPActive   int64  `json:"tcp_active"`
+    TCPBytesIn  uint64 `json:"tcp_bytes_in"`
+    TCPBytesOut uint64 `json:"tcp_bytes_out"`
+}
+
+// snapshot summarises the counters per route and per backend for the admin
+// UI. Up is nil for backends that haven't been contacted yet.
+func (m *proxMetrics) snapshot() map[string]any {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    byRoute := map[routeKey]*routeStats{}
+    for k, n := range m.requests {
+        rk := routeKey{k.routeType, k.routeKey}
+        st, ok := byRoute[rk]
+        if !ok {
+            st = &routeStats{Type: k.routeType, Key: k.routeKey}
+            byRoute[rk] = st
+        }
+        st.Requests += n
+        if strings.HasPrefix(k.status, "5") {
+            st.Errors += n
+        }
+    }
+    routes := []routeStats{}
+    for rk, st := range byRoute {
+        if h := m.durations[rk]; h != nil && h.count > 0 {
+            st.AvgMS = h.sum / float64(h.count) * 1000
+        }
+        routes = append(routes, *st)
+    }
+    sort.Slice(routes, func(i, j int) bool {
+        if routes[i].Type != routes[j].Type {
+            return routes[i].Type < routes[j].Type
+        }
+        return routes[i].Key < routes[j].Key
+    })
+
+    targets := map[string]bool{}
+    for _, series := range []map[string]uint64{m.backendErrors, m.tcpBytesIn} {
+        for t := range series {
+            targets[t] = true
+        }
+    }
+    for t := range m.backendUp {
+        targets[t] = true
+    }
+    for t := range m.tcpActive {
+        targets[t] = true
+    }
+    backends := []backendStats{}
+    for _, t := range sortedKeys(targets) {
+        st := backendStats{
+            Target:      t,
+            Errors:      m.backendErrors[t],
+            TCPActive:   m.tcpActive[t],
+            TCPBytesIn:  m.tcpBytesIn[t],
+            TCPBytesOut: m.tcpBytesOut[t],
+        }
+        if up, ok := m.backendUp[t]; ok {
+            st.Up = &up
+        }
+        backends = append(backends, st)
+    }
+    return map[string]any{"routes": routes, "backends": backends}
+}
+
+// writeTo renders the metrics in the Prometheus text exposition format.
+func (m *proxMetrics) writeTo(w io.Writer) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    fmt.Fprintln(w, "# HELP proxsize_http_requests_total HTTP requests by matched route and status.")
+    fmt.Fprintln(w, "# TYPE proxsize_http_requests_total counter")
+    reqKeys := make([]requestKey, 0, len(m.requests))
+    for k := range m.requests {
+        reqKeys = append(reqKeys, k)
+    }
+    sort.Slice(reqKeys, func(i, j int) bool {
+        a, b := reqKeys[i], reqKeys[j]
+        if a.routeType != b.routeType {
+            return a.routeType < b.routeType
+        }
+        if a.routeKey != b.routeKey {
+            return a.routeKey < b.routeKey
+        }
+        return a.status < b.status
+    })
+    for _, k := range reqKeys {
+        fmt.Fprintf(w, "proxsize_http_requests_total{route_type=%s,route_key=%s,status=%s} %d\n",
+            promLabel(k.routeType), promLabel(k.routeKey), promLabel(k.status), m.requests[k])
+    }
+
+    fmt.Fprintln(w, "# HELP proxsize_http_request_duration_seconds HTTP request latency by matched route.")
+    fmt.Fprintln(w, "# TYPE proxsize_http_request_duration_seconds histogram")
+    durKeys := make([]routeKey, 0, len(m.durations))
+    for k := range m.durations {
+        durKeys = append(durKeys, k)
+    }
+    sort.Slice(durKeys, func(i, j int) bool {
+        if durKeys[i].routeType != durKeys[j].routeType {
+            return durKeys[i].routeType < durKeys[j].routeType
+        }
+        return durKeys[i].routeKey < durKeys[j].routeKey
+    })
+    for _, k := range durKeys {
+        h := m.durations[k]
+        labels := fmt.Sprintf("route_type=%s,route_key=%s", promLabel(k.routeType), promLabel(k.routeKey))
+        for i, bound := range latencyBuckets {
+            fmt.Fprintf(w, "proxsize_http_request_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels, bound, h.counts[i])
+        }
+        fmt.Fprintf(w, "proxsize_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+        fmt.Fprintf(w, "proxsize_http_request_duration_seconds_sum{%s} %g\n", labels, h.sum)
+        fmt.Fprintf(w, "proxsize_http_request_duration_seconds_count{%s} %d\n", labels, h.count)
+    }
+
+    writeTargetSeries(w, "proxsize_backend_errors_total", "counter", "Failed requests or dials per backend target.", m.backendErrors)
+    up := map[string]uint64{}
+    for target, ok := range m.backendUp {
+        up[target] = 0
+        if ok {
+            up[target] = 1
+        }
+    }
+    writeTargetSeries(w, "proxsize_backend_up", "gauge", "Passive health: 1 if the last request or dial to the target succeeded.", up)
+    active := map[string]uint64{}
+    for target, n := range m.tcpActive {
+        active[target] = uint64(n)
+    }
+    writeTargetSeries(w, "proxsize_tcp_active_connections", "gauge", "Open TCP sessions per backend target.", active)
+
+    fmt.Fprintln(w, "# HELP proxsize_tcp_bytes_total Bytes proxied over TCP per backend target and direction.")
+    fmt.Fprintln(w, "# TYPE proxsize_tcp_bytes_total counter")
+    for _, target := range sortedKeys(m.tcpBytesIn) {
+        fmt.Fprintf(w, "proxsize_tcp_bytes_total{target=%s,direction=\"in\"} %d\n", promLabel(target), m.tcpBytesIn[target])
+        fmt.Fprintf(w, "proxsize_tcp_bytes_total{target=%s,direction=\"out\"} %d\n", promLabel(target), m.tcpBytesOut[target])
+    }
+
+    fmt.Fprintln(w, "# HELP proxsize_config_reloads_total Configuration reloads.")
+    fmt.Fprintln(w, "# TYPE proxsize_config_reloads_total counter")
+    fmt.Fprintf(w, "proxsize_config_reloads_total %d\n", m.reloads)
+    fmt.Fprintln(w, "# HELP proxsize_config_reload_failures_total Configuration reloads that were rejected.")
+    fmt.Fprintln(w, "# TYPE proxsize_config_reload_failures_total counter")
+    fmt.Fprintf(w, "proxsize_config_reload_failures_total %d\n", m.reloadFailures)
+    fmt.Fprintln(w, "# HELP proxsize_config_last_reload_timestamp_seconds Time of the last successful reload.")
+    fmt.Fprintln(w, "# TYPE proxsize_config_last_reload_timestamp_seconds gauge")
+    fmt.Fprintf(w, "proxsize_config_last_reload_timestamp_seconds %d\n", m.lastReload.Unix())
+}
+
+func writeTargetSeries(w io.Writer, name, kind, help string, series map[string]uint64) {
+    fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+    fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+    for _, target := range sortedKeys(series) {
+        fmt.Fprintf(w, "%s{target=%s} %d\n", name, promLabel(target), series[target])
+    }
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+    keys := make([]string, 0, len(m))
+    for k := range m {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+func promLabel(v string) string {
+    v = strings.ReplaceAll(v, `\`, `\\`)
+    v = strings.ReplaceAll(v, "\n", `\n`)
+    v = strings.ReplaceAll(v, `"`, `\"`)
+    return `"` + v + `"`
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+    "strings"
+    "testing"
+    "time"
+    "github.com/SrLiath/ProxSize/router"
+)
+
+func TestMetricsExposition(t *testing.T) {
+    m := newMetrics()
+    api := &router.Route{Type: "path", Key: "/api", Target: "http://api:80"}
+    m.observeRequest(api, 0, 3*time.Millisecond)
+    m.observeRequest(api, 502, 300*time.Millisecond)
+    m.observeRequest(nil, 404, time.Millisecond)
+    m.backendResult("http://api:80", true)
+    m.backendResult("http://api:80", false)
+    m.tcpOpened("tcp://db:5432")
+    m.tcpOpened("tcp://db:5432")
+    m.tcpClosed("tcp://db:5432", 10, 20)
+    m.reloaded()
+    m.reloadFailed()
+
+    var out strings.Builder
+    m.writeTo(&out)
+    for _, want := range []string{
+        `proxsize_http_requests_total{route_type="path",route_key="/api",status="200"} 1`,
+        `proxsize_http_requests_total{route_type="path",route_key="/api",status="502"} 1`,
+        `proxsize_http_requests_total{route_type="none",route_key="",status="404"} 1`,
+        `proxsize_http_request_duration_seconds_bucket{route_type="path",route_key="/api",le="0.005"} 1`,
+        `proxsize_http_request_duration_seconds_bucket{route_type="path",route_key="/api",le="0.25"} 1`,
+        `proxsize_http_request_duration_seconds_bucket{route_type="path",route_key="/api",le="0.5"} 2`,
+        `proxsize_http_request_duration_seconds_bucket{route_type="path",route_key="/api",le="+Inf"} 2`,
+        `proxsize_http_request_duration_seconds_count{route_type="path",route_key="/api"} 2`,
+        `proxsize_backend_errors_total{target="http://api:80"} 1`,
+        `proxsize_backend_up{target="http://api:80"} 0`,
+        `proxsize_tcp_active_connections{target="tcp://db:5432"} 1`,
+        `proxsize_tcp_bytes_total{target="tcp://db:5432",direction="in"} 10`,
+        `proxsize_tcp_bytes_total{target="tcp://db:5432",direction="out"} 20`,
+        `proxsize_config_reloads_total 1`,
+        `proxsize_config_reload_failures_total 1`,
+        `# TYPE proxsize_http_request_duration_seconds histogram`,
+    } {
+        if !strings.Contains(out.String(), want+"\n") {
+            t.Errorf("metrics missing %s", want)
+        }
+    }
+
+    snap := m.snapshot()
+    routes := snap["routes"].([]routeStats)
+    if len(routes) != 2 || routes[1].Key != "/api" || routes[1].Requests != 2 || routes[1].Errors != 1 {
+        t.Errorf("snapshot routes = %+v", routes)
+    }
+    backends := snap["backends"].([]backendStats)
+    if len(backends) != 2 || backends[0].Up == nil || *backends[0].Up || backends[1].Up != nil {
+        t.Errorf("snapshot backends = %+v, want api down and db not yet dialed", backends)
+    }
+}
+
+func TestRetainRoutes(t *testing.T) {
+    m := newMetrics()
+    kept := router.Route{Type: "subdomain", Key: "app", Target: "http://app:80"}
+    gone := router.Route{Type: "path", Key: "/old", Target: "http://old:80"}
+    for _, route := range []router.Route{kept, gone} {
+        m.observeRequest(&route, 200, time.Millisecond)
+        m.backendResult(route.Target, false)
+    }
+    m.observeRequest(nil, 404, time.Millisecond)
+    m.tcpOpened("tcp://old:22")
+
+    m.retainRoutes([]router.Route{kept})
+    var out strings.Builder
+    m.writeTo(&out)
+    for _, want := range []string{`route_key="app"`, `status="404"`, `target="http://app:80"`, `target="tcp://old:22"`} {
+        if !strings.Contains(out.String(), want) {
+            t.Errorf("series with %s dropped", want)
+        }
+    }
+    for _, gone := range []string{`route_key="/old"`, `target="http://old:80"`} {
+        if strings.Contains(out.String(), gone) {
+            t.Errorf("series with %s kept after its route was removed", gone)
+        }
+    }
+
+    // A removed TCP target stays until its last session closes.
+    m.tcpClosed("tcp://old:22", 1, 1)
+    m.retainRoutes([]router.Route{kept})
+    out.Reset()
+    m.writeTo(&out)
+    if strings.Contains(out.String(), `target="tcp://old:22"`) {
+        t.Error("removed TCP target kept after its sessions closed")
+    }
+}
+
+func TestPromLabel(t *testing.T) {
+    tests := []struct{ in, want string }{
+        {"/api", `"/api"`},
+        {`say "hi"`, `"say \"hi\""`},
+        {`C:\logs`, `"C:\\logs"`},
+        {"two\nlines", `"two\nlines"`},
+    }
+    for _, tt := range tests {
+        if got := promLabel(tt.in); got != tt.want {
+            t.Errorf("promLabel(%q) = %s, want %s", tt.in, got, tt.want)
+        }
+    }
+}
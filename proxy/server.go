@@ -0,0 +1,301 @@
+// Package proxy runs the HTTP and TCP listeners a config describes, and
+// reloads, upgrades and administers them.
+package proxy
+
+import (
+    "log"
+    "maps"
+    "net"
+    "slices"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "github.com/SrLiath/ProxSize/config"
+    "github.com/SrLiath/ProxSize/router"
+    "github.com/SrLiath/ProxSize/tcpmux"
+)
+
+// Server owns the running listeners and applies each new config to them.
+type Server struct {
+    configFile string
+    instances  map[int]*serverInstance
+    mux        *serverInstance
+    admin      *serverInstance
+    adminCfg   config.AdminConfig
+    reloadCh   chan struct{}
+    upgradeCh  chan struct{}
+    table      *router.Table
+    tel        *telemetry
+    status     *serverStatus
+    // draining tracks stopped listeners still finishing their requests.
+    draining   sync.WaitGroup
+    // mu serializes Apply and Stop, which the Run loop, the Admin API and
+    // library callers can all reach.
+    mu         sync.Mutex
+}
+
+// NewServer creates a Server for the config file at configFile. Nothing is
+// started until Run or Reload.
+func NewServer(configFile string) *Server {
+    return &Server{
+        configFile: configFile,
+        instances:  make(map[int]*serverInstance),
+        reloadCh:   make(chan struct{}, 1),
+        upgradeCh:  make(chan struct{}, 1),
+        tel:        newTelemetry(),
+        status:     &serverStatus{},
+    }
+}
+
+// Run serves the config file, reloading it on RequestReload, and hands the
+// listeners to a new process on RequestUpgrade. It returns once the new
+// process has taken over and the connections here have drained.
+func (p *Server) Run() {
+    inheritListeners()
+    p.RequestReload()
+    for {
+        select {
+        case <-p.reloadCh:
+            log.Println("🔄 Reloading configuration...")
+            if err := p.Reload(); err != nil {
+                log.Printf("❌ Config rejected, keeping the last good configuration:\n%v", err)
+                continue
+            }
+            signalReady()
+        case <-p.upgradeCh:
+            if err := upgrade(p.running()); err != nil {
+                log.Printf("❌ Upgrade failed, still serving: %v", err)
+                continue
+            }
+            log.Println("👋 New process is serving, draining connections before exit")
+            p.Stop()
+            return
+        }
+    }
+}
+
+// RequestReload makes Run reload the config file. Requests made while one is
+// pending are merged into it.
+func (p *Server) RequestReload() {
+    select {
+    case p.reloadCh <- struct{}{}:
+    default:
+    }
+}
+
+// RequestUpgrade makes Run hand its listeners to a new copy of the
+// executable, as SIGUSR2 does for proxserver.
+func (p *Server) RequestUpgrade() {
+    select {
+    case p.upgradeCh <- struct{}{}:
+    default:
+    }
+}
+
+// Reload loads the config file and applies it. A config that fails to load
+// leaves everything running as it was.
+func (p *Server) Reload() error {
+    rules, allowedPorts, err := config.Load(p.configFile)
+    if err != nil {
+        p.tel.metrics.reloadFailed()
+        p.status.rejected(err)
+        return err
+    }
+    p.tel.metrics.reloaded()
+    p.Apply(rules, allowedPorts)
+    return nil
+}
+
+// Apply starts, updates and stops listeners to match rules.
+func (p *Server) Apply(rules config.Rules, allowedPorts []int) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    trusted, err := config.ParseCIDRs(rules.TrustedProxies)
+    if err != nil {
+        log.Printf("⚠️ trusted_proxies: %v", err)
+    }
+    p.tel.configureAccessLog(rules.AccessLog)
+    p.tel.configureTracing(rules.Tracing)
+    table := router.Build(rules, p.table)
+    timeouts := config.DefaultTimeouts.Merge(rules.Timeouts)
+    listenerConfig := func(port int) config.ListenerConfig {
+        lc := rules.Listeners[port]
+        effective := timeouts.Merge(lc.Timeouts)
+        lc.Timeouts = &effective
+        return lc
+    }
+    addr := func(port int) string {
+        return net.JoinHostPort(rules.Bind, strconv.Itoa(port))
+    }
+
+    if p.mux != nil && (len(table.TCP) == 0 || p.mux.addr != addr(rules.TCPPort)) {
+        p.stopServer(p.mux)
+        p.mux = nil
+    }
+    if len(table.TCP) > 0 {
+        routing := tcpmux.NewRouting(rules.TCPPort, table, listenerConfig(rules.TCPPort))
+        if p.mux != nil {
+            p.mux.tcp.Update(routing)
+            log.Printf("🔀 TCP server on %s now routes %d subdomains", p.mux.listener.Addr(), len(table.TCP))
+        } else {
+            p.mux = p.startTCPServer(addr(rules.TCPPort), rules.TCPPort, routing)
+        }
+    }
+
+    for _, port := range allowedPorts {
+        routes := table.Routes(port)
+        inst, running := p.instances[port]
+        if len(routes) == 0 {
+            if running {
+                p.stopServer(inst)
+                delete(p.instances, port)
+            }
+            continue
+        }
+        lc := listenerConfig(port)
+        routing, err := NewRouting(port, table, lc, trusted)
+        if err != nil {
+            log.Printf("❌ Port %d: %v", port, err)
+            if running {
+                log.Printf("⚠️ Keeping the previous configuration on port %d", port)
+            }
+            continue
+        }
+        if running && inst.addr == addr(port) && inst.binding == httpBinding(lc) {
+            inst.handler.Update(routing)
+            log.Printf("🔀 Port %d now has %d routes", port, len(routes))
+            continue
+        }
+        if running {
+            p.stopServer(inst)
+            delete(p.instances, port)
+        }
+        if inst := p.startServer(addr(port), port, routing, lc); inst != nil {
+            p.instances[port] = inst
+        }
+    }
+    table.Prune()
+    p.table = table
+
+    for port, inst := range p.instances {
+        if !slices.Contains(allowedPorts, port) {
+            p.stopServer(inst)
+            delete(p.instances, port)
+        }
+    }
+
+    p.tel.metrics.retainRoutes(table.All())
+
+    var newAdminCfg config.AdminConfig
+    if rules.Admin != nil {
+        newAdminCfg = *rules.Admin
+    }
+    if newAdminCfg != p.adminCfg {
+        if p.admin != nil {
+            p.stopServer(p.admin)
+            p.admin = nil
+        }
+        if newAdminCfg.Listen != "" {
+            p.admin = p.startAdminServer(newAdminCfg)
+        }
+        p.adminCfg = newAdminCfg
+    }
+
+    var running []int
+    addrs := map[string]string{}
+    for port, inst := range p.instances {
+        running = append(running, port)
+        addrs[strconv.Itoa(port)] = inst.listener.Addr().String()
+    }
+    if p.mux != nil {
+        running = append(running, p.mux.port)
+        addrs["tcp"] = p.mux.listener.Addr().String()
+    }
+    if p.admin != nil {
+        addrs["admin"] = p.admin.listener.Addr().String()
+    }
+    p.status.update(running, addrs, rules)
+}
+
+// Addrs returns the address each running listener is bound to, keyed by its
+// port in allowed_ports, "tcp" for the multiplexer and "admin" for the admin
+// server. For port 0 it's the port the system picked.
+func (p *Server) Addrs() map[string]string {
+    p.status.mu.Lock()
+    defer p.status.mu.Unlock()
+    return maps.Clone(p.status.addrs)
+}
+
+// running lists every server, including the admin listener.
+func (p *Server) running() []*serverInstance {
+    var running []*serverInstance
+    if p.admin != nil {
+        running = append(running, p.admin)
+    }
+    if p.mux != nil {
+        running = append(running, p.mux)
+    }
+    for _, inst := range p.instances {
+        running = append(running, inst)
+    }
+    return running
+}
+
+// Stop closes every listener and waits for in-flight requests and TCP
+// sessions to drain.
+func (p *Server) Stop() {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    for _, inst := range p.running() {
+        p.stopServer(inst)
+    }
+    p.instances = make(map[int]*serverInstance)
+    p.mux = nil
+    p.admin = nil
+    p.adminCfg = config.AdminConfig{}
+    p.draining.Wait()
+}
+
+// startTCPServer runs the TCP multiplexer on addr.
+func (p *Server) startTCPServer(addr string, port int, routing *tcpmux.Routing) *serverInstance {
+    ln, err := listen(addr)
+    if err != nil {
+        log.Printf("❌ Error starting TCP server on %s: %v", addr, err)
+        return nil
+    }
+    return &serverInstance{port: port, addr: addr, listener: ln, tcp: tcpmux.Serve(ln, port, routing, tcpObserver{p.tel})}
+}
+
+// telemetry is where a Server's listeners report to: the metrics on
+// /metrics, the access log and the trace exporter. The last two are swapped
+// as the config changes.
+type telemetry struct {
+    metrics   *proxMetrics
+    accessLog atomic.Pointer[accessLogger]
+    tracer    atomic.Pointer[otlpTracer]
+}
+
+func newTelemetry() *telemetry {
+    return &telemetry{metrics: newMetrics()}
+}
+
+// tcpObserver reports TCP sessions to the metrics and the access log.
+type tcpObserver struct {
+    tel *telemetry
+}
+
+func (o tcpObserver) Dialed(target string, ok bool) {
+    o.tel.metrics.backendResult(target, ok)
+}
+
+func (o tcpObserver) Opened(target string) {
+    o.tel.metrics.tcpOpened(target)
+}
+
+func (o tcpObserver) Closed(target string, in, out int64) {
+    o.tel.metrics.tcpClosed(target, in, out)
+}
+
+func (o tcpObserver) Finished(s tcpmux.Session) {
+    o.tel.logTCPSession(s)
+}
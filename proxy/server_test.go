@@ -0,0 +1,604 @@
+package proxy_test
+
+import (
+    "bufio"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/json"
+    "encoding/pem"
+    "fmt"
+    "io"
+    "math/big"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "strings"
+    "testing"
+    "time"
+    "github.com/SrLiath/ProxSize/proxy"
+    "path/filepath"
+)
+
+// backend answers every request with its name and the path it received.
+func backend(t *testing.T, name string) *httptest.Server {
+    t.Helper()
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprintf(w, "%s %s", name, r.URL.Path)
+    }))
+    t.Cleanup(srv.Close)
+    return srv
+}
+
+// echoBackend is a raw TCP server that writes back whatever it reads.
+func echoBackend(t *testing.T) string {
+    t.Helper()
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { ln.Close() })
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                defer conn.Close()
+                io.Copy(conn, conn)
+            }()
+        }
+    }()
+    return ln.Addr().String()
+}
+
+// closedAddr returns an address nothing listens on.
+func closedAddr(t *testing.T) string {
+    t.Helper()
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    addr := ln.Addr().String()
+    ln.Close()
+    return addr
+}
+
+func writeConfig(t *testing.T, file string, cfg map[string]any) {
+    t.Helper()
+    data, err := json.Marshal(cfg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(file, data, 0o644); err != nil {
+        t.Fatal(err)
+    }
+}
+
+// startProxy serves cfg from a temporary proxies.json on free ports of the
+// loopback interface.
+func startProxy(t *testing.T, cfg map[string]any) (*proxy.Server, string) {
+    t.Helper()
+    cfg["bind"] = "127.0.0.1"
+    cfg["tcp_port"] = 0
+    cfg["allowed_ports"] = []int{0}
+    file := filepath.Join(t.TempDir(), "proxies.json")
+    writeConfig(t, file, cfg)
+    srv := proxy.NewServer(file)
+    if err := srv.Reload(); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(srv.Stop)
+    return srv, file
+}
+
+var client = &http.Client{
+    Transport: &http.Transport{DisableKeepAlives: true},
+    Timeout:   5 * time.Second,
+}
+
+// get requests path from the proxy listener at addr with the given Host
+// header, and returns the status and body.
+func get(t *testing.T, addr, host, path string) (int, string) {
+    t.Helper()
+    req, err := http.NewRequest("GET", "http://"+addr+path, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    req.Host = host
+    resp, err := client.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    body, _ := io.ReadAll(resp.Body)
+    return resp.StatusCode, string(body)
+}
+
+// tcpRequest sends an HTTP-style preamble naming host to the multiplexer at
+// addr and returns what comes back before the connection goes quiet.
+func tcpRequest(t *testing.T, addr, host string) string {
+    t.Helper()
+    conn, err := net.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    preamble := "GET / HTTP/1.1\r\nHost: " + host + "\r\n\r\n"
+    if _, err := conn.Write([]byte(preamble)); err != nil {
+        t.Fatal(err)
+    }
+    conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+    buf := make([]byte, len(preamble))
+    n, _ := io.ReadFull(bufio.NewReader(conn), buf)
+    return string(buf[:n])
+}
+
+func route(target string) map[string]any {
+    return map[string]any{"target": target}
+}
+
+func TestRouting(t *testing.T) {
+    api, app, site, fallback := backend(t, "api"), backend(t, "app"), backend(t, "site"), backend(t, "fallback")
+    echo := echoBackend(t)
+    srv, _ := startProxy(t, map[string]any{
+        "path": map[string]any{
+            "/api": route(api.URL),
+            "/":    route(fallback.URL),
+        },
+        "subdomain": map[string]any{
+            "app": route(app.URL),
+            "db":  route("tcp://" + echo),
+        },
+        "domain": map[string]any{"example.test": route(site.URL)},
+        "tcp":    map[string]any{"echo": route("tcp://" + echo)},
+    })
+    addrs := srv.Addrs()
+    httpAddr, tcpAddr := addrs["0"], addrs["tcp"]
+    if strings.HasSuffix(httpAddr, ":0") || strings.HasSuffix(tcpAddr, ":0") || httpAddr == "" || tcpAddr == "" {
+        t.Fatalf("Addrs() = %v, want bound ports for the listener and the multiplexer", addrs)
+    }
+
+    tests := []struct {
+        name, host, path string
+        status           int
+        body             string
+    }{
+        {"path prefix is trimmed", "localhost", "/api/users", 200, "api /users"},
+        {"catch-all path", "localhost", "/other", 200, "fallback /other"},
+        {"subdomain", "app.example.com", "/x", 200, "app /x"},
+        {"subdomain ignores port in Host", "app.example.com:8080", "/x", 200, "app /x"},
+        {"domain before path", "example.test", "/api/users", 200, "site /api/users"},
+        {"domain is matched whole", "www.example.test", "/y", 200, "fallback /y"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            status, body := get(t, httpAddr, tt.host, tt.path)
+            if status != tt.status || body != tt.body {
+                t.Errorf("GET %s%s = %d %q, want %d %q", tt.host, tt.path, status, body, tt.status, tt.body)
+            }
+        })
+    }
+
+    for _, host := range []string{"echo.example.com", "db.example.com"} {
+        t.Run("tcp "+host, func(t *testing.T) {
+            want := "GET / HTTP/1.1\r\nHost: " + host + "\r\n\r\n"
+            if got := tcpRequest(t, tcpAddr, host); got != want {
+                t.Errorf("echo through the multiplexer = %q, want %q", got, want)
+            }
+        })
+    }
+}
+
+func TestRoutingErrors(t *testing.T) {
+    app := backend(t, "app")
+    srv, _ := startProxy(t, map[string]any{
+        "subdomain": map[string]any{
+            "app":  route(app.URL),
+            "down": route("http://" + closedAddr(t)),
+            "private": map[string]any{"target": app.URL, "deny": []string{"127.0.0.1"}},
+        },
+        "tcp": map[string]any{"gone": route("tcp://" + closedAddr(t))},
+    })
+    addrs := srv.Addrs()
+
+    tests := []struct {
+        name, host string
+        status     int
+    }{
+        {"no rule", "other.example.com", http.StatusNotFound},
+        {"backend down", "down.example.com", http.StatusBadGateway},
+        {"client denied", "private.example.com", http.StatusForbidden},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if status, _ := get(t, addrs["0"], tt.host, "/"); status != tt.status {
+                t.Errorf("GET %s = %d, want %d", tt.host, status, tt.status)
+            }
+        })
+    }
+
+    for _, host := range []string{"nothing.example.com", "gone.example.com"} {
+        t.Run("tcp "+host, func(t *testing.T) {
+            if got := tcpRequest(t, addrs["tcp"], host); got != "" {
+                t.Errorf("multiplexer answered %q, want the connection closed", got)
+            }
+        })
+    }
+}
+
+func TestReload(t *testing.T) {
+    one, two := backend(t, "one"), backend(t, "two")
+    echo := echoBackend(t)
+    cfg := map[string]any{
+        "path": map[string]any{"/": route(one.URL)},
+        "tcp":  map[string]any{"echo": route("tcp://" + echo)},
+    }
+    srv, file := startProxy(t, cfg)
+    before := srv.Addrs()
+
+    // A changed target is swapped in on the same listener.
+    cfg["path"] = map[string]any{"/": route(two.URL)}
+    writeConfig(t, file, cfg)
+    if err := srv.Reload(); err != nil {
+        t.Fatal(err)
+    }
+    after := srv.Addrs()
+    if after["0"] != before["0"] || after["tcp"] != before["tcp"] {
+        t.Errorf("listeners moved on reload: %v -> %v", before, after)
+    }
+    if _, body := get(t, after["0"], "localhost", "/a"); body != "two /a" {
+        t.Errorf("after reload got %q, want the new target", body)
+    }
+
+    // A broken config is rejected and the last good one keeps serving.
+    cfg["path"] = map[string]any{"no-slash": route(one.URL)}
+    writeConfig(t, file, cfg)
+    if err := srv.Reload(); err == nil || !strings.Contains(err.Error(), "must start with /") {
+        t.Errorf("Reload() = %v, want the path key rejected", err)
+    }
+    if _, body := get(t, after["0"], "localhost", "/b"); body != "two /b" {
+        t.Errorf("after a rejected reload got %q, want the previous config", body)
+    }
+
+    // Listeners without rules are stopped.
+    delete(cfg, "path")
+    delete(cfg, "tcp")
+    writeConfig(t, file, cfg)
+    if err := srv.Reload(); err != nil {
+        t.Fatal(err)
+    }
+    if addrs := srv.Addrs(); len(addrs) != 0 {
+        t.Errorf("Addrs() = %v after removing every rule, want none", addrs)
+    }
+    if _, err := net.DialTimeout("tcp", after["0"], time.Second); err == nil {
+        t.Errorf("%s still accepts connections", after["0"])
+    }
+}
+
+func TestReloadMissingFile(t *testing.T) {
+    srv := proxy.NewServer(filepath.Join(t.TempDir(), "missing.json"))
+    t.Cleanup(srv.Stop)
+    if err := srv.Reload(); err == nil {
+        t.Error("Reload() of a missing file succeeded")
+    }
+}
+
+// writeCert creates a certificate for cn signed by ca, or self-signed as a CA
+// when ca is nil, and writes it and its key as PEM files in dir.
+func writeCert(t *testing.T, dir, cn string, ca *tls.Certificate) (tls.Certificate, string, string) {
+    t.Helper()
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    tmpl := &x509.Certificate{
+        SerialNumber: big.NewInt(time.Now().UnixNano()),
+        Subject:      pkix.Name{CommonName: cn},
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().Add(time.Hour),
+        KeyUsage:     x509.KeyUsageDigitalSignature,
+        ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+        DNSNames:     []string{cn},
+    }
+    parent, signer := tmpl, any(key)
+    if ca == nil {
+        tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+        tmpl.KeyUsage |= x509.KeyUsageCertSign
+    } else {
+        parent, signer = ca.Leaf, ca.PrivateKey
+    }
+    der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+    if err != nil {
+        t.Fatal(err)
+    }
+    keyDER, err := x509.MarshalECPrivateKey(key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    certFile, keyFile := filepath.Join(dir, cn+".pem"), filepath.Join(dir, cn+"-key.pem")
+    os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+    os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+    cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return cert, certFile, keyFile
+}
+
+func TestTLSListener(t *testing.T) {
+    dir := t.TempDir()
+    ca, caFile, _ := writeCert(t, dir, "ca", nil)
+    _, certFile, keyFile := writeCert(t, dir, "proxy.test", &ca)
+    alice, _, _ := writeCert(t, dir, "alice", &ca)
+    app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprintf(w, "subject=%s", r.Header.Get("X-Client-Cert-Subject"))
+    }))
+    t.Cleanup(app.Close)
+
+    srv, _ := startProxy(t, map[string]any{
+        "subdomain": map[string]any{
+            "open":   route(app.URL),
+            "secure": map[string]any{"target": app.URL, "client_cert": map[string]any{"ca_file": caFile}},
+        },
+        "listeners": map[string]any{"0": map[string]any{"tls": map[string]any{"cert_file": certFile, "key_file": keyFile}}},
+    })
+    roots := x509.NewCertPool()
+    roots.AddCert(ca.Leaf)
+
+    tests := []struct {
+        name, host string
+        certs      []tls.Certificate
+        status     int
+        body       string
+    }{
+        {"no client certificate needed", "open.proxy.test", nil, 200, "subject="},
+        {"client certificate", "secure.proxy.test", []tls.Certificate{alice}, 200, "subject=CN=alice"},
+        {"client certificate missing", "secure.proxy.test", nil, http.StatusForbidden, "Forbidden\n"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            c := &http.Client{Transport: &http.Transport{
+                DisableKeepAlives: true,
+                TLSClientConfig:   &tls.Config{RootCAs: roots, ServerName: "proxy.test", Certificates: tt.certs},
+            }}
+            req, _ := http.NewRequest("GET", "https://"+srv.Addrs()["0"]+"/", nil)
+            req.Host = tt.host
+            resp, err := c.Do(req)
+            if err != nil {
+                t.Fatal(err)
+            }
+            defer resp.Body.Close()
+            body, _ := io.ReadAll(resp.Body)
+            if resp.StatusCode != tt.status || string(body) != tt.body {
+                t.Errorf("GET https://%s/ = %d %q, want %d %q", tt.host, resp.StatusCode, body, tt.status, tt.body)
+            }
+        })
+    }
+}
+
+func TestRateLimit(t *testing.T) {
+    app := backend(t, "app")
+    srv, _ := startProxy(t, map[string]any{
+        "subdomain": map[string]any{
+            "app": map[string]any{"target": app.URL, "rate_limit": map[string]any{"rate": 0.01, "burst": 2}},
+        },
+    })
+    var statuses []int
+    for i := 0; i < 3; i++ {
+        status, _ := get(t, srv.Addrs()["0"], "app.example.com", "/")
+        statuses = append(statuses, status)
+    }
+    if fmt.Sprint(statuses) != "[200 200 429]" {
+        t.Errorf("statuses = %v, want the burst of 2 and then 429", statuses)
+    }
+
+    // The bucket survives a reload that leaves the limit as it was.
+    if err := srv.Reload(); err != nil {
+        t.Fatal(err)
+    }
+    if status, _ := get(t, srv.Addrs()["0"], "app.example.com", "/"); status != http.StatusTooManyRequests {
+        t.Errorf("status after reload = %d, want 429", status)
+    }
+}
+
+func TestConnectionLimit(t *testing.T) {
+    release := make(chan struct{})
+    entered := make(chan struct{}, 1)
+    slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        entered <- struct{}{}
+        <-release
+    }))
+    t.Cleanup(slow.Close)
+    t.Cleanup(func() { close(release) })
+
+    tests := []struct {
+        name string
+        cfg  map[string]any
+    }{
+        {"backend", map[string]any{"subdomain": map[string]any{"app": map[string]any{"target": slow.URL, "max_connections": 1}}}},
+        {"listener", map[string]any{
+            "subdomain": map[string]any{"app": route(slow.URL)},
+            "listeners": map[string]any{"0": map[string]any{"max_connections": 1}},
+        }},
+        {"global", map[string]any{
+            "subdomain": map[string]any{"app": route(slow.URL)},
+            "limits":    map[string]any{"max_connections": 1},
+        }},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            srv, _ := startProxy(t, tt.cfg)
+            addr := srv.Addrs()["0"]
+            done := make(chan int)
+            go func() {
+                req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+                req.Host = "app.example.com"
+                resp, err := client.Do(req)
+                if err != nil {
+                    done <- 0
+                    return
+                }
+                resp.Body.Close()
+                done <- resp.StatusCode
+            }()
+            <-entered
+            if status, _ := get(t, addr, "app.example.com", "/"); status != http.StatusServiceUnavailable {
+                t.Errorf("second request = %d, want 503", status)
+            }
+            release <- struct{}{}
+            if status := <-done; status != http.StatusOK {
+                t.Errorf("first request = %d, want 200", status)
+            }
+        })
+    }
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+    app := backend(t, "app")
+    srv, _ := startProxy(t, map[string]any{
+        "subdomain": map[string]any{"app": route(app.URL)},
+        "timeouts":  map[string]any{"read_header": "100ms"},
+    })
+    conn, err := net.Dial("tcp", srv.Addrs()["0"])
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    conn.Write([]byte("GET / HTTP/1.1\r\nHost: app.example.com\r\n"))
+    start := time.Now()
+    conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    io.Copy(io.Discard, conn)
+    if elapsed := time.Since(start); elapsed > 2*time.Second {
+        t.Errorf("slow client kept for %s, want it cut off after read_header", elapsed)
+    }
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+    app := backend(t, "app")
+    srv, _ := startProxy(t, map[string]any{
+        "subdomain": map[string]any{
+            "app":  route(app.URL),
+            "down": route("http://" + closedAddr(t)),
+        },
+        "admin": map[string]any{"listen": "127.0.0.1:0"},
+    })
+    get(t, srv.Addrs()["0"], "app.example.com", "/")
+    get(t, srv.Addrs()["0"], "down.example.com", "/")
+
+    status, body := get(t, srv.Addrs()["admin"], "localhost", "/metrics")
+    if status != http.StatusOK {
+        t.Fatalf("GET /metrics = %d", status)
+    }
+    for _, want := range []string{
+        `proxsize_http_requests_total{route_type="subdomain",route_key="app",status="200"} 1`,
+        `proxsize_http_requests_total{route_type="subdomain",route_key="down",status="502"} 1`,
+        `proxsize_backend_up{target="` + app.URL + `"} 1`,
+        `proxsize_config_reloads_total 1`,
+    } {
+        if !strings.Contains(body, want+"\n") {
+            t.Errorf("/metrics missing %s", want)
+        }
+    }
+
+    // Each Server counts only its own traffic.
+    other, _ := startProxy(t, map[string]any{"admin": map[string]any{"listen": "127.0.0.1:0"}})
+    if _, body := get(t, other.Addrs()["admin"], "localhost", "/metrics"); strings.Contains(body, "proxsize_http_requests_total{") {
+        t.Error("second server reports the first one's requests")
+    }
+}
+
+func TestReloadDrain(t *testing.T) {
+    release := make(chan struct{})
+    entered := make(chan struct{}, 1)
+    slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        entered <- struct{}{}
+        <-release
+        fmt.Fprint(w, "slow")
+    }))
+    t.Cleanup(slow.Close)
+    fast := backend(t, "fast")
+    echo := echoBackend(t)
+
+    tests := []struct {
+        name    string
+        reload  map[string]any
+        stopped bool
+    }{
+        {"routing swapped in place", map[string]any{
+            "subdomain": map[string]any{"app": route(fast.URL)},
+            "tcp":       map[string]any{"echo": route("tcp://" + echo), "other": route("tcp://" + echo)},
+        }, false},
+        {"listeners stopped", map[string]any{}, true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            srv, file := startProxy(t, map[string]any{
+                "subdomain": map[string]any{"app": route(slow.URL)},
+                "tcp":       map[string]any{"echo": route("tcp://" + echo)},
+            })
+            addrs := srv.Addrs()
+            done := make(chan string)
+            go func() {
+                req, _ := http.NewRequest("GET", "http://"+addrs["0"]+"/", nil)
+                req.Host = "app.example.com"
+                resp, err := client.Do(req)
+                if err != nil {
+                    done <- err.Error()
+                    return
+                }
+                body, _ := io.ReadAll(resp.Body)
+                resp.Body.Close()
+                done <- string(body)
+            }()
+            <-entered
+            session, err := net.Dial("tcp", addrs["tcp"])
+            if err != nil {
+                t.Fatal(err)
+            }
+            defer session.Close()
+            preamble := "GET / HTTP/1.1\r\nHost: echo.example.com\r\n\r\n"
+            session.Write([]byte(preamble))
+            session.SetReadDeadline(time.Now().Add(5 * time.Second))
+            if _, err := io.ReadFull(session, make([]byte, len(preamble))); err != nil {
+                t.Fatal(err)
+            }
+
+            cfg := tt.reload
+            cfg["bind"], cfg["tcp_port"], cfg["allowed_ports"] = "127.0.0.1", 0, []int{0}
+            writeConfig(t, file, cfg)
+            if err := srv.Reload(); err != nil {
+                t.Fatal(err)
+            }
+
+            if tt.stopped {
+                if _, err := net.DialTimeout("tcp", addrs["0"], time.Second); err == nil {
+                    t.Error("stopped listener still accepts connections")
+                }
+            } else {
+                if _, body := get(t, addrs["0"], "app.example.com", "/"); body != "fast /" {
+                    t.Errorf("new request after reload = %q, want the new target", body)
+                }
+                if got := tcpRequest(t, addrs["tcp"], "other.example.com"); !strings.Contains(got, "other.example.com") {
+                    t.Errorf("new tcp rule after reload echoed %q", got)
+                }
+            }
+
+            // What was in flight before the reload finishes on the old routing.
+            session.Write([]byte("ping"))
+            buf := make([]byte, 4)
+            if _, err := io.ReadFull(session, buf); err != nil || string(buf) != "ping" {
+                t.Errorf("open TCP session after reload read %q, %v", buf, err)
+            }
+            release <- struct{}{}
+            if body := <-done; body != "slow" {
+                t.Errorf("in-flight request = %q, want it answered by the old target", body)
+            }
+        })
+    }
+}
@@ -0,0 +1,350 @@
+package proxy
+
+import (
+    "bytes"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    mathrand "math/rand"
+    "net"
+    "net/http"
+    "reflect"
+    "strings"
+    "sync/atomic"
+    "time"
+    "github.com/SrLiath/ProxSize/config"
+    "github.com/SrLiath/ProxSize/router"
+)
+
+const (
+    spanKindInternal = 1
+    spanKindServer   = 2
+    spanKindClient   = 3
+)
+
+type spanContextKey struct{}
+
+// span is a minimal OpenTelemetry span. Methods are safe on a nil span so
+// call sites don't need to check whether tracing is enabled.
+type span struct {
+    tracer   *otlpTracer
+    traceID  [16]byte
+    spanID   [8]byte
+    parentID [8]byte
+    sampled  bool
+    state    string
+    name     string
+    kind     int
+    start    time.Time
+    attrs    map[string]any
+    errMsg   string
+    ended    atomic.Bool
+}
+
+type otlpTracer struct {
+    cfg      config.TracingConfig
+    endpoint string
+    ratio    float64
+    queue    chan *otlpSpan
+    stop     chan struct{}
+    done     chan struct{}
+}
+
+// configureTracing starts an exporter for cfg, replacing (and flushing) the
+// previous one when the settings changed.
+func (tel *telemetry) configureTracing(cfg *config.TracingConfig) {
+    old := tel.tracer.Load()
+    if cfg == nil || cfg.OTLPEndpoint == "" {
+        tel.tracer.Store(nil)
+        if old != nil {
+            old.shutdown()
+        }
+        return
+    }
+    if old != nil && reflect.DeepEqual(old.cfg, *cfg) {
+        return
+    }
+
+    t := &otlpTracer{
+        cfg:      *cfg,
+        endpoint: strings.TrimSuffix(cfg.OTLPEndpoint, "/") + "/v1/traces",
+        ratio:    1,
+        queue:    make(chan *otlpSpan, 2048),
+        stop:     make(chan struct{}),
+        done:     make(chan struct{}),
+    }
+    if cfg.SampleRatio != nil {
+        t.ratio = *cfg.SampleRatio
+    }
+    if t.cfg.ServiceName == "" {
+        t.cfg.ServiceName = "proxsize"
+    }
+    go t.run()
+    tel.tracer.Store(t)
+    log.Printf("🔭 Exporting traces to %s", t.endpoint)
+    if old != nil {
+        old.shutdown()
+    }
+}
+
+// startServerSpan continues the trace from an incoming traceparent header,
+// or starts a new one subject to the sample ratio.
+func (tel *telemetry) startServerSpan(r *http.Request, host string, client net.IP) *span {
+    t := tel.tracer.Load()
+    if t == nil {
+        return nil
+    }
+    s := &span{tracer: t, name: r.Method, kind: spanKindServer, start: time.Now(), attrs: map[string]any{}}
+    if traceID, parentID, flags, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+        s.traceID, s.parentID = traceID, parentID
+        s.sampled = flags&1 == 1
+        s.state = r.Header.Get("tracestate")
+    } else {
+        rand.Read(s.traceID[:])
+        s.sampled = mathrand.Float64() < t.ratio
+    }
+    rand.Read(s.spanID[:])
+    s.setAttr("http.request.method", r.Method)
+    s.setAttr("url.path", r.URL.Path)
+    s.setAttr("server.address", host)
+    s.setAttr("client.address", client.String())
+    if id := requestID(r); id != "" {
+        s.setAttr("http.request.header.x-request-id", id)
+    }
+    return s
+}
+
+func (s *span) child(name string, kind int) *span {
+    if s == nil {
+        return nil
+    }
+    c := &span{
+        tracer:   s.tracer,
+        traceID:  s.traceID,
+        parentID: s.spanID,
+        sampled:  s.sampled,
+        state:    s.state,
+        name:     name,
+        kind:     kind,
+        start:    time.Now(),
+        attrs:    map[string]any{},
+    }
+    rand.Read(c.spanID[:])
+    return c
+}
+
+func (s *span) setAttr(key string, value any) {
+    if s != nil {
+        s.attrs[key] = value
+    }
+}
+
+func (s *span) fail(msg string) {
+    if s != nil {
+        s.errMsg = msg
+    }
+}
+
+// inject writes the span's context into outgoing headers.
+func (s *span) inject(h http.Header) {
+    if s == nil {
+        return
+    }
+    flags := "00"
+    if s.sampled {
+        flags = "01"
+    }
+    h.Set("traceparent", fmt.Sprintf("00-%x-%x-%s", s.traceID, s.spanID, flags))
+    if s.state != "" {
+        h.Set("tracestate", s.state)
+    }
+}
+
+func (s *span) end() {
+    if s == nil || !s.ended.CompareAndSwap(false, true) || !s.sampled {
+        return
+    }
+    s.tracer.export(s, time.Now())
+}
+
+func (s *span) finishHTTP(route *router.Route, status int) {
+    if s == nil {
+        return
+    }
+    if status == 0 {
+        status = http.StatusOK
+    }
+    if route != nil {
+        s.name = fmt.Sprintf("%s %s %s", s.attrs["http.request.method"], route.Type, route.Key)
+        s.setAttr("proxsize.route.type", route.Type)
+        s.setAttr("proxsize.route.key", route.Key)
+        s.setAttr("proxsize.target", route.Target)
+    }
+    s.setAttr("http.response.status_code", status)
+    if status >= 500 {
+        s.fail(http.StatusText(status))
+    }
+    s.end()
+}
+
+func parseTraceparent(h string) (traceID [16]byte, spanID [8]byte, flags byte, ok bool) {
+    parts := strings.Split(strings.TrimSpace(h), "-")
+    if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+        return traceID, spanID, 0, false
+    }
+    if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+        return traceID, spanID, 0, false
+    }
+    if _, err := hex.Decode(spanID[:], []byte(parts[2])); err != nil || spanID == [8]byte{} {
+        return traceID, spanID, 0, false
+    }
+    var f [1]byte
+    if _, err := hex.Decode(f[:], []byte(parts[3])); err != nil {
+        return traceID, spanID, 0, false
+    }
+    return traceID, spanID, f[0], true
+}
+
+type otlpSpan struct {
+    TraceID           string         `json:"traceId"`
+    SpanID            string         `json:"spanId"`
+    ParentSpanID      string         `json:"parentSpanId,omitempty"`
+    TraceState        string         `json:"traceState,omitempty"`
+    Name              string         `json:"name"`
+    Kind              int            `json:"kind"`
+    StartTimeUnixNano string         `json:"startTimeUnixNano"`
+    EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+    Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+    Status            otlpStatus     `json:"status"`
+}
+
+type otlpKeyValue struct {
+    Key   string         `json:"key"`
+    Value map[string]any `json:"value"`
+}
+
+type otlpStatus struct {
+    Code    int    `json:"code,omitempty"`
+    Message string `json:"message,omitempty"`
+}
+
+func (t *otlpTracer) export(s *span, end time.Time) {
+    o := &otlpSpan{
+        TraceID:           hex.EncodeToString(s.traceID[:]),
+        SpanID:            hex.EncodeToString(s.spanID[:]),
+        TraceState:        s.state,
+        Name:              s.name,
+        Kind:              s.kind,
+        StartTimeUnixNano: fmt.Sprintf("%d", s.start.UnixNano()),
+        EndTimeUnixNano:   fmt.Sprintf("%d", end.UnixNano()),
+    }
+    if s.parentID != [8]byte{} {
+        o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+    }
+    for _, key := range sortedKeys(s.attrs) {
+        o.Attributes = append(o.Attributes, otlpAttr(key, s.attrs[key]))
+    }
+    if s.errMsg != "" {
+        o.Status = otlpStatus{Code: 2, Message: s.errMsg}
+    }
+    select {
+    case t.queue <- o:
+    default:
+        // Exporter is behind; drop the span rather than slow down requests.
+    }
+}
+
+// run batches queued spans and posts them to the collector every few seconds
+// or once 512 spans are waiting.
+func (t *otlpTracer) run() {
+    defer close(t.done)
+    ticker := time.NewTicker(5 * time.Second)
+    defer ticker.Stop()
+    var batch []*otlpSpan
+    for {
+        select {
+        case o := <-t.queue:
+            batch = append(batch, o)
+            if len(batch) >= 512 {
+                t.post(batch)
+                batch = nil
+            }
+        case <-ticker.C:
+            if len(batch) > 0 {
+                t.post(batch)
+                batch = nil
+            }
+        case <-t.stop:
+            for {
+                select {
+                case o := <-t.queue:
+                    batch = append(batch, o)
+                    continue
+                default:
+                }
+                break
+            }
+            if len(batch) > 0 {
+                t.post(batch)
+            }
+            return
+        }
+    }
+}
+
+func (t *otlpTracer) shutdown() {
+    close(t.stop)
+    <-t.done
+}
+
+func (t *otlpTracer) post(spans []*otlpSpan) {
+    payload := map[string]any{
+        "resourceSpans": []any{map[string]any{
+            "resource": map[string]any{
+                "attributes": []otlpKeyValue{otlpAttr("service.name", t.cfg.ServiceName)},
+            },
+            "scopeSpans": []any{map[string]any{
+                "scope": map[string]any{"name": "proxsize"},
+                "spans": spans,
+            }},
+        }},
+    }
+    body, err := json.Marshal(payload)
+    if err != nil {
+        return
+    }
+    req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(body))
+    if err != nil {
+        log.Printf("⚠️ Trace export: %v", err)
+        return
+    }
+    req.Header.Set("Content-Type", "application/json")
+    for k, v := range t.cfg.Headers {
+        req.Header.Set(k, v)
+    }
+    client := &http.Client{Timeout: 10 * time.Second}
+    resp, err := client.Do(req)
+    if err != nil {
+        log.Printf("⚠️ Trace export to %s failed: %v", t.endpoint, err)
+        return
+    }
+    io.Copy(io.Discard, resp.Body)
+    resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        log.Printf("⚠️ Trace export to %s failed: %s", t.endpoint, resp.Status)
+    }
+}
+
+func otlpAttr(key string, value any) otlpKeyValue {
+    switch v := value.(type) {
+    case int:
+        return otlpKeyValue{Key: key, Value: map[string]any{"intValue": fmt.Sprintf("%d", v)}}
+    case bool:
+        return otlpKeyValue{Key: key, Value: map[string]any{"boolValue": v}}
+    default:
+        return otlpKeyValue{Key: key, Value: map[string]any{"stringValue": fmt.Sprint(v)}}
+    }
+}
@@ -0,0 +1,196 @@
+package proxy
+
+import (
+    "encoding/hex"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "github.com/SrLiath/ProxSize/config"
+    "github.com/SrLiath/ProxSize/router"
+)
+
+func TestParseTraceparent(t *testing.T) {
+    tests := []struct {
+        name   string
+        header string
+        ok     bool
+        flags  byte
+    }{
+        {"sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, 1},
+        {"not sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, 0},
+        {"future version with extra fields", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, 1},
+        {"invalid version", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, 0},
+        {"zero trace id", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, 0},
+        {"zero span id", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, 0},
+        {"short trace id", "00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01", false, 0},
+        {"not hex", "00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01", false, 0},
+        {"empty", "", false, 0},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            traceID, spanID, flags, ok := parseTraceparent(tt.header)
+            if ok != tt.ok {
+                t.Fatalf("ok = %t, want %t", ok, tt.ok)
+            }
+            if !ok {
+                return
+            }
+            if got := hex.EncodeToString(traceID[:]); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+                t.Errorf("trace id = %s", got)
+            }
+            if got := hex.EncodeToString(spanID[:]); got != "00f067aa0ba902b7" {
+                t.Errorf("span id = %s", got)
+            }
+            if flags != tt.flags {
+                t.Errorf("flags = %d, want %d", flags, tt.flags)
+            }
+        })
+    }
+}
+
+type exportedSpan struct {
+    TraceID      string `json:"traceId"`
+    SpanID       string `json:"spanId"`
+    ParentSpanID string `json:"parentSpanId"`
+    TraceState   string `json:"traceState"`
+    Name         string `json:"name"`
+    Kind         int    `json:"kind"`
+    Status       struct {
+        Code int `json:"code"`
+    } `json:"status"`
+}
+
+type exportRequest struct {
+    ResourceSpans []struct {
+        Resource struct {
+            Attributes []otlpKeyValue `json:"attributes"`
+        } `json:"resource"`
+        ScopeSpans []struct {
+            Spans []exportedSpan `json:"spans"`
+        } `json:"scopeSpans"`
+    } `json:"resourceSpans"`
+}
+
+// traceRequest sends r through a Handler exporting to a test collector, and
+// returns the spans collected and the traceparent the backend received.
+func traceRequest(t *testing.T, cfg config.TracingConfig, r *http.Request) (map[string]exportedSpan, string) {
+    t.Helper()
+    var exports []exportRequest
+    collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path != "/v1/traces" || r.Header.Get("Authorization") != "Bearer collector-key" {
+            t.Errorf("export to %s with Authorization %q", r.URL.Path, r.Header.Get("Authorization"))
+        }
+        var req exportRequest
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            t.Error(err)
+        }
+        exports = append(exports, req)
+    }))
+    defer collector.Close()
+    var traceparent string
+    upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        traceparent = r.Header.Get("traceparent")
+    }))
+    defer upstream.Close()
+
+    routing, err := NewRouting(80, router.Build(config.Rules{Path: map[string]config.RouteEntry{
+        "/app": {Target: upstream.URL},
+    }}, nil), config.ListenerConfig{}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    tel := newTelemetry()
+    cfg.OTLPEndpoint = collector.URL + "/"
+    cfg.Headers = map[string]string{"Authorization": "Bearer collector-key"}
+    tel.configureTracing(&cfg)
+    newHandler(80, routing, tel).ServeHTTP(httptest.NewRecorder(), r)
+    // Turning tracing off flushes the exporter.
+    tel.configureTracing(nil)
+
+    spans := map[string]exportedSpan{}
+    for _, req := range exports {
+        for _, rs := range req.ResourceSpans {
+            if attrs := rs.Resource.Attributes; len(attrs) != 1 || attrs[0].Value["stringValue"] != "proxsize" {
+                t.Errorf("resource attributes = %v, want service.name proxsize", attrs)
+            }
+            for _, ss := range rs.ScopeSpans {
+                for _, s := range ss.Spans {
+                    spans[s.Name] = s
+                }
+            }
+        }
+    }
+    return spans, traceparent
+}
+
+func TestTracing(t *testing.T) {
+    r := httptest.NewRequest("GET", "http://example.com/app/x", nil)
+    r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+    r.Header.Set("tracestate", "vendor=abc")
+    spans, traceparent := traceRequest(t, config.TracingConfig{}, r)
+
+    server, route, upstream := spans["GET path /app"], spans["route"], spans["upstream"]
+    if len(spans) != 3 {
+        t.Fatalf("exported spans %v, want the server, route and upstream spans", spans)
+    }
+    if server.Kind != spanKindServer || route.Kind != spanKindInternal || upstream.Kind != spanKindClient {
+        t.Errorf("span kinds = %d, %d, %d", server.Kind, route.Kind, upstream.Kind)
+    }
+    for _, s := range spans {
+        if s.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || s.TraceState != "vendor=abc" {
+            t.Errorf("span %q in trace %s with state %q, want the incoming trace", s.Name, s.TraceID, s.TraceState)
+        }
+    }
+    if server.ParentSpanID != "00f067aa0ba902b7" || route.ParentSpanID != server.SpanID || upstream.ParentSpanID != server.SpanID {
+        t.Errorf("parents = %s, %s, %s, want the caller's span and then the server span", server.ParentSpanID, route.ParentSpanID, upstream.ParentSpanID)
+    }
+    if want := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + upstream.SpanID + "-01"; traceparent != want {
+        t.Errorf("backend got traceparent %q, want %q", traceparent, want)
+    }
+}
+
+func TestTracingSampling(t *testing.T) {
+    never, always := 0.0, 1.0
+    tests := []struct {
+        name        string
+        ratio       *float64
+        traceparent string
+        exported    bool
+        flags       string
+    }{
+        {"new trace, ratio 0", &never, "", false, "00"},
+        {"new trace, ratio 1", &always, "", true, "01"},
+        {"default ratio", nil, "", true, "01"},
+        {"caller's decision wins over the ratio", &never, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, "01"},
+        {"caller didn't sample", &always, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", false, "00"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := httptest.NewRequest("GET", "http://example.com/app/", nil)
+            if tt.traceparent != "" {
+                r.Header.Set("traceparent", tt.traceparent)
+            }
+            spans, traceparent := traceRequest(t, config.TracingConfig{SampleRatio: tt.ratio}, r)
+            if exported := len(spans) > 0; exported != tt.exported {
+                t.Errorf("exported %d spans, want exported = %t", len(spans), tt.exported)
+            }
+            // Unsampled requests still pass a trace context on.
+            if _, _, flags, ok := parseTraceparent(traceparent); !ok || hex.EncodeToString([]byte{flags}) != tt.flags {
+                t.Errorf("backend got traceparent %q, want flags %s", traceparent, tt.flags)
+            }
+        })
+    }
+}
+
+func TestTracingDisabled(t *testing.T) {
+    tel := newTelemetry()
+    if s := tel.startServerSpan(httptest.NewRequest("GET", "/", nil), "example.com", nil); s != nil {
+        t.Fatalf("span started without tracing configured")
+    }
+    // Every span method is a no-op on nil.
+    var s *span
+    s.child("x", spanKindClient).setAttr("k", "v")
+    s.inject(http.Header{})
+    s.finishHTTP(nil, 200)
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+    "fmt"
+    "log"
+    "net"
+    "os"
+    "os/exec"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// upgradeTimeout bounds how long the old process waits for the new one to
+// start serving before giving up on an upgrade.
+const upgradeTimeout = 30 * time.Second
+
+// upgrade starts a new copy of the executable that inherits every listening
+// socket, and returns once the new process reports that it is serving. The
+// sockets are passed as extra files and named in PROXSIZE_LISTENERS
+// ("addr=fd,..."); the new process writes to PROXSIZE_READY_FD when ready.
+func upgrade(running []*serverInstance) error {
+    exe, err := os.Executable()
+    if err != nil {
+        return err
+    }
+    var files []*os.File
+    defer func() {
+        for _, f := range files {
+            f.Close()
+        }
+    }()
+    var specs []string
+    for _, inst := range running {
+        if inst == nil {
+            continue
+        }
+        tl, ok := inst.listener.(*net.TCPListener)
+        if !ok {
+            continue
+        }
+        f, err := tl.File()
+        if err != nil {
+            return fmt.Errorf("handing over %s: %w", inst.addr, err)
+        }
+        files = append(files, f)
+        specs = append(specs, fmt.Sprintf("%s=%d", inst.addr, 2+len(files)))
+    }
+    ready, readyW, err := os.Pipe()
+    if err != nil {
+        return err
+    }
+    defer ready.Close()
+    files = append(files, readyW)
+
+    cmd := exec.Command(exe, os.Args[1:]...)
+    cmd.Stdout = os.Stdout
+    cmd.Stderr = os.Stderr
+    cmd.ExtraFiles = files
+    cmd.Env = append(os.Environ(),
+        "PROXSIZE_LISTENERS="+strings.Join(specs, ","),
+        fmt.Sprintf("PROXSIZE_READY_FD=%d", 2+len(files)))
+    log.Printf("⬆️ Starting %s with %d inherited listeners", exe, len(specs))
+    if err := cmd.Start(); err != nil {
+        return err
+    }
+    // Close our end of the pipe so a crashing child shows up as EOF.
+    readyW.Close()
+    files = files[:len(files)-1]
+
+    done := make(chan error, 1)
+    go func() {
+        _, err := ready.Read(make([]byte, 1))
+        done <- err
+    }()
+    select {
+    case err := <-done:
+        if err != nil {
+            cmd.Process.Kill()
+            go cmd.Wait()
+            return fmt.Errorf("new process exited before it was ready")
+        }
+    case <-time.After(upgradeTimeout):
+        cmd.Process.Kill()
+        go cmd.Wait()
+        return fmt.Errorf("new process not ready after %s", upgradeTimeout)
+    }
+    log.Printf("⬆️ New process %d is serving", cmd.Process.Pid)
+    cmd.Process.Release()
+    return nil
+}
+
+var inheritedListeners = map[string]net.Listener{}
+
+// inheritListeners picks up the sockets handed over by the old process during
+// an upgrade.
+func inheritListeners() {
+    spec := os.Getenv("PROXSIZE_LISTENERS")
+    os.Unsetenv("PROXSIZE_LISTENERS")
+    for _, item := range strings.Split(spec, ",") {
+        i := strings.LastIndex(item, "=")
+        if i < 0 {
+            continue
+        }
+        addr := item[:i]
+        fd, err := strconv.Atoi(item[i+1:])
+        if err != nil {
+            log.Printf("⚠️ Ignoring inherited listener %q", item)
+            continue
+        }
+        f := os.NewFile(uintptr(fd), addr)
+        ln, err := net.FileListener(f)
+        f.Close()
+        if err != nil {
+            log.Printf("⚠️ Inherited listener %s: %v", addr, err)
+            continue
+        }
+        inheritedListeners[addr] = ln
+    }
+}
+
+// listen reuses a socket inherited during an upgrade when there is one for
+// addr, and binds a new one otherwise.
+func listen(addr string) (net.Listener, error) {
+    if ln, ok := inheritedListeners[addr]; ok {
+        delete(inheritedListeners, addr)
+        log.Printf("♻️ Taking over listener %s", addr)
+        return ln, nil
+    }
+    return net.Listen("tcp", addr)
+}
+
+// signalReady tells the old process of an upgrade that this one is serving.
+// Inherited sockets the config no longer uses are closed.
+func signalReady() {
+    for addr, ln := range inheritedListeners {
+        ln.Close()
+        delete(inheritedListeners, addr)
+    }
+    fd, err := strconv.Atoi(os.Getenv("PROXSIZE_READY_FD"))
+    if err != nil {
+        return
+    }
+    os.Unsetenv("PROXSIZE_READY_FD")
+    f := os.NewFile(uintptr(fd), "ready")
+    f.Write([]byte{1})
+    f.Close()
+}
@@ -0,0 +1,108 @@
+//go:build unix
+
+package proxy
+
+import (
+    "fmt"
+    "net"
+    "os"
+    "strings"
+    "syscall"
+    "testing"
+)
+
+// handOver returns a descriptor for ln the way an old process passes it on,
+// for inheritListeners to take over.
+func handOver(t *testing.T, ln net.Listener) int {
+    t.Helper()
+    f, err := ln.(*net.TCPListener).File()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer f.Close()
+    fd, err := syscall.Dup(int(f.Fd()))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return fd
+}
+
+func TestInheritListeners(t *testing.T) {
+    old, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer old.Close()
+    unused, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer unused.Close()
+    notSocket, err := os.Open(os.DevNull)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer notSocket.Close()
+    devNull, err := syscall.Dup(int(notSocket.Fd()))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    t.Setenv("PROXSIZE_LISTENERS", strings.Join([]string{
+        fmt.Sprintf("127.0.0.1:0=%d", handOver(t, old)),
+        fmt.Sprintf("[::1]:8080=%d", handOver(t, unused)),
+        "no-descriptor",
+        "127.0.0.1:1=abc",
+        fmt.Sprintf("127.0.0.1:2=%d", devNull),
+    }, ","))
+    t.Cleanup(func() { clear(inheritedListeners) })
+    inheritListeners()
+    if _, set := os.LookupEnv("PROXSIZE_LISTENERS"); set {
+        t.Error("PROXSIZE_LISTENERS left for child processes")
+    }
+    if len(inheritedListeners) != 2 {
+        t.Fatalf("inherited %v, want the two sockets", inheritedListeners)
+    }
+
+    // The configured address, port 0 included, picks up the same socket.
+    ln, err := listen("127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ln.Close()
+    if ln.Addr().String() != old.Addr().String() {
+        t.Errorf("listen() = %s, want the inherited %s", ln.Addr(), old.Addr())
+    }
+    again, err := listen("127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer again.Close()
+    if again.Addr().String() == old.Addr().String() {
+        t.Error("inherited socket handed out twice")
+    }
+
+    // Ready closes what the new config didn't use, and tells the old process.
+    r, w, err := os.Pipe()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer r.Close()
+    readyFD, err := syscall.Dup(int(w.Fd()))
+    if err != nil {
+        t.Fatal(err)
+    }
+    w.Close()
+    t.Setenv("PROXSIZE_READY_FD", fmt.Sprint(readyFD))
+    signalReady()
+    if len(inheritedListeners) != 0 {
+        t.Errorf("unused inherited listeners kept: %v", inheritedListeners)
+    }
+    buf := make([]byte, 2)
+    if n, _ := r.Read(buf); n != 1 {
+        t.Errorf("ready pipe got %d bytes, want 1", n)
+    }
+    if n, err := r.Read(buf); n != 0 || err == nil {
+        t.Errorf("ready pipe still open after signalReady: %d, %v", n, err)
+    }
+}
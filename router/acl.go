@@ -0,0 +1,101 @@
+package router
+
+import (
+    "log"
+    "net"
+    "net/http"
+    "strings"
+    "github.com/SrLiath/ProxSize/config"
+)
+
+// ACL is a compiled allow/deny list. Deny entries win; when the allow list
+// is non-empty only matching clients get through. A nil ACL allows all.
+type ACL struct {
+    allow []*net.IPNet
+    deny  []*net.IPNet
+}
+
+// NewACL compiles allow and deny lists. An invalid entry makes the ACL deny
+// everything, so a typo never opens a route up.
+func NewACL(allow, deny []string, owner string) *ACL {
+    if len(allow) == 0 && len(deny) == 0 {
+        return nil
+    }
+    allowNets, err := config.ParseCIDRs(allow)
+    if err == nil {
+        var denyNets []*net.IPNet
+        denyNets, err = config.ParseCIDRs(deny)
+        if err == nil {
+            return &ACL{allow: allowNets, deny: denyNets}
+        }
+    }
+    log.Printf("⚠️ Access list for %s: %v (denying all clients)", owner, err)
+    _, all4, _ := net.ParseCIDR("0.0.0.0/0")
+    _, all6, _ := net.ParseCIDR("::/0")
+    return &ACL{deny: []*net.IPNet{all4, all6}}
+}
+
+// Allows reports whether a client at ip may pass. A nil ip, one that couldn't
+// be parsed, is only allowed by a nil ACL.
+func (a *ACL) Allows(ip net.IP) bool {
+    if a == nil {
+        return true
+    }
+    if ip == nil {
+        return false
+    }
+    if ContainsIP(a.deny, ip) {
+        return false
+    }
+    return len(a.allow) == 0 || ContainsIP(a.allow, ip)
+}
+
+// ContainsIP reports whether ip is in any of nets.
+func ContainsIP(nets []*net.IPNet, ip net.IP) bool {
+    for _, n := range nets {
+        if n.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// RemoteIP returns the IP address of a connection's peer address, or nil if
+// it has none.
+func RemoteIP(addr net.Addr) net.IP {
+    host, _, err := net.SplitHostPort(addr.String())
+    if err != nil {
+        host = addr.String()
+    }
+    return net.ParseIP(host)
+}
+
+// ClientIP returns the address of the real client. X-Forwarded-For is only
+// honoured when the connection comes from a trusted proxy, and is walked from
+// the right so a client can't prepend a forged address.
+func ClientIP(r *http.Request, trusted []*net.IPNet) net.IP {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        host = r.RemoteAddr
+    }
+    ip := net.ParseIP(host)
+    if ip == nil || !ContainsIP(trusted, ip) {
+        return ip
+    }
+
+    var hops []string
+    for _, header := range r.Header.Values("X-Forwarded-For") {
+        hops = append(hops, strings.Split(header, ",")...)
+    }
+    for i := len(hops) - 1; i >= 0; i-- {
+        hop := net.ParseIP(strings.TrimSpace(hops[i]))
+        if hop == nil {
+            break
+        }
+        ip = hop
+        if !ContainsIP(trusted, hop) {
+            break
+        }
+    }
+    return ip
+}
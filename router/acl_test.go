@@ -0,0 +1,79 @@
+package router
+
+import (
+    "net"
+    "net/http/httptest"
+    "testing"
+    "github.com/SrLiath/ProxSize/config"
+)
+
+func TestACL(t *testing.T) {
+    tests := []struct {
+        name        string
+        allow, deny []string
+        ip          string
+        want        bool
+    }{
+        {"no lists", nil, nil, "203.0.113.9", true},
+        {"in allow range", []string{"10.0.0.0/8"}, nil, "10.1.2.3", true},
+        {"outside allow range", []string{"10.0.0.0/8"}, nil, "192.168.1.1", false},
+        {"single allowed IP", []string{"192.168.1.1"}, nil, "192.168.1.1", true},
+        {"deny only", nil, []string{"192.168.1.1"}, "192.168.1.2", true},
+        {"denied IP", nil, []string{"192.168.1.1"}, "192.168.1.1", false},
+        {"deny wins over allow", []string{"10.0.0.0/8"}, []string{"10.0.0.13"}, "10.0.0.13", false},
+        {"IPv6 range", []string{"2001:db8::/32"}, nil, "2001:db8::1", true},
+        {"IPv4-mapped IPv6 client", []string{"10.0.0.0/8"}, nil, "::ffff:10.0.0.1", true},
+        {"unknown client", []string{"10.0.0.0/8"}, nil, "", false},
+        {"invalid entry denies all", []string{"10.0.0.0/8", "10.0.0.300"}, nil, "10.0.0.1", false},
+        {"invalid deny entry denies all", nil, []string{"nope"}, "10.0.0.1", false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            acl := NewACL(tt.allow, tt.deny, "test")
+            if got := acl.Allows(net.ParseIP(tt.ip)); got != tt.want {
+                t.Errorf("Allows(%s) = %t, want %t", tt.ip, got, tt.want)
+            }
+        })
+    }
+}
+
+func TestClientIP(t *testing.T) {
+    trusted, err := config.ParseCIDRs([]string{"10.0.0.0/8", "127.0.0.1"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    tests := []struct {
+        name    string
+        remote  string
+        xff     []string
+        trusted bool
+        want    string
+    }{
+        {"no proxy", "203.0.113.9:5000", nil, true, "203.0.113.9"},
+        {"header from an untrusted client", "203.0.113.9:5000", []string{"198.51.100.1"}, true, "203.0.113.9"},
+        {"header ignored without trusted proxies", "10.0.0.2:5000", []string{"198.51.100.1"}, false, "10.0.0.2"},
+        {"trusted proxy", "10.0.0.2:5000", []string{"198.51.100.1"}, true, "198.51.100.1"},
+        {"chain of trusted proxies", "10.0.0.2:5000", []string{"198.51.100.1, 10.0.0.5, 127.0.0.1"}, true, "198.51.100.1"},
+        {"forged leftmost address", "10.0.0.2:5000", []string{"1.1.1.1, 198.51.100.1"}, true, "198.51.100.1"},
+        {"several headers", "10.0.0.2:5000", []string{"1.1.1.1", "198.51.100.1"}, true, "198.51.100.1"},
+        {"garbage hop stops the walk", "10.0.0.2:5000", []string{"198.51.100.1, junk, 10.0.0.5"}, true, "10.0.0.5"},
+        {"only trusted hops", "10.0.0.2:5000", []string{"10.0.0.5"}, true, "10.0.0.5"},
+        {"IPv6 remote", "[2001:db8::1]:5000", nil, true, "2001:db8::1"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := httptest.NewRequest("GET", "/", nil)
+            r.RemoteAddr = tt.remote
+            for _, v := range tt.xff {
+                r.Header.Add("X-Forwarded-For", v)
+            }
+            nets := trusted
+            if !tt.trusted {
+                nets = nil
+            }
+            if got := ClientIP(r, nets); got.String() != tt.want {
+                t.Errorf("ClientIP() = %s, want %s", got, tt.want)
+            }
+        })
+    }
+}
@@ -0,0 +1,105 @@
+package router
+
+import (
+    "crypto/x509"
+    "errors"
+    "fmt"
+    "net/http"
+    "os"
+    "path"
+    "github.com/SrLiath/ProxSize/config"
+)
+
+// ClientCertPolicy is a route's client certificate requirement: the CA bundle
+// a certificate must chain to and the subjects and SANs it may have.
+type ClientCertPolicy struct {
+    cfg    *config.ClientCertConfig
+    roots  *x509.CertPool
+    header string
+}
+
+// NewClientCertPolicy loads the CA bundle of cfg and checks its patterns.
+func NewClientCertPolicy(cfg *config.ClientCertConfig) (*ClientCertPolicy, error) {
+    data, err := os.ReadFile(cfg.CAFile)
+    if err != nil {
+        return nil, fmt.Errorf("reading CA bundle: %w", err)
+    }
+    roots := x509.NewCertPool()
+    if !roots.AppendCertsFromPEM(data) {
+        return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+    }
+    for _, pattern := range append(append([]string{}, cfg.AllowedSubjects...), cfg.AllowedSANs...) {
+        if _, err := path.Match(pattern, ""); err != nil {
+            return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+        }
+    }
+    header := cfg.IdentityHeader
+    if header == "" {
+        header = "X-Client-Cert-Subject"
+    }
+    return &ClientCertPolicy{cfg: cfg, roots: roots, header: header}, nil
+}
+
+// Authorize verifies the client certificate presented on r against the
+// route's CA bundle and subject/SAN patterns, and passes the verified subject
+// to the backend in the identity header.
+func (p *ClientCertPolicy) Authorize(r *http.Request) error {
+    header := p.header
+    if header == "" {
+        header = "X-Client-Cert-Subject"
+    }
+    r.Header.Del(header)
+
+    if p.roots == nil {
+        return errors.New("client certificate policy not loaded")
+    }
+    if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+        return errors.New("no client certificate")
+    }
+
+    cert := r.TLS.PeerCertificates[0]
+    intermediates := x509.NewCertPool()
+    for _, c := range r.TLS.PeerCertificates[1:] {
+        intermediates.AddCert(c)
+    }
+    _, err := cert.Verify(x509.VerifyOptions{
+        Roots:         p.roots,
+        Intermediates: intermediates,
+        KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+    })
+    if err != nil {
+        return err
+    }
+
+    subject := cert.Subject.String()
+    if len(p.cfg.AllowedSubjects) > 0 || len(p.cfg.AllowedSANs) > 0 {
+        allowed := matchAny(p.cfg.AllowedSubjects, subject, cert.Subject.CommonName)
+
+        var sans []string
+        sans = append(sans, cert.DNSNames...)
+        sans = append(sans, cert.EmailAddresses...)
+        for _, ip := range cert.IPAddresses {
+            sans = append(sans, ip.String())
+        }
+        for _, uri := range cert.URIs {
+            sans = append(sans, uri.String())
+        }
+        if !allowed && !matchAny(p.cfg.AllowedSANs, sans...) {
+            return fmt.Errorf("certificate %q not allowed", subject)
+        }
+    }
+
+    r.Header.Set(header, subject)
+    return nil
+}
+
+func matchAny(patterns []string, values ...string) bool {
+    for _, pattern := range patterns {
+        for _, value := range values {
+            if ok, _ := path.Match(pattern, value); ok {
+                return true
+            }
+        }
+    }
+    return false
+}
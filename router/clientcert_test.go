@@ -0,0 +1,172 @@
+package router
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "math/big"
+    "net"
+    "net/http/httptest"
+    "net/url"
+    "os"
+    "strings"
+    "testing"
+    "time"
+    "github.com/SrLiath/ProxSize/config"
+    "path/filepath"
+)
+
+type testCA struct {
+    cert *x509.Certificate
+    key  *ecdsa.PrivateKey
+}
+
+var serial int64
+
+// issue creates a certificate from tmpl signed by ca, or self-signed when ca
+// is nil.
+func issue(t *testing.T, tmpl *x509.Certificate, ca *testCA) *testCA {
+    t.Helper()
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    serial++
+    tmpl.SerialNumber = big.NewInt(serial)
+    tmpl.NotBefore = time.Now().Add(-time.Hour)
+    tmpl.NotAfter = time.Now().Add(time.Hour)
+    parent, signer := tmpl, key
+    if ca != nil {
+        parent, signer = ca.cert, ca.key
+    }
+    der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cert, err := x509.ParseCertificate(der)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return &testCA{cert: cert, key: key}
+}
+
+func newCA(t *testing.T, name string, parent *testCA) *testCA {
+    return issue(t, &x509.Certificate{
+        Subject:               pkix.Name{CommonName: name},
+        IsCA:                  true,
+        BasicConstraintsValid: true,
+        KeyUsage:              x509.KeyUsageCertSign,
+    }, parent)
+}
+
+func clientCert(t *testing.T, ca *testCA, tmpl x509.Certificate) *x509.Certificate {
+    if tmpl.ExtKeyUsage == nil {
+        tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+    }
+    tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+    return issue(t, &tmpl, ca).cert
+}
+
+func writeCA(t *testing.T, ca *testCA) string {
+    t.Helper()
+    file := filepath.Join(t.TempDir(), "ca.pem")
+    if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    return file
+}
+
+func TestClientCertPolicy(t *testing.T) {
+    ca := newCA(t, "Test CA", nil)
+    intermediate := newCA(t, "Test Intermediate", ca)
+    otherCA := newCA(t, "Other CA", nil)
+    spiffe, _ := url.Parse("spiffe://example.org/billing")
+
+    alice := clientCert(t, ca, x509.Certificate{Subject: pkix.Name{CommonName: "alice", Organization: []string{"Example"}}})
+    web := clientCert(t, ca, x509.Certificate{Subject: pkix.Name{CommonName: "web"}, DNSNames: []string{"web.internal.example.com"}})
+    mailer := clientCert(t, ca, x509.Certificate{Subject: pkix.Name{CommonName: "mailer"}, EmailAddresses: []string{"ops@example.com"}})
+    billing := clientCert(t, ca, x509.Certificate{Subject: pkix.Name{CommonName: "billing"}, URIs: []*url.URL{spiffe}})
+    host := clientCert(t, ca, x509.Certificate{Subject: pkix.Name{CommonName: "host"}, IPAddresses: []net.IP{net.ParseIP("10.0.0.7")}})
+    chained := clientCert(t, intermediate, x509.Certificate{Subject: pkix.Name{CommonName: "chained"}})
+    server := clientCert(t, ca, x509.Certificate{Subject: pkix.Name{CommonName: "server"}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+    stranger := clientCert(t, otherCA, x509.Certificate{Subject: pkix.Name{CommonName: "alice"}})
+
+    tests := []struct {
+        name     string
+        subjects []string
+        sans     []string
+        chain    []*x509.Certificate
+        wantErr  string
+    }{
+        {"any cert from the CA", nil, nil, []*x509.Certificate{alice}, ""},
+        {"subject by common name", []string{"alice"}, nil, []*x509.Certificate{alice}, ""},
+        {"full subject", []string{"CN=alice,O=Example"}, nil, []*x509.Certificate{alice}, ""},
+        {"subject pattern", []string{"CN=*,O=Example"}, nil, []*x509.Certificate{alice}, ""},
+        {"subject not allowed", []string{"bob"}, nil, []*x509.Certificate{alice}, "not allowed"},
+        {"DNS SAN pattern", nil, []string{"*.internal.example.com"}, []*x509.Certificate{web}, ""},
+        {"email SAN", nil, []string{"ops@example.com"}, []*x509.Certificate{mailer}, ""},
+        {"URI SAN", nil, []string{"spiffe://example.org/*"}, []*x509.Certificate{billing}, ""},
+        {"IP SAN", nil, []string{"10.0.0.*"}, []*x509.Certificate{host}, ""},
+        {"SAN not allowed", nil, []string{"*.internal.example.com"}, []*x509.Certificate{mailer}, "not allowed"},
+        {"subject or SAN", []string{"nobody"}, []string{"ops@*"}, []*x509.Certificate{mailer}, ""},
+        {"SAN patterns don't match the subject", nil, []string{"alice"}, []*x509.Certificate{alice}, "not allowed"},
+        {"intermediate sent by the client", nil, nil, []*x509.Certificate{chained, intermediate.cert}, ""},
+        {"intermediate missing", nil, nil, []*x509.Certificate{chained}, "unknown authority"},
+        {"other CA", []string{"alice"}, nil, []*x509.Certificate{stranger}, "unknown authority"},
+        {"server-only certificate", nil, nil, []*x509.Certificate{server}, "incompatible key usage"},
+        {"no certificate", nil, nil, nil, "no client certificate"},
+    }
+    caFile := writeCA(t, ca)
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            p, err := NewClientCertPolicy(&config.ClientCertConfig{CAFile: caFile, AllowedSubjects: tt.subjects, AllowedSANs: tt.sans})
+            if err != nil {
+                t.Fatal(err)
+            }
+            r := httptest.NewRequest("GET", "https://example.com/", nil)
+            r.TLS = &tls.ConnectionState{PeerCertificates: tt.chain}
+            r.Header.Set("X-Client-Cert-Subject", "CN=forged")
+            err = p.Authorize(r)
+            if tt.wantErr == "" {
+                if err != nil {
+                    t.Fatalf("Authorize() = %v", err)
+                }
+                if got, want := r.Header.Get("X-Client-Cert-Subject"), tt.chain[0].Subject.String(); got != want {
+                    t.Errorf("identity header = %q, want %q", got, want)
+                }
+                return
+            }
+            if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                t.Errorf("Authorize() = %v, want an error containing %q", err, tt.wantErr)
+            }
+            if got := r.Header.Get("X-Client-Cert-Subject"); got != "" {
+                t.Errorf("identity header = %q on a rejected request", got)
+            }
+        })
+    }
+}
+
+func TestNewClientCertPolicyErrors(t *testing.T) {
+    caFile := writeCA(t, newCA(t, "Test CA", nil))
+    tests := []struct {
+        name    string
+        cfg     config.ClientCertConfig
+        wantErr string
+    }{
+        {"missing CA file", config.ClientCertConfig{CAFile: "/nonexistent/ca.pem"}, "reading CA bundle"},
+        {"no certificates", config.ClientCertConfig{CAFile: os.DevNull}, "no certificates found"},
+        {"bad pattern", config.ClientCertConfig{CAFile: caFile, AllowedSANs: []string{"[a-"}}, `invalid pattern "[a-"`},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            cfg := tt.cfg
+            if _, err := NewClientCertPolicy(&cfg); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                t.Errorf("NewClientCertPolicy() = %v, want %q", err, tt.wantErr)
+            }
+        })
+    }
+}
@@ -0,0 +1,419 @@
+package router
+
+import (
+    "bytes"
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/hmac"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/json"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "math/big"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+    "time"
+    "github.com/SrLiath/ProxSize/config"
+)
+
+// JWTVerifier checks the bearer tokens of a route's requests against its
+// JWT config: algorithms, keys and claims.
+type JWTVerifier struct {
+    cfg        *config.JWTConfig
+    algorithms map[string]bool
+    secret     []byte
+    keys       []crypto.PublicKey
+    jwks       *jwksCache
+}
+
+type jwksEntry struct {
+    mu      sync.Mutex
+    keys    map[string]crypto.PublicKey
+    fetched time.Time
+    // tried is the time of the last fetch, successful or not.
+    tried time.Time
+}
+
+// jwksMinRefresh is the shortest time between two fetches of a key set.
+const jwksMinRefresh = 10 * time.Second
+
+// jwksCache holds the key sets fetched from JWKS URLs, shared by the
+// verifiers of a Table.
+type jwksCache struct {
+    mu      sync.Mutex
+    entries map[string]*jwksEntry
+}
+
+func newJWKSCache() *jwksCache {
+    return &jwksCache{entries: map[string]*jwksEntry{}}
+}
+
+// NewJWTVerifier loads the keys of cfg. A JWKS URL isn't fetched until the
+// first token needs it.
+func NewJWTVerifier(cfg *config.JWTConfig) (*JWTVerifier, error) {
+    v := &JWTVerifier{cfg: cfg, algorithms: map[string]bool{}, jwks: newJWKSCache()}
+    algs := cfg.Algorithms
+    if len(algs) == 0 {
+        algs = []string{"HS256", "RS256", "ES256"}
+    }
+    for _, alg := range algs {
+        switch alg {
+        case "HS256", "RS256", "ES256":
+            v.algorithms[alg] = true
+        default:
+            return nil, fmt.Errorf("unsupported algorithm %q", alg)
+        }
+    }
+
+    v.secret = []byte(cfg.Secret)
+    if cfg.SecretFile != "" {
+        data, err := os.ReadFile(cfg.SecretFile)
+        if err != nil {
+            return nil, fmt.Errorf("reading secret file: %w", err)
+        }
+        v.secret = bytes.TrimSpace(data)
+    }
+
+    if cfg.PublicKeyFile != "" {
+        data, err := os.ReadFile(cfg.PublicKeyFile)
+        if err != nil {
+            return nil, fmt.Errorf("reading public key file: %w", err)
+        }
+        for {
+            var block *pem.Block
+            block, data = pem.Decode(data)
+            if block == nil {
+                break
+            }
+            switch block.Type {
+            case "CERTIFICATE":
+                cert, err := x509.ParseCertificate(block.Bytes)
+                if err != nil {
+                    return nil, fmt.Errorf("parsing certificate: %w", err)
+                }
+                v.keys = append(v.keys, cert.PublicKey)
+            case "PUBLIC KEY":
+                key, err := x509.ParsePKIXPublicKey(block.Bytes)
+                if err != nil {
+                    return nil, fmt.Errorf("parsing public key: %w", err)
+                }
+                v.keys = append(v.keys, key)
+            case "RSA PUBLIC KEY":
+                key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+                if err != nil {
+                    return nil, fmt.Errorf("parsing RSA public key: %w", err)
+                }
+                v.keys = append(v.keys, key)
+            }
+        }
+        if len(v.keys) == 0 {
+            return nil, fmt.Errorf("no public keys found in %s", cfg.PublicKeyFile)
+        }
+    }
+
+    if len(v.secret) == 0 && len(v.keys) == 0 && cfg.JWKSURL == "" {
+        return nil, errors.New("no secret, public key or JWKS URL configured")
+    }
+    return v, nil
+}
+
+// Authorize validates the bearer token on r and, on success, replaces the
+// configured forward headers with the token's claims.
+func (v *JWTVerifier) Authorize(r *http.Request) error {
+    for _, header := range v.cfg.ForwardClaims {
+        r.Header.Del(header)
+    }
+
+    auth := r.Header.Get("Authorization")
+    if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+        return errors.New("missing bearer token")
+    }
+    claims, err := v.verify(strings.TrimSpace(auth[7:]))
+    if err != nil {
+        return err
+    }
+
+    for claim, header := range v.cfg.ForwardClaims {
+        value, ok := claims[claim]
+        if !ok {
+            continue
+        }
+        if s, ok := value.(string); ok {
+            r.Header.Set(header, s)
+        } else if b, err := json.Marshal(value); err == nil {
+            r.Header.Set(header, string(b))
+        }
+    }
+    return nil
+}
+
+func (v *JWTVerifier) verify(token string) (map[string]any, error) {
+    parts := strings.Split(token, ".")
+    if len(parts) != 3 {
+        return nil, errors.New("malformed token")
+    }
+
+    var header struct {
+        Alg string `json:"alg"`
+        Kid string `json:"kid"`
+    }
+    if err := decodeJWTPart(parts[0], &header); err != nil {
+        return nil, fmt.Errorf("invalid header: %w", err)
+    }
+    if !v.algorithms[header.Alg] {
+        return nil, fmt.Errorf("algorithm %q not allowed", header.Alg)
+    }
+
+    sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+    if err != nil {
+        return nil, errors.New("invalid signature encoding")
+    }
+    signed := []byte(parts[0] + "." + parts[1])
+    digest := sha256.Sum256(signed)
+
+    verified := false
+    switch header.Alg {
+    case "HS256":
+        if len(v.secret) > 0 {
+            mac := hmac.New(sha256.New, v.secret)
+            mac.Write(signed)
+            verified = hmac.Equal(sig, mac.Sum(nil))
+        }
+    case "RS256", "ES256":
+        for _, key := range v.candidateKeys(header.Kid) {
+            if verifySignature(header.Alg, key, digest[:], sig) {
+                verified = true
+                break
+            }
+        }
+    }
+    if !verified {
+        return nil, errors.New("invalid signature")
+    }
+
+    claims := map[string]any{}
+    if err := decodeJWTPart(parts[1], &claims); err != nil {
+        return nil, fmt.Errorf("invalid claims: %w", err)
+    }
+    if err := v.checkClaims(claims); err != nil {
+        return nil, err
+    }
+    return claims, nil
+}
+
+func (v *JWTVerifier) checkClaims(claims map[string]any) error {
+    now := time.Now()
+    leeway := time.Duration(v.cfg.Leeway) * time.Second
+
+    exp, ok := claims["exp"]
+    if !ok {
+        return errors.New("missing exp claim")
+    }
+    t, ok := jwtTime(exp)
+    if !ok {
+        return errors.New("invalid exp claim")
+    }
+    if now.After(t.Add(leeway)) {
+        return errors.New("token expired")
+    }
+    if nbf, ok := claims["nbf"]; ok {
+        t, ok := jwtTime(nbf)
+        if !ok {
+            return errors.New("invalid nbf claim")
+        }
+        if now.Add(leeway).Before(t) {
+            return errors.New("token not yet valid")
+        }
+    }
+
+    if v.cfg.Issuer != "" {
+        if iss, _ := claims["iss"].(string); iss != v.cfg.Issuer {
+            return fmt.Errorf("unexpected issuer %q", iss)
+        }
+    }
+
+    if len(v.cfg.Audience) > 0 {
+        var audiences []string
+        switch aud := claims["aud"].(type) {
+        case string:
+            audiences = []string{aud}
+        case []any:
+            for _, a := range aud {
+                if s, ok := a.(string); ok {
+                    audiences = append(audiences, s)
+                }
+            }
+        }
+        matched := false
+        for _, want := range v.cfg.Audience {
+            for _, got := range audiences {
+                if want == got {
+                    matched = true
+                }
+            }
+        }
+        if !matched {
+            return errors.New("audience not accepted")
+        }
+    }
+
+    for _, name := range v.cfg.RequiredClaims {
+        if _, ok := claims[name]; !ok {
+            return fmt.Errorf("missing required claim %q", name)
+        }
+    }
+    return nil
+}
+
+func (v *JWTVerifier) candidateKeys(kid string) []crypto.PublicKey {
+    keys := v.keys
+    if v.cfg.JWKSURL == "" {
+        return keys
+    }
+    remote, err := v.jwks.fetch(v.cfg.JWKSURL, time.Duration(v.cfg.JWKSCacheTTL)*time.Second, kid)
+    if err != nil {
+        log.Printf("⚠️ JWKS fetch from %s failed: %v", v.cfg.JWKSURL, err)
+    }
+    if kid != "" {
+        if key, ok := remote[kid]; ok {
+            return append([]crypto.PublicKey{key}, keys...)
+        }
+        return keys
+    }
+    for _, key := range remote {
+        keys = append(keys, key)
+    }
+    return keys
+}
+
+// fetch returns the cached key set for url, refreshing it when the TTL has
+// passed or when kid is unknown. Fetches, failed ones included, are at least
+// jwksMinRefresh apart, to absorb key rotation without letting bad tokens or
+// an identity provider outage turn every request into a fetch. Only an
+// attempted fetch returns an error.
+func (c *jwksCache) fetch(url string, ttl time.Duration, kid string) (map[string]crypto.PublicKey, error) {
+    if ttl <= 0 {
+        ttl = 5 * time.Minute
+    }
+    c.mu.Lock()
+    entry, ok := c.entries[url]
+    if !ok {
+        entry = &jwksEntry{}
+        c.entries[url] = entry
+    }
+    c.mu.Unlock()
+
+    entry.mu.Lock()
+    defer entry.mu.Unlock()
+
+    _, known := entry.keys[kid]
+    if entry.keys != nil && time.Since(entry.fetched) < ttl && (kid == "" || known) {
+        return entry.keys, nil
+    }
+    if time.Since(entry.tried) < jwksMinRefresh {
+        return entry.keys, nil
+    }
+    entry.tried = time.Now()
+    keys, err := fetchKeySet(url)
+    if err != nil {
+        return entry.keys, err
+    }
+    entry.keys = keys
+    entry.fetched = entry.tried
+    return keys, nil
+}
+
+func fetchKeySet(url string) (map[string]crypto.PublicKey, error) {
+    client := &http.Client{Timeout: 5 * time.Second}
+    resp, err := client.Get(url)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("unexpected status %s", resp.Status)
+    }
+
+    var set struct {
+        Keys []struct {
+            Kty string `json:"kty"`
+            Kid string `json:"kid"`
+            Use string `json:"use"`
+            N   string `json:"n"`
+            E   string `json:"e"`
+            Crv string `json:"crv"`
+            X   string `json:"x"`
+            Y   string `json:"y"`
+        } `json:"keys"`
+    }
+    if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&set); err != nil {
+        return nil, err
+    }
+
+    keys := map[string]crypto.PublicKey{}
+    for _, k := range set.Keys {
+        if k.Use != "" && k.Use != "sig" {
+            continue
+        }
+        switch k.Kty {
+        case "RSA":
+            n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+            e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+            if err1 != nil || err2 != nil {
+                continue
+            }
+            keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+        case "EC":
+            if k.Crv != "P-256" {
+                continue
+            }
+            x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+            y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+            if err1 != nil || err2 != nil {
+                continue
+            }
+            keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+        }
+    }
+    return keys, nil
+}
+
+func verifySignature(alg string, key crypto.PublicKey, digest, sig []byte) bool {
+    switch k := key.(type) {
+    case *rsa.PublicKey:
+        return alg == "RS256" && rsa.VerifyPKCS1v15(k, crypto.SHA256, digest, sig) == nil
+    case *ecdsa.PublicKey:
+        if alg != "ES256" || len(sig) != 64 {
+            return false
+        }
+        r := new(big.Int).SetBytes(sig[:32])
+        s := new(big.Int).SetBytes(sig[32:])
+        return ecdsa.Verify(k, digest, r, s)
+    }
+    return false
+}
+
+func decodeJWTPart(part string, v any) error {
+    data, err := base64.RawURLEncoding.DecodeString(part)
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal(data, v)
+}
+
+func jwtTime(v any) (time.Time, bool) {
+    f, ok := v.(float64)
+    if !ok {
+        return time.Time{}, false
+    }
+    return time.Unix(int64(f), 0), true
+}
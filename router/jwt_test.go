@@ -0,0 +1,276 @@
+package router
+
+import (
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/json"
+    "encoding/pem"
+    "fmt"
+    "math/big"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+    "github.com/SrLiath/ProxSize/config"
+    "path/filepath"
+)
+
+// signJWT builds a token over header and claims with key: a []byte secret
+// for HS256, or an RSA or ECDSA private key.
+func signJWT(t *testing.T, header, claims map[string]any, key any) string {
+    t.Helper()
+    enc := func(v any) string {
+        data, err := json.Marshal(v)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return base64.RawURLEncoding.EncodeToString(data)
+    }
+    signed := enc(header) + "." + enc(claims)
+    digest := sha256.Sum256([]byte(signed))
+    var sig []byte
+    switch k := key.(type) {
+    case []byte:
+        mac := hmac.New(sha256.New, k)
+        mac.Write([]byte(signed))
+        sig = mac.Sum(nil)
+    case *rsa.PrivateKey:
+        var err error
+        sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+        if err != nil {
+            t.Fatal(err)
+        }
+    case *ecdsa.PrivateKey:
+        r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+        if err != nil {
+            t.Fatal(err)
+        }
+        sig = make([]byte, 64)
+        r.FillBytes(sig[:32])
+        s.FillBytes(sig[32:])
+    }
+    return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func bearer(token string) *http.Request {
+    r := httptest.NewRequest("GET", "/", nil)
+    r.Header.Set("Authorization", "Bearer "+token)
+    return r
+}
+
+func writePublicKey(t *testing.T, key crypto.PublicKey) string {
+    t.Helper()
+    der, err := x509.MarshalPKIXPublicKey(key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    file := filepath.Join(t.TempDir(), "key.pem")
+    if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    return file
+}
+
+func TestJWTVerifier(t *testing.T) {
+    secret := []byte("s3cret")
+    rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    otherEC, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+    now := time.Now().Unix()
+    valid := map[string]any{"sub": "alice", "exp": now + 60}
+    with := func(extra map[string]any) map[string]any {
+        claims := map[string]any{}
+        for k, v := range valid {
+            claims[k] = v
+        }
+        for k, v := range extra {
+            if v == nil {
+                delete(claims, k)
+            } else {
+                claims[k] = v
+            }
+        }
+        return claims
+    }
+    hs := map[string]any{"alg": "HS256", "typ": "JWT"}
+
+    tests := []struct {
+        name    string
+        cfg     config.JWTConfig
+        token   string
+        wantErr string
+    }{
+        {"HS256", config.JWTConfig{Secret: "s3cret"}, signJWT(t, hs, valid, secret), ""},
+        {"HS256 wrong secret", config.JWTConfig{Secret: "other"}, signJWT(t, hs, valid, secret), "invalid signature"},
+        {"RS256 public key file", config.JWTConfig{PublicKeyFile: writePublicKey(t, &rsaKey.PublicKey)}, signJWT(t, map[string]any{"alg": "RS256"}, valid, rsaKey), ""},
+        {"ES256 public key file", config.JWTConfig{PublicKeyFile: writePublicKey(t, &ecKey.PublicKey)}, signJWT(t, map[string]any{"alg": "ES256"}, valid, ecKey), ""},
+        {"ES256 other key", config.JWTConfig{PublicKeyFile: writePublicKey(t, &ecKey.PublicKey)}, signJWT(t, map[string]any{"alg": "ES256"}, valid, otherEC), "invalid signature"},
+        {"algorithm not allowed", config.JWTConfig{Secret: "s3cret", Algorithms: []string{"RS256"}}, signJWT(t, hs, valid, secret), `algorithm "HS256" not allowed`},
+        {"alg none", config.JWTConfig{Secret: "s3cret"}, signJWT(t, map[string]any{"alg": "none"}, valid, secret), `algorithm "none" not allowed`},
+        {"HS256 signed with the public key", config.JWTConfig{PublicKeyFile: writePublicKey(t, &rsaKey.PublicKey)}, signJWT(t, hs, valid, x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey)), "invalid signature"},
+        {"malformed", config.JWTConfig{Secret: "s3cret"}, "abc.def", "malformed token"},
+        {"expired", config.JWTConfig{Secret: "s3cret"}, signJWT(t, hs, with(map[string]any{"exp": now - 60}), secret), "token expired"},
+        {"expired within leeway", config.JWTConfig{Secret: "s3cret", Leeway: 120}, signJWT(t, hs, with(map[string]any{"exp": now - 60}), secret), ""},
+        {"missing exp", config.JWTConfig{Secret: "s3cret"}, signJWT(t, hs, with(map[string]any{"exp": nil}), secret), "missing exp claim"},
+        {"string exp", config.JWTConfig{Secret: "s3cret"}, signJWT(t, hs, with(map[string]any{"exp": "tomorrow"}), secret), "invalid exp claim"},
+        {"not yet valid", config.JWTConfig{Secret: "s3cret"}, signJWT(t, hs, with(map[string]any{"nbf": now + 60}), secret), "token not yet valid"},
+        {"issuer", config.JWTConfig{Secret: "s3cret", Issuer: "idp"}, signJWT(t, hs, with(map[string]any{"iss": "idp"}), secret), ""},
+        {"wrong issuer", config.JWTConfig{Secret: "s3cret", Issuer: "idp"}, signJWT(t, hs, with(map[string]any{"iss": "evil"}), secret), `unexpected issuer "evil"`},
+        {"audience list", config.JWTConfig{Secret: "s3cret", Audience: []string{"api"}}, signJWT(t, hs, with(map[string]any{"aud": []string{"web", "api"}}), secret), ""},
+        {"wrong audience", config.JWTConfig{Secret: "s3cret", Audience: []string{"api"}}, signJWT(t, hs, with(map[string]any{"aud": "web"}), secret), "audience not accepted"},
+        {"required claim", config.JWTConfig{Secret: "s3cret", RequiredClaims: []string{"role"}}, signJWT(t, hs, valid, secret), `missing required claim "role"`},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            cfg := tt.cfg
+            v, err := NewJWTVerifier(&cfg)
+            if err != nil {
+                t.Fatal(err)
+            }
+            err = v.Authorize(bearer(tt.token))
+            if tt.wantErr == "" && err != nil {
+                t.Errorf("Authorize() = %v, want nil", err)
+            }
+            if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+                t.Errorf("Authorize() = %v, want %q", err, tt.wantErr)
+            }
+        })
+    }
+}
+
+func TestJWTForwardClaims(t *testing.T) {
+    v, err := NewJWTVerifier(&config.JWTConfig{
+        Secret:        "s3cret",
+        ForwardClaims: map[string]string{"sub": "X-User", "roles": "X-Roles", "email": "X-Email"},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    claims := map[string]any{"sub": "alice", "roles": []string{"a", "b"}, "exp": time.Now().Unix() + 60}
+    r := bearer(signJWT(t, map[string]any{"alg": "HS256"}, claims, []byte("s3cret")))
+    // A client can't smuggle in a header the token doesn't back.
+    r.Header.Set("X-Email", "admin@example.com")
+    if err := v.Authorize(r); err != nil {
+        t.Fatal(err)
+    }
+    want := map[string]string{"X-User": "alice", "X-Roles": `["a","b"]`, "X-Email": ""}
+    for header, value := range want {
+        if got := r.Header.Get(header); got != value {
+            t.Errorf("%s = %q, want %q", header, got, value)
+        }
+    }
+
+    r = httptest.NewRequest("GET", "/", nil)
+    r.Header.Set("X-User", "mallory")
+    if err := v.Authorize(r); err == nil || err.Error() != "missing bearer token" {
+        t.Errorf("Authorize() without a token = %v", err)
+    }
+    if got := r.Header.Get("X-User"); got != "" {
+        t.Errorf("X-User = %q on a rejected request, want it removed", got)
+    }
+}
+
+func TestNewJWTVerifierErrors(t *testing.T) {
+    tests := []struct {
+        name    string
+        cfg     config.JWTConfig
+        wantErr string
+    }{
+        {"no key", config.JWTConfig{}, "no secret, public key or JWKS URL configured"},
+        {"unknown algorithm", config.JWTConfig{Secret: "x", Algorithms: []string{"HS512"}}, `unsupported algorithm "HS512"`},
+        {"missing secret file", config.JWTConfig{SecretFile: "/nonexistent/secret"}, "reading secret file"},
+        {"empty key file", config.JWTConfig{PublicKeyFile: os.DevNull}, "no public keys found"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            cfg := tt.cfg
+            if _, err := NewJWTVerifier(&cfg); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                t.Errorf("NewJWTVerifier() = %v, want %q", err, tt.wantErr)
+            }
+        })
+    }
+}
+
+func TestJWKS(t *testing.T) {
+    rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+    var fetches atomic.Int32
+    var failing atomic.Bool
+    jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        fetches.Add(1)
+        if failing.Load() {
+            http.Error(w, "down", http.StatusServiceUnavailable)
+            return
+        }
+        fmt.Fprintf(w, `{"keys": [
+            {"kty": "RSA", "kid": "rsa1", "use": "sig", "n": %q, "e": %q},
+            {"kty": "EC", "kid": "ec1", "crv": "P-256", "x": %q, "y": %q},
+            {"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQAB", "e": "AQAB"}
+        ]}`, b64(rsaKey.N.Bytes()), b64(big.NewInt(int64(rsaKey.E)).Bytes()), b64(ecKey.X.FillBytes(make([]byte, 32))), b64(ecKey.Y.FillBytes(make([]byte, 32))))
+    }))
+    defer jwks.Close()
+
+    v, err := NewJWTVerifier(&config.JWTConfig{JWKSURL: jwks.URL})
+    if err != nil {
+        t.Fatal(err)
+    }
+    claims := map[string]any{"exp": time.Now().Unix() + 60}
+    for _, tt := range []struct {
+        header map[string]any
+        key    any
+    }{
+        {map[string]any{"alg": "RS256", "kid": "rsa1"}, rsaKey},
+        {map[string]any{"alg": "ES256", "kid": "ec1"}, ecKey},
+        {map[string]any{"alg": "ES256"}, ecKey},
+    } {
+        if err := v.Authorize(bearer(signJWT(t, tt.header, claims, tt.key))); err != nil {
+            t.Errorf("Authorize(%v) = %v", tt.header, err)
+        }
+    }
+    if n := fetches.Load(); n != 1 {
+        t.Errorf("%d fetches for known keys, want 1", n)
+    }
+
+    // Unknown key IDs may trigger a refetch, but no more than one every
+    // jwksMinRefresh however many tokens come in.
+    entry := v.jwks.entries[jwks.URL]
+    entry.tried = time.Now().Add(-jwksMinRefresh)
+    failing.Store(true)
+    for i := 0; i < 5; i++ {
+        token := signJWT(t, map[string]any{"alg": "RS256", "kid": fmt.Sprintf("rotated%d", i)}, claims, rsaKey)
+        if err := v.Authorize(bearer(token)); err == nil {
+            t.Errorf("token with unknown kid accepted")
+        }
+    }
+    if n := fetches.Load(); n != 2 {
+        t.Errorf("%d fetches after a failing refresh, want 2", n)
+    }
+    // The keys fetched before keep working while the provider is down.
+    if err := v.Authorize(bearer(signJWT(t, map[string]any{"alg": "RS256", "kid": "rsa1"}, claims, rsaKey))); err != nil {
+        t.Errorf("cached key rejected while the JWKS URL fails: %v", err)
+    }
+}
@@ -0,0 +1,134 @@
+package router
+
+import (
+    "math"
+    "net"
+    "net/http"
+    "sync"
+    "time"
+    "github.com/SrLiath/ProxSize/config"
+)
+
+// RateLimiter keeps one token bucket per client key. A Table hands the same
+// limiter to the next Table built from it, so the state survives config
+// reloads as long as the limit itself is unchanged.
+type RateLimiter struct {
+    cfg       config.RateLimitConfig
+    mu        sync.Mutex
+    buckets   map[string]*tokenBucket
+    lastSweep time.Time
+}
+
+type tokenBucket struct {
+    tokens float64
+    last   time.Time
+}
+
+// NewRateLimiter returns a limiter for cfg, or nil when cfg has no positive
+// rate. The burst defaults to the rate, rounded up.
+func NewRateLimiter(cfg config.RateLimitConfig) *RateLimiter {
+    if cfg.Rate <= 0 {
+        return nil
+    }
+    if cfg.Burst <= 0 {
+        cfg.Burst = int(math.Max(1, math.Ceil(cfg.Rate)))
+    }
+    return &RateLimiter{cfg: cfg, buckets: map[string]*tokenBucket{}, lastSweep: time.Now()}
+}
+
+// Key picks the bucket for a request: the client IP by default, a header
+// value with "by": "header", or one shared bucket with "by": "route".
+func (l *RateLimiter) Key(r *http.Request, client net.IP) string {
+    switch l.cfg.By {
+    case "route":
+        return ""
+    case "header":
+        if r != nil {
+            if v := r.Header.Get(l.cfg.Header); v != "" {
+                return "h:" + v
+            }
+        }
+    }
+    return client.String()
+}
+
+// Allow takes a token from the bucket for key. When the bucket is empty it
+// reports how long until the next token is available.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    now := time.Now()
+    burst := float64(l.cfg.Burst)
+    if now.Sub(l.lastSweep) > time.Minute {
+        // Buckets that have refilled completely carry no state; drop them.
+        for k, b := range l.buckets {
+            if b.tokens+now.Sub(b.last).Seconds()*l.cfg.Rate >= burst {
+                delete(l.buckets, k)
+            }
+        }
+        l.lastSweep = now
+    }
+
+    b, ok := l.buckets[key]
+    if !ok {
+        b = &tokenBucket{tokens: burst, last: now}
+        l.buckets[key] = b
+    }
+    b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.cfg.Rate)
+    b.last = now
+    if b.tokens >= 1 {
+        b.tokens--
+        return true, 0
+    }
+    return false, time.Duration((1 - b.tokens) / l.cfg.Rate * float64(time.Second))
+}
+
+// ConnLimiter is a counting semaphore for concurrent connections or requests.
+// When full, Acquire waits up to the queue timeout for a slot (or fails at
+// once without one). A nil ConnLimiter has no limit.
+type ConnLimiter struct {
+    max     int
+    timeout time.Duration
+    slots   chan struct{}
+}
+
+// NewConnLimiter returns a limiter for max concurrent holders, or nil for no
+// limit when max isn't positive.
+func NewConnLimiter(max int, timeout time.Duration) *ConnLimiter {
+    if max <= 0 {
+        return nil
+    }
+    return &ConnLimiter{max: max, timeout: timeout, slots: make(chan struct{}, max)}
+}
+
+// Acquire takes a slot, waiting up to the queue timeout for one, and reports
+// whether it got one. Every successful Acquire must be followed by Release.
+func (l *ConnLimiter) Acquire() bool {
+    if l == nil {
+        return true
+    }
+    select {
+    case l.slots <- struct{}{}:
+        return true
+    default:
+    }
+    if l.timeout <= 0 {
+        return false
+    }
+    timer := time.NewTimer(l.timeout)
+    defer timer.Stop()
+    select {
+    case l.slots <- struct{}{}:
+        return true
+    case <-timer.C:
+        return false
+    }
+}
+
+// Release gives back a slot taken by Acquire.
+func (l *ConnLimiter) Release() {
+    if l != nil {
+        <-l.slots
+    }
+}
@@ -0,0 +1,191 @@
+package router
+
+import (
+    "net"
+    "net/http/httptest"
+    "testing"
+    "time"
+    "github.com/SrLiath/ProxSize/config"
+)
+
+func TestNewRateLimiter(t *testing.T) {
+    tests := []struct {
+        cfg       config.RateLimitConfig
+        wantBurst int
+    }{
+        {config.RateLimitConfig{Rate: 5}, 5},
+        {config.RateLimitConfig{Rate: 0.5}, 1},
+        {config.RateLimitConfig{Rate: 2.5}, 3},
+        {config.RateLimitConfig{Rate: 2, Burst: 10}, 10},
+    }
+    for _, tt := range tests {
+        l := NewRateLimiter(tt.cfg)
+        if l == nil {
+            t.Errorf("NewRateLimiter(%+v) = nil", tt.cfg)
+        } else if l.cfg.Burst != tt.wantBurst {
+            t.Errorf("NewRateLimiter(%+v) burst = %d, want %d", tt.cfg, l.cfg.Burst, tt.wantBurst)
+        }
+    }
+    for _, rate := range []float64{0, -1} {
+        if l := NewRateLimiter(config.RateLimitConfig{Rate: rate}); l != nil {
+            t.Errorf("NewRateLimiter(rate %g) = %v, want nil", rate, l)
+        }
+    }
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+    l := NewRateLimiter(config.RateLimitConfig{Rate: 2, Burst: 3})
+    for i := 0; i < 3; i++ {
+        if ok, _ := l.Allow("a"); !ok {
+            t.Fatalf("request %d within the burst rejected", i+1)
+        }
+    }
+    ok, wait := l.Allow("a")
+    if ok {
+        t.Fatal("request over the burst allowed")
+    }
+    if wait <= 0 || wait > 500*time.Millisecond {
+        t.Errorf("wait = %s, want up to one token at 2/s", wait)
+    }
+    if ok, _ := l.Allow("b"); !ok {
+        t.Error("other key shares the bucket")
+    }
+
+    // A second later two tokens are back, and no more than the burst ever.
+    l.buckets["a"].last = l.buckets["a"].last.Add(-time.Second)
+    for i := 0; i < 2; i++ {
+        if ok, _ := l.Allow("a"); !ok {
+            t.Fatalf("refilled token %d rejected", i+1)
+        }
+    }
+    if ok, _ := l.Allow("a"); ok {
+        t.Error("more tokens than the refill rate")
+    }
+    l.buckets["a"].last = l.buckets["a"].last.Add(-time.Hour)
+    allowed := 0
+    for i := 0; i < 10; i++ {
+        if ok, _ := l.Allow("a"); ok {
+            allowed++
+        }
+    }
+    if allowed != 3 {
+        t.Errorf("%d requests after an idle hour, want the burst of 3", allowed)
+    }
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+    l := NewRateLimiter(config.RateLimitConfig{Rate: 1, Burst: 1})
+    l.Allow("idle")
+    l.Allow("busy")
+    l.buckets["idle"].last = time.Now().Add(-time.Hour)
+    l.buckets["busy"].last = time.Now()
+    l.lastSweep = time.Now().Add(-2 * time.Minute)
+    l.Allow("new")
+    if _, ok := l.buckets["idle"]; ok {
+        t.Error("full bucket kept after the sweep")
+    }
+    if _, ok := l.buckets["busy"]; !ok {
+        t.Error("empty bucket dropped by the sweep, which would reset its limit")
+    }
+}
+
+func TestRateLimiterKey(t *testing.T) {
+    client := net.ParseIP("192.0.2.7")
+    tests := []struct {
+        name   string
+        cfg    config.RateLimitConfig
+        header string
+        want   string
+    }{
+        {"by ip", config.RateLimitConfig{Rate: 1}, "", "192.0.2.7"},
+        {"by route", config.RateLimitConfig{Rate: 1, By: "route"}, "", ""},
+        {"by header", config.RateLimitConfig{Rate: 1, By: "header", Header: "X-API-Key"}, "k1", "h:k1"},
+        {"by header, missing", config.RateLimitConfig{Rate: 1, By: "header", Header: "X-API-Key"}, "", "192.0.2.7"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := httptest.NewRequest("GET", "/", nil)
+            if tt.header != "" {
+                r.Header.Set("X-API-Key", tt.header)
+            }
+            if got := NewRateLimiter(tt.cfg).Key(r, client); got != tt.want {
+                t.Errorf("Key() = %q, want %q", got, tt.want)
+            }
+        })
+    }
+    // TCP accepts have no request.
+    l := NewRateLimiter(config.RateLimitConfig{Rate: 1, By: "header", Header: "X-API-Key"})
+    if got := l.Key(nil, client); got != "192.0.2.7" {
+        t.Errorf("Key(nil) = %q, want the client IP", got)
+    }
+}
+
+func TestConnLimiter(t *testing.T) {
+    var unlimited *ConnLimiter
+    if !unlimited.Acquire() {
+        t.Error("nil limiter refused a slot")
+    }
+    unlimited.Release()
+    if l := NewConnLimiter(0, time.Second); l != nil {
+        t.Errorf("NewConnLimiter(0) = %v, want nil", l)
+    }
+
+    l := NewConnLimiter(2, 0)
+    if !l.Acquire() || !l.Acquire() {
+        t.Fatal("slots within the limit refused")
+    }
+    if l.Acquire() {
+        t.Fatal("slot over the limit granted")
+    }
+    l.Release()
+    if !l.Acquire() {
+        t.Error("released slot not reused")
+    }
+}
+
+func TestConnLimiterQueue(t *testing.T) {
+    l := NewConnLimiter(1, 50*time.Millisecond)
+    l.Acquire()
+    start := time.Now()
+    if l.Acquire() {
+        t.Fatal("slot granted while full")
+    }
+    if waited := time.Since(start); waited < 50*time.Millisecond {
+        t.Errorf("gave up after %s, want the queue timeout", waited)
+    }
+
+    l = NewConnLimiter(1, 5*time.Second)
+    l.Acquire()
+    go func() {
+        time.Sleep(20 * time.Millisecond)
+        l.Release()
+    }()
+    if !l.Acquire() {
+        t.Error("queued request didn't get the released slot")
+    }
+}
+
+func TestBuildConnLimiters(t *testing.T) {
+    rules := config.Rules{
+        Path: map[string]config.RouteEntry{
+            "/a": {Target: "http://backend:80", MaxConnections: 5},
+            "/b": {Target: "http://backend:80", MaxConnections: 5},
+            "/c": {Target: "http://other:80"},
+        },
+        Limits: config.LimitsConfig{MaxConnections: 100},
+    }
+    table := Build(rules, nil)
+    backends := map[string]*ConnLimiter{}
+    for _, route := range table.Routes(80) {
+        backends[route.Key] = route.Backend
+    }
+    if backends["/a"] == nil || backends["/a"] != backends["/b"] {
+        t.Error("routes to the same backend don't share its limiter")
+    }
+    if backends["/c"] != nil {
+        t.Error("backend without max_connections is limited")
+    }
+    if table.Global == nil || table.Global.max != 100 {
+        t.Errorf("global limiter = %+v, want max 100", table.Global)
+    }
+}
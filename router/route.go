@@ -0,0 +1,261 @@
+// Package router turns a config into routes, and holds the per-route checks a
+// request or connection goes through: access lists, rate and connection
+// limits, JWT and client certificate authentication.
+package router
+
+import (
+    "fmt"
+    "log"
+    "maps"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+    "github.com/SrLiath/ProxSize/config"
+)
+
+// AnyPort keys the routes in Table.Ports that have no port of their own and
+// are served on every listener.
+const AnyPort = -1
+
+// Route is a rule ready to serve: where it matches, where it forwards to and
+// the checks a request or connection goes through first. Nil checks and
+// limiters are off.
+type Route struct {
+    Type       string
+    Key        string
+    Target     string
+    JWT        *JWTVerifier
+    ClientCert *ClientCertPolicy
+    ACL        *ACL
+    RateLimit  *RateLimiter
+    Backend    *ConnLimiter
+    MaxBody    int64
+    BufferBody bool
+}
+
+// Matches reports whether a request for host and path goes to this route.
+// Host names are compared case-insensitively, paths exactly.
+func (route Route) Matches(host, path string) bool {
+    switch route.Type {
+    case "domain":
+        return strings.EqualFold(host, route.Key)
+    case "subdomain":
+        parts := strings.Split(host, ".")
+        return len(parts) >= 2 && strings.EqualFold(parts[0], route.Key)
+    case "path":
+        return strings.HasPrefix(path, route.Key)
+    }
+    return false
+}
+
+// Table is a config's routes, grouped by the listener that serves them. It
+// owns the state behind them, rate and connection limiters and cached JWKS
+// keys, which the next Table built from it takes over.
+type Table struct {
+    Ports  map[int][]Route
+    // TCP holds the routes of the multiplexer by their lower-cased key.
+    TCP    map[string]Route
+    Global *ConnLimiter
+
+    mu    sync.Mutex
+    rate  map[string]*RateLimiter
+    conns map[string]*ConnLimiter
+    jwks  *jwksCache
+    // The limiters of the table this one was built from, until Prune.
+    oldRate  map[string]*RateLimiter
+    oldConns map[string]*ConnLimiter
+}
+
+// Build creates the routes for rules. prev is the table of the previous
+// config, or nil: limiters keyed the same way with unchanged settings are
+// taken over from it, so a reload keeps the state of the limits that didn't
+// change, and so is the JWKS cache.
+func Build(rules config.Rules, prev *Table) *Table {
+    t := &Table{
+        Ports: map[int][]Route{},
+        TCP:   map[string]Route{},
+        rate:  map[string]*RateLimiter{},
+        conns: map[string]*ConnLimiter{},
+        jwks:  newJWKSCache(),
+    }
+    if prev != nil {
+        prev.mu.Lock()
+        t.oldRate, t.oldConns, t.jwks = maps.Clone(prev.rate), maps.Clone(prev.conns), prev.jwks
+        prev.mu.Unlock()
+    }
+    backendCaps := map[string]config.RouteEntry{}
+    for _, entries := range []map[string]config.RouteEntry{rules.Path, rules.Subdomain, rules.Domain, rules.TCP} {
+        for _, entry := range entries {
+            if entry.MaxConnections <= 0 {
+                continue
+            }
+            if prev, ok := backendCaps[entry.Target]; !ok || entry.MaxConnections < prev.MaxConnections {
+                backendCaps[entry.Target] = entry
+            }
+        }
+    }
+    t.Global = t.ConnLimiter("global", rules.Limits.MaxConnections, time.Duration(rules.Limits.QueueTimeout))
+    backendLimiter := func(target string) *ConnLimiter {
+        entry, ok := backendCaps[target]
+        if !ok {
+            return nil
+        }
+        return t.ConnLimiter("backend:"+target, entry.MaxConnections, time.Duration(entry.QueueTimeout))
+    }
+    for kind, entries := range map[string]map[string]config.RouteEntry{
+        "path":      rules.Path,
+        "subdomain": rules.Subdomain,
+        "domain":    rules.Domain,
+    } {
+        for key, entry := range entries {
+
+            port := entry.Port
+            if port == 0 {
+                port = AnyPort
+            }
+            route := Route{
+                Type:       kind,
+                Key:        key,
+                Target:     entry.Target,
+                MaxBody:    entry.MaxBodyBytes,
+                BufferBody: entry.BufferBody,
+            }
+            if entry.JWT != nil {
+                verifier, err := NewJWTVerifier(entry.JWT)
+                if err != nil {
+                    // Keep the route but reject every request rather than
+                    // exposing it unauthenticated.
+                    log.Printf("⚠️ JWT config for %s %q: %v", kind, key, err)
+                    verifier = &JWTVerifier{cfg: entry.JWT}
+                }
+                verifier.jwks = t.jwks
+                route.JWT = verifier
+            }
+            if entry.ClientCert != nil {
+                policy, err := NewClientCertPolicy(entry.ClientCert)
+                if err != nil {
+                    log.Printf("⚠️ Client certificate config for %s %q: %v", kind, key, err)
+                    policy = &ClientCertPolicy{cfg: entry.ClientCert}
+                }
+                route.ClientCert = policy
+            }
+            route.ACL = NewACL(entry.Allow, entry.Deny, fmt.Sprintf("%s %q", kind, key))
+            if entry.RateLimit != nil {
+                route.RateLimit = t.RateLimiter(fmt.Sprintf("%s:%s:%d", kind, key, entry.Port), *entry.RateLimit)
+            }
+            route.Backend = backendLimiter(entry.Target)
+            t.Ports[port] = append(t.Ports[port], route)
+        }
+    }
+    for _, routes := range t.Ports {
+        Sort(routes)
+    }
+
+    // tcp:// subdomains and tcp rules are both served by the multiplexer,
+    // by the first label of the host name.
+    for kind, entries := range map[string]map[string]config.RouteEntry{
+        "subdomain": rules.Subdomain,
+        "tcp":       rules.TCP,
+    } {
+        for key, entry := range entries {
+            if !strings.HasPrefix(entry.Target, "tcp://") {
+                continue
+            }
+            t.TCP[strings.ToLower(key)] = Route{
+                Type:    kind,
+                Key:     key,
+                Target:  entry.Target,
+                ACL:     NewACL(entry.Allow, entry.Deny, fmt.Sprintf("%s %q", kind, key)),
+                Backend: backendLimiter(entry.Target),
+            }
+        }
+    }
+    return t
+}
+
+// Routes lists the HTTP routes served on port, in match order.
+func (t *Table) Routes(port int) []Route {
+    routes := append(append([]Route{}, t.Ports[port]...), t.Ports[AnyPort]...)
+    Sort(routes)
+    return routes
+}
+
+// Sort puts routes in the order requests are matched against them: domain
+// rules, then subdomain rules, then path rules with the longest prefix
+// first, each by key. Routes that tie keep their order, so a rule for a
+// specific port listed before an any-port rule with the same key wins.
+func Sort(routes []Route) {
+    rank := map[string]int{"domain": 0, "subdomain": 1, "path": 2}
+    sort.SliceStable(routes, func(i, j int) bool {
+        a, b := routes[i], routes[j]
+        if a.Type != b.Type {
+            return rank[a.Type] < rank[b.Type]
+        }
+        if a.Type == "path" && len(a.Key) != len(b.Key) {
+            return len(a.Key) > len(b.Key)
+        }
+        return a.Key < b.Key
+    })
+}
+
+// All lists every route in the table, HTTP and TCP.
+func (t *Table) All() []Route {
+    var all []Route
+    for _, routes := range t.Ports {
+        all = append(all, routes...)
+    }
+    for _, route := range t.TCP {
+        all = append(all, route)
+    }
+    return all
+}
+
+// RateLimiter returns the rate limiter for id, like "listener:8080", taking
+// over the previous table's when its settings are unchanged. It returns nil
+// when cfg has no positive rate.
+func (t *Table) RateLimiter(id string, cfg config.RateLimitConfig) *RateLimiter {
+    l := NewRateLimiter(cfg)
+    if l == nil {
+        log.Printf("⚠️ Rate limit for %s has no positive rate, ignoring", id)
+        return nil
+    }
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    for _, limiters := range []map[string]*RateLimiter{t.rate, t.oldRate} {
+        if old, ok := limiters[id]; ok && old.cfg == l.cfg {
+            l = old
+            break
+        }
+    }
+    t.rate[id] = l
+    return l
+}
+
+// ConnLimiter returns the connection limiter for id, taking over the previous
+// table's when its settings are unchanged, so in-flight counts carry over
+// across reloads. It returns nil, no limit, when max isn't positive.
+func (t *Table) ConnLimiter(id string, max int, timeout time.Duration) *ConnLimiter {
+    if max <= 0 {
+        return nil
+    }
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    for _, limiters := range []map[string]*ConnLimiter{t.conns, t.oldConns} {
+        if old, ok := limiters[id]; ok && old.max == max && old.timeout == timeout {
+            t.conns[id] = old
+            return old
+        }
+    }
+    l := NewConnLimiter(max, timeout)
+    t.conns[id] = l
+    return l
+}
+
+// Prune lets go of the previous table's limiters that this one didn't take
+// over. Call it once every listener has asked for its limiters.
+func (t *Table) Prune() {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    t.oldRate, t.oldConns = nil, nil
+}
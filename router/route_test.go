@@ -0,0 +1,129 @@
+package router
+
+import (
+    "fmt"
+    "testing"
+    "github.com/SrLiath/ProxSize/config"
+)
+
+func TestRoutesOrder(t *testing.T) {
+    entry := func(port int) config.RouteEntry {
+        return config.RouteEntry{Target: "http://backend", Port: port}
+    }
+    table := Build(config.Rules{
+        Path: map[string]config.RouteEntry{
+            "/":        entry(0),
+            "/api":     entry(0),
+            "/api/v2":  entry(80),
+            "/app":     entry(0),
+            "/static":  entry(443),
+            "/api/v10": entry(0),
+        },
+        Subdomain: map[string]config.RouteEntry{"www": entry(0), "app": entry(80)},
+        Domain:    map[string]config.RouteEntry{"example.com": entry(0), "b.example.com": entry(0)},
+    }, nil)
+
+    tests := []struct {
+        port int
+        want string
+    }{
+        {80, "[domain b.example.com domain example.com subdomain app subdomain www path /api/v10 path /api/v2 path /api path /app path /]"},
+        {443, "[domain b.example.com domain example.com subdomain www path /api/v10 path /static path /api path /app path /]"},
+        {8080, "[domain b.example.com domain example.com subdomain www path /api/v10 path /api path /app path /]"},
+    }
+    for _, tt := range tests {
+        var got []string
+        for _, route := range table.Routes(tt.port) {
+            got = append(got, route.Type+" "+route.Key)
+        }
+        if fmt.Sprint(got) != tt.want {
+            t.Errorf("Routes(%d) = %v\nwant %s", tt.port, got, tt.want)
+        }
+    }
+}
+
+func TestMatches(t *testing.T) {
+    tests := []struct {
+        route      Route
+        host, path string
+        want       bool
+    }{
+        {Route{Type: "domain", Key: "example.com"}, "example.com", "/", true},
+        {Route{Type: "domain", Key: "example.com"}, "www.example.com", "/", false},
+        {Route{Type: "domain", Key: "Example.com"}, "EXAMPLE.com", "/", true},
+        {Route{Type: "subdomain", Key: "App"}, "aPP.example.com", "/", true},
+        {Route{Type: "subdomain", Key: "app"}, "app.example.com", "/", true},
+        {Route{Type: "subdomain", Key: "app"}, "app", "/", false},
+        {Route{Type: "subdomain", Key: "app"}, "www.app.example.com", "/", false},
+        {Route{Type: "path", Key: "/api"}, "example.com", "/api/users", true},
+        {Route{Type: "path", Key: "/api"}, "example.com", "/apiary", true},
+        {Route{Type: "path", Key: "/api"}, "example.com", "/ap", false},
+        {Route{Type: "path", Key: "/api"}, "example.com", "/API", false},
+        {Route{Type: "tcp", Key: "db"}, "db.example.com", "/", false},
+    }
+    for _, tt := range tests {
+        if got := tt.route.Matches(tt.host, tt.path); got != tt.want {
+            t.Errorf("%s %q Matches(%q, %q) = %t, want %t", tt.route.Type, tt.route.Key, tt.host, tt.path, got, tt.want)
+        }
+    }
+}
+
+func TestBuildKeepsState(t *testing.T) {
+    rate := func(r float64) *config.RateLimitConfig { return &config.RateLimitConfig{Rate: r} }
+    rules := func(bRate float64, maxConns int) config.Rules {
+        return config.Rules{
+            Path: map[string]config.RouteEntry{
+                "/a": {Target: "http://a", RateLimit: rate(1), MaxConnections: 5},
+                "/b": {Target: "http://b", RateLimit: rate(bRate), MaxConnections: maxConns},
+                "/c": {Target: "http://c", JWT: &config.JWTConfig{JWKSURL: "https://idp.example.com/jwks"}},
+            },
+            Limits: config.LimitsConfig{MaxConnections: 100},
+        }
+    }
+    routes := func(table *Table) map[string]Route {
+        byKey := map[string]Route{}
+        for _, route := range table.Routes(80) {
+            byKey[route.Key] = route
+        }
+        return byKey
+    }
+    listener := config.RateLimitConfig{Rate: 10}
+
+    first := Build(rules(1, 5), nil)
+    firstListener := first.RateLimiter("listener:80", listener)
+    first.ConnLimiter("listener:8080", 3, 0)
+    first.Prune()
+
+    second := Build(rules(2, 6), first)
+    secondListener := second.RateLimiter("listener:80", listener)
+    second.Prune()
+    before, after := routes(first), routes(second)
+    if after["/a"].RateLimit != before["/a"].RateLimit || after["/a"].Backend != before["/a"].Backend {
+        t.Error("unchanged limits not taken over")
+    }
+    if after["/b"].RateLimit == before["/b"].RateLimit || after["/b"].Backend == before["/b"].Backend {
+        t.Error("changed limits taken over with their old settings")
+    }
+    if second.Global != first.Global || secondListener != firstListener {
+        t.Error("unchanged global or listener limit not taken over")
+    }
+    if after["/c"].JWT.jwks != before["/c"].JWT.jwks || after["/c"].JWT.jwks != second.jwks {
+        t.Error("JWKS cache not shared with the next table")
+    }
+
+    // Prune dropped the listener:8080 limiter nothing asked for, so it
+    // starts over once the port comes back.
+    third := Build(rules(2, 6), second)
+    if third.ConnLimiter("listener:8080", 3, 0) == first.conns["listener:8080"] {
+        t.Error("limiter dropped by a reload came back")
+    }
+    if third.RateLimiter("listener:80", listener) != firstListener {
+        t.Error("limiter lost after two reloads")
+    }
+
+    // Tables built from scratch share nothing.
+    other := Build(rules(1, 5), nil)
+    if routes(other)["/a"].RateLimit == before["/a"].RateLimit || other.Global == first.Global || other.jwks == first.jwks {
+        t.Error("independent tables share state")
+    }
+}
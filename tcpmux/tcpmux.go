@@ -0,0 +1,430 @@
+// Package tcpmux routes raw TCP connections to tcp:// subdomain backends by
+// the host name in the first bytes the client sends.
+package tcpmux
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "crypto/tls"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/SrLiath/ProxSize/config"
+    "github.com/SrLiath/ProxSize/router"
+)
+
+// Routing is what the multiplexer needs to route a connection. Reloads
+// replace it with Server.Update; sessions already open keep the routing they
+// started with.
+type Routing struct {
+    subdomains map[string]router.Route
+    acl        *router.ACL
+    connLimit  *router.RateLimiter
+    cap        *router.ConnLimiter
+    global     *router.ConnLimiter
+    timeouts   config.TimeoutsConfig
+}
+
+// NewRouting routes connections on port to the tcp:// rules of table, with
+// the access list and limits of the port's listener config.
+func NewRouting(port int, table *router.Table, listenerCfg config.ListenerConfig) *Routing {
+    routing := &Routing{
+        subdomains: table.TCP,
+        acl:        router.NewACL(listenerCfg.Allow, listenerCfg.Deny, fmt.Sprintf("listener %d", port)),
+        cap:        table.ConnLimiter(fmt.Sprintf("listener:%d", port), listenerCfg.MaxConnections, time.Duration(listenerCfg.QueueTimeout)),
+        global:     table.Global,
+        timeouts:   config.DefaultTimeouts.Merge(listenerCfg.Timeouts),
+    }
+    if listenerCfg.ConnRateLimit != nil {
+        routing.connLimit = table.RateLimiter(fmt.Sprintf("listener:%d", port), *listenerCfg.ConnRateLimit)
+    }
+    return routing
+}
+
+// Observer is told about the backends and sessions a Server handles.
+type Observer interface {
+    Dialed(target string, ok bool)
+    Opened(target string)
+    Closed(target string, in, out int64)
+    Finished(s Session)
+}
+
+// Server multiplexes the connections accepted on one listener to backends,
+// by the host name the client sends first.
+type Server struct {
+    port     int
+    observer Observer
+    routing  atomic.Pointer[Routing]
+    sessions sync.WaitGroup
+    connsMu  sync.Mutex
+    conns    map[net.Conn]struct{}
+}
+
+// Serve accepts connections on ln until it is closed. observer may be nil.
+func Serve(ln net.Listener, port int, routing *Routing, observer Observer) *Server {
+    s := &Server{port: port, observer: observer, conns: map[net.Conn]struct{}{}}
+    s.routing.Store(routing)
+
+    // The accept loop counts as a session so Drain can't finish while it
+    // might still hand off a connection.
+    s.sessions.Add(1)
+    go func() {
+        defer s.sessions.Done()
+        log.Printf("🔌 TCP Server listening on %s for subdomains", ln.Addr())
+        for {
+            conn, err := ln.Accept()
+            if errors.Is(err, net.ErrClosed) {
+                return
+            }
+            if err != nil {
+                log.Printf("❌ Error accepting TCP connection: %v", err)
+                continue
+            }
+            rt := s.routing.Load()
+            if ip := router.RemoteIP(conn.RemoteAddr()); !rt.acl.Allows(ip) {
+                log.Printf("🚫 TCP client %s denied on port %d", ip, port)
+                s.reject(conn, "denied")
+                continue
+            }
+            if rt.connLimit != nil {
+                if ok, _ := rt.connLimit.Allow(rt.connLimit.Key(nil, router.RemoteIP(conn.RemoteAddr()))); !ok {
+                    log.Printf("🐢 TCP connection rate exceeded on port %d by %s", port, conn.RemoteAddr())
+                    s.reject(conn, "rate limited")
+                    continue
+                }
+            }
+            // Waiting for a slot here applies backpressure on accept
+            // instead of spawning a goroutine per connection.
+            if !rt.cap.Acquire() {
+                log.Printf("⛔ Port %d at its connection limit, closing %s", port, conn.RemoteAddr())
+                s.reject(conn, "connection limit")
+                continue
+            }
+            if !rt.global.Acquire() {
+                log.Printf("⛔ Global connection limit reached, closing %s", conn.RemoteAddr())
+                rt.cap.Release()
+                s.reject(conn, "connection limit")
+                continue
+            }
+            s.track(conn, true)
+            go func() {
+                defer s.track(conn, false)
+                defer rt.cap.Release()
+                defer rt.global.Release()
+                s.handle(conn, rt.subdomains, rt.timeouts)
+            }()
+        }
+    }()
+
+    return s
+}
+
+// reject closes a connection turned away by the listener's access list or
+// limits, and still reports it as a session.
+func (s *Server) reject(conn net.Conn, reason string) {
+    conn.Close()
+    if s.observer != nil {
+        s.observer.Finished(Session{Type: "tcp", Client: conn.RemoteAddr().String(), CloseReason: reason})
+    }
+}
+
+// Update swaps in new routing for the connections accepted from now on.
+func (s *Server) Update(routing *Routing) {
+    s.routing.Store(routing)
+}
+
+// Drain waits for the accept loop and the open sessions to finish, once the
+// listener is closed. If ctx ends first, the remaining sessions are closed
+// and their number returned.
+func (s *Server) Drain(ctx context.Context) int {
+    done := make(chan struct{})
+    go func() {
+        s.sessions.Wait()
+        close(done)
+    }()
+    select {
+    case <-done:
+        return 0
+    case <-ctx.Done():
+    }
+    s.connsMu.Lock()
+    closed := len(s.conns)
+    for conn := range s.conns {
+        conn.Close()
+    }
+    s.connsMu.Unlock()
+    <-done
+    return closed
+}
+
+// track records open sessions so Drain can wait for them and close the
+// stragglers.
+func (s *Server) track(conn net.Conn, open bool) {
+    s.connsMu.Lock()
+    defer s.connsMu.Unlock()
+    if open {
+        s.sessions.Add(1)
+        s.conns[conn] = struct{}{}
+    } else {
+        delete(s.conns, conn)
+        s.sessions.Done()
+    }
+}
+
+func (s *Server) handle(client net.Conn, subdomains map[string]router.Route, timeouts config.TimeoutsConfig) {
+    defer client.Close()
+    rec := Session{Type: "tcp", Client: client.RemoteAddr().String()}
+    start := time.Now()
+    defer func() {
+        rec.DurationMS = float64(time.Since(start).Microseconds()) / 1000
+        if s.observer != nil {
+            s.observer.Finished(rec)
+        }
+    }()
+
+    buffer := make([]byte, sniffSize)
+    if timeouts.TCPSniff > 0 {
+        client.SetReadDeadline(time.Now().Add(time.Duration(timeouts.TCPSniff)))
+    }
+    n, err := client.Read(buffer)
+    if err != nil {
+        log.Printf("❌ Error reading initial data: %v", err)
+        rec.CloseReason = "sniff failed: " + err.Error()
+        return
+    }
+    // A ClientHello can arrive over several reads; wait for its whole record.
+    for n < recordEnd(buffer[:n]) {
+        m, err := client.Read(buffer[n:])
+        n += m
+        if err != nil {
+            break
+        }
+    }
+    client.SetReadDeadline(time.Time{})
+    rec.BytesIn = int64(n)
+
+    host := extractHostname(buffer[:n], client.RemoteAddr().String())
+    if host == "" {
+        log.Printf("❌ Could not identify hostname from TCP connection")
+        rec.CloseReason = "no hostname"
+        return
+    }
+    rec.Host = host
+
+    sub := strings.ToLower(strings.SplitN(host, ".", 2)[0])
+    if route, found := subdomains[sub]; found {
+        if ip := router.RemoteIP(client.RemoteAddr()); !route.ACL.Allows(ip) {
+            log.Printf("🚫 TCP client %s denied for subdomain %q", ip, sub)
+            rec.CloseReason = "denied"
+            return
+        }
+        targetAddr := strings.TrimPrefix(route.Target, "tcp://")
+        rec.Target = targetAddr
+        log.Printf("🎯 TCP Subdomain match: %s -> %s", sub, targetAddr)
+        if !route.Backend.Acquire() {
+            log.Printf("⛔ Backend %q at its connection limit, closing %s", targetAddr, client.RemoteAddr())
+            rec.CloseReason = "backend connection limit"
+            return
+        }
+        defer route.Backend.Release()
+        dialStart := time.Now()
+        backend, err := net.Dial("tcp", targetAddr)
+        rec.ConnectMS = float64(time.Since(dialStart).Microseconds()) / 1000
+        if err != nil {
+            log.Printf("❌ Error connecting to TCP target (%s): %v", targetAddr, err)
+            rec.CloseReason = "dial failed: " + err.Error()
+            if s.observer != nil {
+                s.observer.Dialed(route.Target, false)
+            }
+            return
+        }
+        defer backend.Close()
+        if s.observer != nil {
+            s.observer.Dialed(route.Target, true)
+            s.observer.Opened(route.Target)
+            defer func() {
+                s.observer.Closed(route.Target, rec.BytesIn, rec.BytesOut)
+            }()
+        }
+
+        _, _ = backend.Write(buffer[:n])
+        in, out, reason := pipe(client, backend, time.Duration(timeouts.TCPIdle))
+        rec.BytesIn += in
+        rec.BytesOut = out
+        rec.CloseReason = reason
+        return
+    }
+
+    log.Printf("❌ No destination found for TCP subdomain: %s", host)
+    rec.CloseReason = "no route"
+}
+
+// pipe copies data both ways and returns once both directions are done, so
+// the caller's deferred cleanup runs when the session actually ends. With an
+// idle timeout, the session is closed after that long without traffic in
+// either direction. It reports the bytes sent by the client (in) and by the
+// backend (out), and why the session ended.
+func pipe(client, backend net.Conn, idle time.Duration) (in, out int64, reason string) {
+    var lastActivity atomic.Int64
+    lastActivity.Store(time.Now().UnixNano())
+    var closeReason atomic.Value
+    setReason := func(r string) {
+        closeReason.CompareAndSwap(nil, r)
+    }
+
+    type result struct {
+        fromClient bool
+        n          int64
+    }
+    done := make(chan result, 2)
+    copyHalf := func(dst, src net.Conn, fromClient bool) {
+        var n int64
+        var err error
+        if idle <= 0 {
+            n, err = io.Copy(dst, src)
+        } else {
+            buf := make([]byte, 32*1024)
+            for {
+                src.SetReadDeadline(time.Now().Add(idle))
+                nr, rerr := src.Read(buf)
+                if nr > 0 {
+                    lastActivity.Store(time.Now().UnixNano())
+                    dst.SetWriteDeadline(time.Now().Add(idle))
+                    nw, werr := dst.Write(buf[:nr])
+                    n += int64(nw)
+                    if werr != nil {
+                        err = werr
+                        break
+                    }
+                }
+                if rerr != nil {
+                    var ne net.Error
+                    if errors.As(rerr, &ne) && ne.Timeout() {
+                        // Only idle if the other direction has been quiet too.
+                        if time.Since(time.Unix(0, lastActivity.Load())) < idle {
+                            continue
+                        }
+                        log.Printf("⌛ TCP session %s idle for %s, closing", client.RemoteAddr(), idle)
+                        setReason("idle timeout")
+                        client.Close()
+                        backend.Close()
+                    } else if rerr != io.EOF {
+                        err = rerr
+                    }
+                    break
+                }
+            }
+        }
+        switch {
+        case err != nil && fromClient:
+            setReason("client error: " + err.Error())
+        case err != nil:
+            setReason("backend error: " + err.Error())
+        case fromClient:
+            setReason("client closed")
+        default:
+            setReason("backend closed")
+        }
+        if tc, ok := dst.(*net.TCPConn); ok {
+            tc.CloseWrite()
+        } else {
+            dst.Close()
+        }
+        done <- result{fromClient: fromClient, n: n}
+    }
+    go copyHalf(backend, client, true)
+    go copyHalf(client, backend, false)
+    for i := 0; i < 2; i++ {
+        r := <-done
+        if r.fromClient {
+            in = r.n
+        } else {
+            out = r.n
+        }
+    }
+    reason, _ = closeReason.Load().(string)
+    return in, out, reason
+}
+
+// sniffSize is the most read from a client before routing it: a whole TLS
+// record, which is as large as a ClientHello gets.
+const sniffSize = 5 + 16384
+
+// recordEnd returns the length of the TLS handshake record at the start of
+// data, or 0 if data doesn't start with one.
+func recordEnd(data []byte) int {
+    if len(data) < 5 || data[0] != 0x16 || data[1] != 3 {
+        return 0
+    }
+    return min(5+int(data[3])<<8|int(data[4]), sniffSize)
+}
+
+// extractHostname finds the host name a connection is for: the SNI of a TLS
+// ClientHello, or the Host header of an HTTP request.
+func extractHostname(data []byte, remoteAddr string) string {
+    if recordEnd(data) > 0 {
+        return serverName(data)
+    }
+    s := string(data)
+    if strings.HasPrefix(s, "GET ") || strings.HasPrefix(s, "POST ") {
+        scanner := bufio.NewScanner(bytes.NewReader(data))
+        for scanner.Scan() {
+            line := scanner.Text()
+            if strings.HasPrefix(line, "Host:") {
+                return strings.TrimSpace(strings.TrimPrefix(line, "Host:"))
+            }
+            if line == "" {
+                break
+            }
+        }
+    }
+    return ""
+}
+
+// serverName returns the SNI host name of the ClientHello in data, or "".
+// crypto/tls parses it, from a conn that only replays data, and the handshake
+// is abandoned as soon as the hello is read.
+func serverName(data []byte) string {
+    var name string
+    conn := tls.Server(replayConn{Reader: bytes.NewReader(data)}, &tls.Config{
+        GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+            name = hello.ServerName
+            return nil, errSniffed
+        },
+    })
+    conn.Handshake()
+    return name
+}
+
+var errSniffed = errors.New("client hello sniffed")
+
+// replayConn reads from a buffer and discards what is written to it, for
+// serverName. Nothing else of net.Conn is used during the handshake.
+type replayConn struct {
+    net.Conn
+    *bytes.Reader
+}
+
+func (c replayConn) Read(p []byte) (int, error)  { return c.Reader.Read(p) }
+func (c replayConn) Write(p []byte) (int, error) { return len(p), nil }
+
+// Session describes a finished session, as passed to Observer.Finished.
+type Session struct {
+    Type        string  `json:"type"`
+    Time        string  `json:"time"`
+    Client      string  `json:"client"`
+    Host        string  `json:"host,omitempty"`
+    Target      string  `json:"target,omitempty"`
+    ConnectMS   float64 `json:"connect_ms,omitempty"`
+    BytesIn     int64   `json:"bytes_in"`
+    BytesOut    int64   `json:"bytes_out"`
+    DurationMS  float64 `json:"duration_ms"`
+    CloseReason string  `json:"close_reason"`
+}
@@ -0,0 +1,277 @@
+package tcpmux
+
+import (
+    "context"
+    "crypto/tls"
+    "io"
+    "net"
+    "strings"
+    "testing"
+    "time"
+    "github.com/SrLiath/ProxSize/config"
+    "github.com/SrLiath/ProxSize/router"
+)
+
+// recorder is an Observer that hands finished sessions to the test.
+type recorder struct {
+    sessions chan Session
+}
+
+func (r *recorder) Dialed(target string, ok bool)      {}
+func (r *recorder) Opened(target string)               {}
+func (r *recorder) Closed(target string, in, out int64) {}
+
+func (r *recorder) Finished(s Session) {
+    r.sessions <- s
+}
+
+func (r *recorder) next(t *testing.T) Session {
+    t.Helper()
+    select {
+    case s := <-r.sessions:
+        return s
+    case <-time.After(5 * time.Second):
+        t.Fatal("no session finished")
+        return Session{}
+    }
+}
+
+// serve runs a multiplexer for the tcp rules on a free port.
+func serve(t *testing.T, tcp map[string]config.RouteEntry, lc config.ListenerConfig) (string, *recorder) {
+    t.Helper()
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    rec := &recorder{sessions: make(chan Session, 16)}
+    table := router.Build(config.Rules{TCP: tcp}, nil)
+    srv := Serve(ln, 0, NewRouting(0, table, lc), rec)
+    t.Cleanup(func() {
+        ln.Close()
+        srv.Drain(context.Background())
+    })
+    return ln.Addr().String(), rec
+}
+
+// echo runs a TCP server that writes back what it reads.
+func echo(t *testing.T) string {
+    t.Helper()
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { ln.Close() })
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                defer conn.Close()
+                io.Copy(conn, conn)
+            }()
+        }
+    }()
+    return ln.Addr().String()
+}
+
+func dial(t *testing.T, addr string) net.Conn {
+    t.Helper()
+    conn, err := net.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { conn.Close() })
+    return conn
+}
+
+func preamble(host string) string {
+    return "GET / HTTP/1.1\r\nHost: " + host + "\r\n\r\n"
+}
+
+// clientHello returns the first TLS record a client sends for serverName.
+// Long ALPN protocol names make it larger than a single small read.
+func clientHello(t *testing.T, serverName string) string {
+    t.Helper()
+    client, server := net.Pipe()
+    defer server.Close()
+    var protos []string
+    for _, c := range "abcd" {
+        protos = append(protos, strings.Repeat(string(c), 250))
+    }
+    go tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true, NextProtos: protos}).Handshake()
+    header := make([]byte, 5)
+    if _, err := io.ReadFull(server, header); err != nil {
+        t.Fatal(err)
+    }
+    record := make([]byte, int(header[3])<<8|int(header[4]))
+    if _, err := io.ReadFull(server, record); err != nil {
+        t.Fatal(err)
+    }
+    client.Close()
+    return string(header) + string(record)
+}
+
+func TestExtractHostname(t *testing.T) {
+    tests := []struct {
+        name, data, want string
+    }{
+        {"HTTP Host header", preamble("git.example.com"), "git.example.com"},
+        {"POST request", "POST /x HTTP/1.1\r\nHost: api.example.com\r\n\r\n", "api.example.com"},
+        {"TLS server name", clientHello(t, "db.example.com"), "db.example.com"},
+        {"TLS without server name", clientHello(t, ""), ""},
+        {"truncated ClientHello", clientHello(t, "db.example.com")[:100], ""},
+        {"SSH banner", "SSH-2.0-OpenSSH\r\n", ""},
+    }
+    for _, tt := range tests {
+        if got := extractHostname([]byte(tt.data), ""); got != tt.want {
+            t.Errorf("%s: extractHostname() = %q, want %q", tt.name, got, tt.want)
+        }
+    }
+}
+
+func TestTimeouts(t *testing.T) {
+    backend := echo(t)
+    rules := map[string]config.RouteEntry{"echo": {Target: "tcp://" + backend}}
+    tests := []struct {
+        name     string
+        timeouts config.TimeoutsConfig
+        send     string
+        reason   string
+    }{
+        {"client never sends", config.TimeoutsConfig{TCPSniff: config.Duration(50 * time.Millisecond)}, "", "sniff failed"},
+        {"idle session", config.TimeoutsConfig{TCPIdle: config.Duration(50 * time.Millisecond)}, preamble("echo.example.com"), "idle timeout"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            timeouts := tt.timeouts
+            addr, rec := serve(t, rules, config.ListenerConfig{Timeouts: &timeouts})
+            conn := dial(t, addr)
+            if tt.send != "" {
+                conn.Write([]byte(tt.send))
+            }
+            start := time.Now()
+            // The multiplexer closes the connection once the timeout hits.
+            conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+            io.Copy(io.Discard, conn)
+            if elapsed := time.Since(start); elapsed > 2*time.Second {
+                t.Errorf("closed after %s", elapsed)
+            }
+            if s := rec.next(t); !strings.HasPrefix(s.CloseReason, tt.reason) {
+                t.Errorf("close reason = %q, want %q", s.CloseReason, tt.reason)
+            }
+        })
+    }
+}
+
+// closedAddr is an address nothing listens on.
+func closedAddr(t *testing.T) string {
+    t.Helper()
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    addr := ln.Addr().String()
+    ln.Close()
+    return addr
+}
+
+func TestSessions(t *testing.T) {
+    backend := echo(t)
+    rules := map[string]config.RouteEntry{
+        "echo":    {Target: "tcp://" + backend},
+        "down":    {Target: "tcp://" + closedAddr(t)},
+        "private": {Target: "tcp://" + backend, Deny: []string{"127.0.0.1"}},
+    }
+    addr, rec := serve(t, rules, config.ListenerConfig{})
+    hello := clientHello(t, "echo.example.com")
+
+    tests := []struct {
+        name   string
+        send   string
+        want   Session
+        reason string
+    }{
+        {"proxied", preamble("echo.example.com"), Session{Host: "echo.example.com", Target: backend, BytesIn: 42, BytesOut: 42}, "client closed"},
+        {"host name in upper case", preamble("ECHO.example.com"), Session{Host: "ECHO.example.com", Target: backend, BytesIn: 42, BytesOut: 42}, "client closed"},
+        {"proxied by SNI", hello, Session{Host: "echo.example.com", Target: backend, BytesIn: int64(len(hello)), BytesOut: int64(len(hello))}, "client closed"},
+        {"no route", preamble("nowhere.example.com"), Session{Host: "nowhere.example.com", BytesIn: 45}, "no route"},
+        {"no hostname", "SSH-2.0-OpenSSH\r\n", Session{BytesIn: 17}, "no hostname"},
+        {"route denies the client", preamble("private.example.com"), Session{Host: "private.example.com", BytesIn: 45}, "denied"},
+        {"backend down", preamble("down.example.com"), Session{Host: "down.example.com", Target: strings.TrimPrefix(rules["down"].Target, "tcp://"), BytesIn: 42}, "dial failed"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            conn := dial(t, addr)
+            conn.Write([]byte(tt.send))
+            conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+            if tt.want.BytesOut > 0 {
+                buf := make([]byte, tt.want.BytesOut)
+                if _, err := io.ReadFull(conn, buf); err != nil {
+                    t.Fatal(err)
+                }
+                conn.(*net.TCPConn).CloseWrite()
+            }
+            io.Copy(io.Discard, conn)
+
+            s := rec.next(t)
+            if !strings.HasPrefix(s.CloseReason, tt.reason) {
+                t.Errorf("close reason = %q, want %q", s.CloseReason, tt.reason)
+            }
+            if s.Type != "tcp" || s.Client != conn.LocalAddr().String() {
+                t.Errorf("session type %q from %q, want tcp from %s", s.Type, s.Client, conn.LocalAddr())
+            }
+            if s.Host != tt.want.Host || s.Target != tt.want.Target || s.BytesIn != tt.want.BytesIn || s.BytesOut != tt.want.BytesOut {
+                t.Errorf("session = %+v, want %+v", s, tt.want)
+            }
+        })
+    }
+}
+
+func TestRejectedSessions(t *testing.T) {
+    backend := echo(t)
+    rules := map[string]config.RouteEntry{"echo": {Target: "tcp://" + backend}}
+    tests := []struct {
+        name     string
+        listener config.ListenerConfig
+        reason   string
+    }{
+        {"listener denies the client", config.ListenerConfig{Deny: []string{"127.0.0.0/8"}}, "denied"},
+        {"connection rate", config.ListenerConfig{ConnRateLimit: &config.RateLimitConfig{Rate: 0.01, Burst: 1}}, "rate limited"},
+        {"listener at its limit", config.ListenerConfig{MaxConnections: 1, QueueTimeout: config.Duration(10 * time.Millisecond)}, "connection limit"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            addr, rec := serve(t, rules, tt.listener)
+            // Hold an open session so the rate and connection limits are
+            // used up; with the deny list this one is turned away too.
+            first := dial(t, addr)
+            first.Write([]byte(preamble("echo.example.com")))
+            if tt.reason == "denied" {
+                if s := rec.next(t); s.CloseReason != "denied" {
+                    t.Fatalf("close reason = %q, want denied", s.CloseReason)
+                }
+            } else {
+                first.SetReadDeadline(time.Now().Add(5 * time.Second))
+                if _, err := io.ReadFull(first, make([]byte, 42)); err != nil {
+                    t.Fatal(err)
+                }
+            }
+
+            conn := dial(t, addr)
+            conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+            if n, _ := io.Copy(io.Discard, conn); n != 0 {
+                t.Errorf("rejected connection got %d bytes", n)
+            }
+            s := rec.next(t)
+            if s.CloseReason != tt.reason {
+                t.Errorf("close reason = %q, want %q", s.CloseReason, tt.reason)
+            }
+            if s.Client != conn.LocalAddr().String() {
+                t.Errorf("session client = %q, want %s", s.Client, conn.LocalAddr())
+            }
+            first.Close()
+        })
+    }
+}